@@ -1,5 +1,191 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
 package main
 
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yuanfeng0905/go-mydumper/common"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+var (
+	flagUser, flagPasswd, flagHost, flagToUser, flagToPasswd, flagToHost, flagToDB string
+	flagDB, flagTable, flagRegexp, flagVars, flagMode, flagDorisLoadAddress        string
+	flagDir, flagReport                                                            string
+	flagDefaultsFile, flagPasswordFrom, flagToDefaultsFile, flagToPasswordFrom     string
+	flagPort, flagToPort, flagThreads, flagChunks                                  int
+	flagChecksum, flagRepair                                                       bool
+	flagSocket, flagToSocket                                                       string
+	tlsFlags, toTLSFlags                                                           *common.TLSFlags
+
+	log = xlog.NewStdLog(xlog.Level(xlog.INFO))
+)
+
+func init() {
+	flag.StringVar(&flagUser, "u", "", "Source username")
+	flag.StringVar(&flagPasswd, "p", "", "Source user password, visible in ps: prefer -defaults-file or -password-from")
+	flag.StringVar(&flagDefaultsFile, "defaults-file", "", "MySQL option file to read the source [client] and [checker] user, password, host and port from")
+	flag.StringVar(&flagPasswordFrom, "password-from", "", "Read the source password from env:NAME, file:PATH or prompt")
+	flag.StringVar(&flagHost, "h", "", "Source host to connect to")
+	flag.IntVar(&flagPort, "P", 3306, "Source TCP/IP port to connect to")
+	flag.StringVar(&flagSocket, "S", "", "Source unix socket file to connect to instead of the host and port")
+	tlsFlags = common.NewTLSFlags(flag.CommandLine, "", "source")
+	flag.StringVar(&flagToUser, "to-u", "", "Target username")
+	flag.StringVar(&flagToPasswd, "to-p", "", "Target user password, visible in ps: prefer -to-defaults-file or -to-password-from")
+	flag.StringVar(&flagToDefaultsFile, "to-defaults-file", "", "MySQL option file to read the target [client] and [checker] user, password, host and port from")
+	flag.StringVar(&flagToPasswordFrom, "to-password-from", "", "Read the target password from env:NAME, file:PATH or prompt")
+	flag.StringVar(&flagToHost, "to-h", "", "Target host to connect to")
+	flag.IntVar(&flagToPort, "to-P", 3306, "Target TCP/IP port to connect to")
+	flag.StringVar(&flagToSocket, "to-S", "", "Target unix socket file to connect to instead of the host and port")
+	toTLSFlags = common.NewTLSFlags(flag.CommandLine, "to-", "target")
+	flag.StringVar(&flagToDB, "to-db", "", "Target database name if it differs from the source")
+	flag.StringVar(&flagDB, "db", "", "Databases to check, split by ,")
+	flag.StringVar(&flagRegexp, "regexp", "", "Regexp of the databases to check")
+	flag.StringVar(&flagTable, "table", "", "Tables to check, split by ,")
+	flag.IntVar(&flagThreads, "t", 8, "Number of threads to use")
+	flag.StringVar(&flagVars, "vars", "", "Session variables, split by ;")
+	flag.BoolVar(&flagChecksum, "checksum", false, "Compare CRC aggregates of the rows besides the row counts")
+	flag.IntVar(&flagChunks, "chunks", 16, "Number of primary key ranges for the checksum")
+	flag.StringVar(&flagReport, "report", "", "File to write the JSON report to (default stdout)")
+	flag.BoolVar(&flagRepair, "repair", false, "Dump the mismatched tables from the source and load them into the target")
+	flag.StringVar(&flagDir, "d", "./checker-repair", "Directory for the repair dumps")
+	flag.StringVar(&flagMode, "m", "", "doris mode for support Doris MPP (default \"mysql\")")
+	flag.StringVar(&flagDorisLoadAddress, "dp", "", "doris mode for HTTP Load address (example: \"127.0.0.1:8040,127.0.0.2:8040\")")
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " -h [HOST] -P [PORT] -u [USER] -p [PASSWORD] -to-h [HOST] -to-P [PORT] -to-u [USER] -to-p [PASSWORD] -db [DB] [-checksum] [-repair]")
+	flag.PrintDefaults()
+}
+
+// recoveryFlags overrides the credentials and connections by the flags given on the command line.
+func recoveryFlags(args *common.Args) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["u"] {
+		args.User = flagUser
+	}
+	if set["p"] {
+		args.Password = flagPasswd
+	}
+	args.Address = overrideAddress(args.Address, set["S"], flagSocket, set["h"], flagHost, set["P"], flagPort)
+	if set["to-u"] {
+		args.ToUser = flagToUser
+	}
+	if set["to-p"] {
+		args.ToPassword = flagToPasswd
+	}
+	args.ToAddress = overrideAddress(args.ToAddress, set["to-S"], flagToSocket, set["to-h"], flagToHost, set["to-P"], flagToPort)
+
+	var err error
+	args.TLS, err = tlsFlags.Override(args.TLS, set)
+	common.AssertNil(err)
+	args.ToTLS, err = toTLSFlags.Override(args.ToTLS, set)
+	common.AssertNil(err)
+}
+
+// overrideAddress replaces the host and port of the address which are given, the socket replaces both.
+func overrideAddress(address string, setSocket bool, socket string, setHost bool, host string, setPort bool, port int) string {
+	if setSocket {
+		return "unix:" + socket
+	}
+	if !setHost && !setPort {
+		return address
+	}
+	h, p, err := net.SplitHostPort(address)
+	if err != nil {
+		p = strconv.Itoa(port)
+	}
+	if setHost {
+		h = host
+	}
+	if setPort {
+		p = strconv.Itoa(port)
+	}
+	return net.JoinHostPort(h, p)
+}
+
+// hasServer returns true if the address has a host or is a socket.
+func hasServer(address string) bool {
+	if strings.HasPrefix(address, "unix:") {
+		return len(address) > len("unix:")
+	}
+	host, _, _ := net.SplitHostPort(address)
+	return host != ""
+}
+
 func main() {
+	flag.Usage = func() { usage() }
+	flag.Parse()
+
+	args := &common.Args{
+		Mode:                 flagMode,
+		DorisHttpLoadAddress: strings.Split(flagDorisLoadAddress, ","),
+		User:                 flagUser,
+		Password:             flagPasswd,
+		Address:              fmt.Sprintf("%s:%d", flagHost, flagPort),
+		ToUser:               flagToUser,
+		ToPassword:           flagToPasswd,
+		ToAddress:            fmt.Sprintf("%s:%d", flagToHost, flagToPort),
+		ToDatabase:           flagToDB,
+		Database:             flagDB,
+		DatabaseRegexp:       flagRegexp,
+		Table:                flagTable,
+		Outdir:               flagDir,
+		SessionVars:          flagVars,
+		Threads:              flagThreads,
+		ChunksizeInMB:        128,
+		StmtSize:             1000000,
+		IntervalMs:           10 * 1000,
+		Checksum:             flagChecksum,
+		ChecksumChunks:       flagChunks,
+		Repair:               flagRepair,
+	}
+
+	// The option files, then the flags given, then the password sources for the users of them.
+	src := &common.Credentials{DefaultsFile: flagDefaultsFile}
+	common.AssertNil(src.Apply("checker", &args.User, &args.Password, &args.Address))
+	dst := &common.Credentials{DefaultsFile: flagToDefaultsFile}
+	common.AssertNil(dst.Apply("checker", &args.ToUser, &args.ToPassword, &args.ToAddress))
+	recoveryFlags(args)
+	src = &common.Credentials{PasswordFrom: flagPasswordFrom}
+	common.AssertNil(src.Apply("checker", &args.User, &args.Password, &args.Address))
+	dst = &common.Credentials{PasswordFrom: flagToPasswordFrom}
+	common.AssertNil(dst.Apply("checker", &args.ToUser, &args.ToPassword, &args.ToAddress))
+
+	if !hasServer(args.Address) || args.User == "" || !hasServer(args.ToAddress) || args.ToUser == "" {
+		usage()
+		os.Exit(0)
+	}
+
+	report := common.Checker(log, args)
+	data, err := json.MarshalIndent(report, "", "  ")
+	common.AssertNil(err)
+	if flagReport != "" {
+		common.AssertNil(common.WriteFile(flagReport, string(data)+"\n"))
+	} else {
+		fmt.Println(string(data))
+	}
 
+	for _, t := range report.Tables {
+		if !t.Match && !t.Repaired {
+			os.Exit(1)
+		}
+	}
 }
@@ -10,9 +10,12 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 
 	"github.com/yuanfeng0905/go-mydumper/common"
 
@@ -20,84 +23,200 @@ import (
 )
 
 var (
-	flagUser, flagPasswd, flagHost, flagConfig, flagBiz, flagDB, flagTable, flagOutDir, flagMode, flagVars string
-	flagPort, flagThreads, flagChunkSize                                                                   *int
+	flagUser, flagPasswd, flagHost, flagConfig, flagBiz, flagDB, flagTable, flagOutDir, flagMode, flagVars, flagMetricsAddr, flagKeyFile string
+	flagPort, flagThreads, flagChunkSize                                                                                                 *int
+	flagMaxMB, flagMaxRows, flagMaxThreadsRunning, flagMaxReplicaLag, flagMaxPerDatabase                                                 int
+	flagChunkRows, flagStmtSize, flagMaxAllowedPacket, flagDorisBuckets                                                                  int
+	flagDefaultsFile, flagPasswordFrom, flagSample                                                                                       string
+	flagCompress, flagStream, flagDryRun                                                                                                 bool
+
+	flagSocket string
+	tlsFlags   *common.TLSFlags
 
 	log = xlog.NewStdLog(xlog.Level(xlog.INFO))
 )
 
 func init() {
 	flag.StringVar(&flagUser, "u", "", "Username with privileges to run the loader")
-	flag.StringVar(&flagPasswd, "p", "", "User password")
+	flag.StringVar(&flagPasswd, "p", "", "User password, visible in ps: prefer -defaults-file or -password-from")
+	flag.StringVar(&flagDefaultsFile, "defaults-file", "", "MySQL option file to read the [client] and [mydumper] user, password, host and port from")
+	flag.StringVar(&flagPasswordFrom, "password-from", "", "Read the password from env:NAME, file:PATH or prompt")
 	flag.StringVar(&flagHost, "h", "", "The host to connect to")
 	flagPort = flag.Int("P", 3306, "TCP/IP port to connect to")
-	flag.StringVar(&flagConfig, "c", "", "config file")
+	flag.StringVar(&flagSocket, "S", "", "Unix socket file to connect to instead of the host and port")
+	tlsFlags = common.NewTLSFlags(flag.CommandLine, "", "MySQL")
+	flag.StringVar(&flagConfig, "c", "", "config file, shared with myloader")
 	flag.StringVar(&flagBiz, "biz", "", "source biz")
 	flag.StringVar(&flagDB, "db", "", "source db")
 	flag.StringVar(&flagTable, "table", "", "source table")
-	flag.StringVar(&flagOutDir, "d", "", "Directory of the dump to import")
+	flag.StringVar(&flagOutDir, "d", "", "Directory to dump to, or s3://bucket/prefix")
 	flagThreads = flag.Int("t", 16, "Number of threads to use")
-	flag.StringVar(&flagMode, "m", "", "doris mode for support Doris MPP (default \"mysql\")")
+	flag.StringVar(&flagMode, "m", "", "doris mode for support Doris MPP, parquet mode for columnar files (default \"mysql\")")
 	flagChunkSize = flag.Int("chunk-size", 128, "default chunk size (MB)")
+	flag.IntVar(&flagChunkRows, "chunk-rows", 0, "Split the tables into chunks of this many rows instead of the chunk size")
+	flag.IntVar(&flagStmtSize, "stmt-size", 1000000, "Split the INSERT statements at this size (bytes)")
+	flag.IntVar(&flagMaxAllowedPacket, "max-allowed-packet", 0, "max_allowed_packet of the restore target, the INSERT statements stay under it (default the source's)")
+	flag.IntVar(&flagDorisBuckets, "doris-buckets", 10, "Buckets of the Doris tables translated in doris mode, 0 is AUTO")
 	flag.StringVar(&flagVars, "vars", "", "variables")
+	flag.StringVar(&flagSample, "sample", "", "Sample the root tables by percent or rows and follow their foreign keys (example: \"orders=10%,users=1000\")")
+	flag.IntVar(&flagMaxMB, "max-mb-per-sec", 0, "Limit the dump bandwidth in MB/s of all threads (default unlimited)")
+	flag.IntVar(&flagMaxRows, "max-rows-per-sec", 0, "Limit the dumped rows per second of all threads (default unlimited)")
+	flag.IntVar(&flagMaxThreadsRunning, "max-threads-running", 0, "Pause dumping while the source Threads_running exceeds this")
+	flag.IntVar(&flagMaxReplicaLag, "max-replica-lag", 0, "Pause dumping while the source replica lag exceeds this in seconds")
+	flag.IntVar(&flagMaxPerDatabase, "max-threads-per-database", 0, "Dump at most this many tables of one database at once (default unlimited)")
+	flag.StringVar(&flagMetricsAddr, "metrics-addr", "", "Address to expose the Prometheus metrics on (example: \":9104\")")
+	flag.BoolVar(&flagCompress, "compress", false, "Gzip the dump files")
+	flag.BoolVar(&flagStream, "stream", false, "Write the whole dump as a tar stream to stdout instead of the directory, the logs go to stderr")
+	flag.BoolVar(&flagDryRun, "dry-run", false, "Print the tables to dump with their rules and estimated rows, size and chunks, without dumping")
+	flag.StringVar(&flagKeyFile, "encryption-key-file", "", "Encrypt the dump files with the 32 bytes key of this file (raw, hex or base64), or set MYDUMPER_ENCRYPTION_KEY")
 
 }
 
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " -c conf/mydumper.ini.sample")
+	fmt.Println("The values are taken from the flags, then the MYDUMPER_* environment, then the config file, then the defaults.")
 	flag.PrintDefaults()
 }
 
 // 解析命令行，覆盖
+// Only the flags given on the command line override the config, the defaults of the flags don't.
 func recoveryConfig(args *common.Args) {
-	if flagHost != "" && flagPort != nil {
-		args.Address = fmt.Sprintf("%s:%d", flagHost, *flagPort)
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	args.TLS, err = tlsFlags.Override(args.TLS, set)
+	common.AssertNil(err)
+
+	if set["S"] {
+		args.Address = "unix:" + flagSocket
+	} else if set["h"] || set["P"] {
+		host, port, err := net.SplitHostPort(args.Address)
+		if err != nil {
+			// The socket of the config is replaced by the TCP address.
+			port = strconv.Itoa(*flagPort)
+		}
+		if set["h"] {
+			host = flagHost
+		}
+		if set["P"] {
+			port = strconv.Itoa(*flagPort)
+		}
+		args.Address = net.JoinHostPort(host, port)
 	}
-	if flagUser != "" {
+	if set["u"] {
 		args.User = flagUser
 	}
-	if flagPasswd != "" {
+	if set["p"] {
 		args.Password = flagPasswd
 	}
-	if flagBiz != "" {
+	if set["biz"] {
 		args.Biz = flagBiz
 	}
-	if flagDB != "" {
+	if set["db"] {
 		args.Database = flagDB
 	}
-	if flagTable != "" {
+	if set["table"] {
 		args.Table = flagTable
 	}
-	if flagThreads != nil {
+	if set["t"] {
 		args.Threads = *flagThreads
 	}
-	if flagOutDir != "" {
+	if set["d"] {
 		args.Outdir = flagOutDir
 	}
-	if flagMode != "" {
+	if set["m"] {
 		args.Mode = flagMode
 	}
-	if flagChunkSize != nil {
+	if set["chunk-size"] {
 		args.ChunksizeInMB = *flagChunkSize
 	}
-	if flagVars != "" {
+	if set["chunk-rows"] {
+		args.ChunkRows = flagChunkRows
+	}
+	if set["stmt-size"] {
+		args.StmtSize = flagStmtSize
+	}
+	if set["max-allowed-packet"] {
+		args.MaxAllowedPacket = flagMaxAllowedPacket
+	}
+	if set["doris-buckets"] {
+		args.DorisBuckets = flagDorisBuckets
+	}
+	if set["vars"] {
 		args.SessionVars = flagVars
 	}
+	if set["sample"] {
+		samples, err := common.ParseSamples(flagSample)
+		common.AssertNil(err)
+		args.Samples = samples
+	}
+	if set["max-mb-per-sec"] {
+		args.RateLimitMB = flagMaxMB
+	}
+	if set["max-rows-per-sec"] {
+		args.RateLimitRows = flagMaxRows
+	}
+	if set["max-threads-running"] {
+		args.MaxThreadsRunning = flagMaxThreadsRunning
+	}
+	if set["max-replica-lag"] {
+		args.MaxReplicaLag = flagMaxReplicaLag
+	}
+	if set["max-threads-per-database"] {
+		args.MaxThreadsPerDatabase = flagMaxPerDatabase
+	}
+	if set["compress"] {
+		args.Compress = flagCompress
+	}
+	if set["encryption-key-file"] {
+		args.EncryptionKeyFile = flagKeyFile
+	}
 }
 
 func main() {
 	flag.Usage = func() { usage() }
 	flag.Parse()
 
+	if flagStream {
+		log = xlog.NewXLog(os.Stderr, xlog.Level(xlog.INFO))
+	}
 	args, err := common.ParseDumperConfig(flagConfig)
 	common.AssertNil(err)
 
+	// The option file, then the flags given, then the password source for the user of them.
+	defaults := &common.Credentials{DefaultsFile: flagDefaultsFile}
+	common.AssertNil(defaults.Apply("mydumper", &args.User, &args.Password, &args.Address))
 	recoveryConfig(args)
+	source := &common.Credentials{PasswordFrom: flagPasswordFrom}
+	common.AssertNil(source.Apply("mydumper", &args.User, &args.Password, &args.Address))
+	if args.Outdir == "" && !flagStream && !flagDryRun {
+		fmt.Println("The dump directory is required, by -d or the outdir of the config.")
+		os.Exit(1)
+	}
 
-	if _, err := os.Stat(args.Outdir); os.IsNotExist(err) {
-		x := os.MkdirAll(args.Outdir, 0777)
-		common.AssertNil(x)
+	if flagDryRun {
+		plan, err := common.PlanDump(log, args)
+		common.AssertNil(err)
+		common.AssertNil(plan.Write(os.Stdout))
+		return
+	}
+	if flagMetricsAddr != "" {
+		common.AssertNil(common.ServeMetrics(log, flagMetricsAddr))
 	}
 
-	common.Dumper(log, args)
+	// SIGINT or SIGTERM stop the dump, SIGUSR1 logs the status of the threads.
+	ctx, interrupt := common.NotifyInterrupt(log)
+	if flagStream {
+		w := bufio.NewWriterSize(os.Stdout, 1<<20)
+		err = common.DumpStream(ctx, log, args, w)
+		common.AssertNil(w.Flush())
+	} else {
+		err = common.Dumper(ctx, log, args)
+	}
+	interrupt.Stop()
+	if err != nil {
+		log.Error("mydumper.error:%v", err)
+		os.Exit(interrupt.ExitCode())
+	}
 }
@@ -10,9 +10,12 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/yuanfeng0905/go-mydumper/common"
@@ -21,50 +24,213 @@ import (
 )
 
 var (
-	flagOverwriteTables                                                     bool
-	flagPort, flagThreads                                                   int
-	flagUser, flagPasswd, flagHost, flagDir, flagMode, flagDorisLoadAddress string
+	flagOverwriteTables, flagSkipVerify, flagAllowUnfinished, flagStream, flagDryRun                                                    bool
+	flagPort, flagThreads, flagMaxMB, flagMaxRows, flagMaxThreadsRunning, flagMaxReplicaLag, flagMaxPerTable, flagMaxPerDatabase        int
+	flagUser, flagPasswd, flagHost, flagDir, flagMode, flagDorisLoadAddress, flagFile, flagDB, flagMetricsAddr, flagKeyFile, flagConfig string
+	flagDefaultsFile, flagPasswordFrom, flagDorisUser, flagDorisPasswordFrom                                                            string
+
+	flagSocket string
+	tlsFlags   *common.TLSFlags
 
 	log = xlog.NewStdLog(xlog.Level(xlog.INFO))
 )
 
 func init() {
 	flag.StringVar(&flagUser, "u", "", "Username with privileges to run the loader")
-	flag.StringVar(&flagPasswd, "p", "", "User password")
+	flag.StringVar(&flagPasswd, "p", "", "User password, visible in ps: prefer -defaults-file or -password-from")
+	flag.StringVar(&flagDefaultsFile, "defaults-file", "", "MySQL option file to read the [client] and [myloader] user, password, host and port from")
+	flag.StringVar(&flagPasswordFrom, "password-from", "", "Read the password from env:NAME, file:PATH or prompt")
+	flag.StringVar(&flagDorisUser, "doris-user", "", "Username of the Doris HTTP load (default the -u one)")
+	flag.StringVar(&flagDorisPasswordFrom, "doris-password-from", "", "Read the Doris HTTP load password from env:NAME, file:PATH or prompt")
 	flag.StringVar(&flagHost, "h", "", "The host to connect to")
+	flag.StringVar(&flagConfig, "c", "", "config file, shared with mydumper, see the [loader] section")
 	flag.IntVar(&flagPort, "P", 3306, "TCP/IP port to connect to")
-	flag.StringVar(&flagDir, "d", "", "Directory of the dump to import")
+	flag.StringVar(&flagSocket, "S", "", "Unix socket file to connect to instead of the host and port")
+	tlsFlags = common.NewTLSFlags(flag.CommandLine, "", "MySQL")
+	flag.StringVar(&flagDir, "d", "", "Directory of the dump to import, or s3://bucket/prefix")
+	flag.BoolVar(&flagStream, "stream", false, "Import the tar stream of mydumper -stream from stdin")
+	flag.StringVar(&flagFile, "f", "", "Single mysqldump file to import, optionally gzipped")
+	flag.StringVar(&flagDB, "db", "", "Database to import the mysqldump file into when it has no USE statement")
 	flag.IntVar(&flagThreads, "t", 16, "Number of threads to use")
 	flag.BoolVar(&flagOverwriteTables, "o", false, "Drop tables if they already exist")
+	flag.IntVar(&flagMaxMB, "max-mb-per-sec", 0, "Limit the load bandwidth in MB/s of all threads (default unlimited)")
+	flag.IntVar(&flagMaxRows, "max-rows-per-sec", 0, "Limit the loaded rows per second of all threads, rows are known from the manifest (default unlimited)")
+	flag.IntVar(&flagMaxThreadsRunning, "max-threads-running", 0, "Pause loading while the target Threads_running exceeds this")
+	flag.IntVar(&flagMaxReplicaLag, "max-replica-lag", 0, "Pause loading while the target replica lag exceeds this in seconds")
+	flag.IntVar(&flagMaxPerTable, "max-threads-per-table", 0, "Load at most this many chunks of one table at once (default unlimited)")
+	flag.IntVar(&flagMaxPerDatabase, "max-threads-per-database", 0, "Load at most this many chunks of one database at once (default unlimited)")
+	flag.StringVar(&flagMetricsAddr, "metrics-addr", "", "Address to expose the Prometheus metrics on (example: \":9104\")")
+	flag.BoolVar(&flagSkipVerify, "skip-verify", false, "Skip verifying the dump files against the manifest")
+	flag.BoolVar(&flagAllowUnfinished, "allow-unfinished", false, "Load the dump interrupted or with unfinished tables anyway")
+	flag.BoolVar(&flagDryRun, "dry-run", false, "Print the load plan of the dump directory, without loading")
+	flag.StringVar(&flagKeyFile, "encryption-key-file", "", "Key file to decrypt the dump files, or set MYDUMPER_ENCRYPTION_KEY")
 	flag.StringVar(&flagMode, "m", "", "doris mode for support Doris MPP (default \"mysql\")")
 	flag.StringVar(&flagDorisLoadAddress, "dp", "", "doris mode for HTTP Load address (example: \"127.0.0.1:8040,127.0.0.2:8040\")")
 }
 
 func usage() {
 	fmt.Println("Usage: " + os.Args[0] + " -h [HOST] -P [PORT] -u [USER] -p [PASSWORD] -d [DIR] [-o]")
+	fmt.Println("       " + os.Args[0] + " -c conf/mydumper.ini.sample [-d DIR]")
+	fmt.Println("       " + os.Args[0] + " -h [HOST] -P [PORT] -u [USER] -p [PASSWORD] -f [MYSQLDUMP FILE] [-db DATABASE]")
+	fmt.Println("       " + os.Args[0] + " -h [HOST] -P [PORT] -u [USER] -p [PASSWORD] -stream [-o] < [TAR STREAM]")
+	fmt.Println("       " + os.Args[0] + " verify -d [DIR] [-t THREADS]")
 	flag.PrintDefaults()
 }
 
+// verify checks the dump directory against its manifest without loading it.
+func verify(arguments []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("d", "", "Directory of the dump to verify")
+	threads := fs.Int("t", 16, "Number of threads to use")
+	fs.Parse(arguments)
+
+	if *dir == "" {
+		usage()
+		os.Exit(0)
+	}
+	if err := common.VerifyDump(log, *dir, *threads); err != nil {
+		log.Error("verify.error:%v", err)
+		os.Exit(1)
+	}
+}
+
+// recoveryConfig overrides the config by the flags given on the command line.
+func recoveryConfig(args *common.Args) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	args.TLS, err = tlsFlags.Override(args.TLS, set)
+	common.AssertNil(err)
+
+	if set["S"] {
+		args.Address = "unix:" + flagSocket
+	} else if set["h"] || set["P"] {
+		host, port, err := net.SplitHostPort(args.Address)
+		if err != nil {
+			// The socket of the config is replaced by the TCP address.
+			port = strconv.Itoa(flagPort)
+		}
+		if set["h"] {
+			host = flagHost
+		}
+		if set["P"] {
+			port = strconv.Itoa(flagPort)
+		}
+		args.Address = net.JoinHostPort(host, port)
+	}
+	if set["u"] {
+		args.User = flagUser
+	}
+	if set["p"] {
+		args.Password = flagPasswd
+	}
+	if set["d"] {
+		args.Outdir = flagDir
+	}
+	if set["t"] {
+		args.Threads = flagThreads
+	}
+	if set["o"] {
+		args.OverwriteTables = flagOverwriteTables
+	}
+	if set["skip-verify"] {
+		args.SkipVerify = flagSkipVerify
+	}
+	if set["allow-unfinished"] {
+		args.AllowUnfinished = flagAllowUnfinished
+	}
+	if set["m"] {
+		args.Mode = flagMode
+	}
+	if set["dp"] {
+		args.DorisHttpLoadAddress = strings.Split(flagDorisLoadAddress, ",")
+	}
+	if set["max-mb-per-sec"] {
+		args.RateLimitMB = flagMaxMB
+	}
+	if set["max-rows-per-sec"] {
+		args.RateLimitRows = flagMaxRows
+	}
+	if set["max-threads-running"] {
+		args.MaxThreadsRunning = flagMaxThreadsRunning
+	}
+	if set["max-replica-lag"] {
+		args.MaxReplicaLag = flagMaxReplicaLag
+	}
+	if set["max-threads-per-table"] {
+		args.MaxThreadsPerTable = flagMaxPerTable
+	}
+	if set["max-threads-per-database"] {
+		args.MaxThreadsPerDatabase = flagMaxPerDatabase
+	}
+	if set["encryption-key-file"] {
+		args.EncryptionKeyFile = flagKeyFile
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verify(os.Args[2:])
+		return
+	}
+
 	flag.Usage = func() { usage() }
 	flag.Parse()
 
-	if flagHost == "" || flagUser == "" || flagDir == "" {
+	args, err := common.ParseLoaderConfig(flagConfig)
+	common.AssertNil(err)
+	// The option file, then the flags given, then the password source for the user of them.
+	defaults := &common.Credentials{DefaultsFile: flagDefaultsFile}
+	common.AssertNil(defaults.Apply("myloader", &args.User, &args.Password, &args.Address))
+	recoveryConfig(args)
+	source := &common.Credentials{PasswordFrom: flagPasswordFrom}
+	common.AssertNil(source.Apply("myloader", &args.User, &args.Password, &args.Address))
+	if flagDorisUser != "" {
+		args.DorisUser = flagDorisUser
+	}
+	if flagDorisPasswordFrom != "" {
+		if args.DorisUser == "" {
+			args.DorisUser = args.User
+		}
+		args.DorisPassword, err = common.ReadSecret(flagDorisPasswordFrom, fmt.Sprintf("Enter Doris password for %s: ", args.DorisUser))
+		common.AssertNil(err)
+	}
+	args.DumpFile = flagFile
+	args.Database = flagDB
+
+	if flagDryRun {
+		if args.Outdir == "" || args.DumpFile != "" || flagStream {
+			fmt.Println("The dry-run plans the load of a dump directory, given by -d.")
+			os.Exit(1)
+		}
+		plan, err := common.PlanLoad(log, args)
+		common.AssertNil(err)
+		common.AssertNil(plan.Write(os.Stdout))
+		return
+	}
+	if args.User == "" || (args.Outdir == "" && args.DumpFile == "" && !flagStream) {
 		usage()
 		os.Exit(0)
 	}
 
-	args := &common.Args{
-		Mode:                 flagMode,
-		DorisHttpLoadAddress: strings.Split(flagDorisLoadAddress, ","),
-		User:                 flagUser,
-		Password:             flagPasswd,
-		Address:              fmt.Sprintf("%s:%d", flagHost, flagPort),
-		Outdir:               flagDir,
-		Threads:              flagThreads,
-		IntervalMs:           10 * 1000,
-		OverwriteTables:      flagOverwriteTables,
+	if flagMetricsAddr != "" {
+		common.AssertNil(common.ServeMetrics(log, flagMetricsAddr))
 	}
 
-	common.Loader(log, args)
+	// SIGINT or SIGTERM stop the load, SIGUSR1 logs the status of the threads.
+	ctx, interrupt := common.NotifyInterrupt(log)
+	switch {
+	case flagStream:
+		err = common.LoadStream(ctx, log, args, bufio.NewReaderSize(os.Stdin, 1<<20))
+	case args.DumpFile != "":
+		err = common.LoadMysqldump(ctx, log, args)
+	default:
+		err = common.Loader(ctx, log, args)
+	}
+	interrupt.Stop()
+	if err != nil {
+		log.Error("myloader.interrupted:%v", err)
+		os.Exit(interrupt.ExitCode())
+	}
 }
@@ -0,0 +1,358 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// ChunkDiff describes one primary key range whose checksum differs.
+type ChunkDiff struct {
+	Lower      int64  `json:"lower"`
+	Upper      int64  `json:"upper"`
+	SourceRows int64  `json:"source_rows"`
+	TargetRows int64  `json:"target_rows"`
+	SourceCRC  string `json:"source_crc"`
+	TargetCRC  string `json:"target_crc"`
+}
+
+// TableReport is the comparison result of one table.
+type TableReport struct {
+	Database   string       `json:"database"`
+	Table      string       `json:"table"`
+	SourceRows int64        `json:"source_rows"`
+	TargetRows int64        `json:"target_rows"`
+	Chunks     []*ChunkDiff `json:"chunks,omitempty"`
+	Match      bool         `json:"match"`
+	Repaired   bool         `json:"repaired,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// CheckReport is the comparison result of the checker.
+type CheckReport struct {
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished"`
+	Tables     []*TableReport `json:"tables"`
+	Mismatched int            `json:"mismatched"`
+}
+
+func fetchInt(conn *Connection, query string) (int64, error) {
+	qr, err := conn.Fetch(query)
+	if err != nil {
+		return 0, err
+	}
+	if len(qr.Rows) == 0 || qr.Rows[0][0].IsNull() {
+		return 0, nil
+	}
+	return strconv.ParseInt(qr.Rows[0][0].String(), 10, 64)
+}
+
+// checksumColumns returns the columns to checksum, filtered and overridden columns are skipped.
+func checksumColumns(conn *Connection, args *Args, database string, table string) ([]string, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s' ORDER BY ORDINAL_POSITION", database, table))
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(qr.Rows))
+	for _, row := range qr.Rows {
+		column := row[0].String()
+		if _, ok := args.Filters[table][column]; ok {
+			continue
+		}
+		if _, ok := args.Selects[table][column]; ok {
+			continue
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// integerKey returns the single integer primary key column of the table, "" if none.
+func integerKey(conn *Connection, database string, table string) (string, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT k.COLUMN_NAME, c.DATA_TYPE FROM information_schema.KEY_COLUMN_USAGE k JOIN information_schema.COLUMNS c ON c.TABLE_SCHEMA=k.TABLE_SCHEMA AND c.TABLE_NAME=k.TABLE_NAME AND c.COLUMN_NAME=k.COLUMN_NAME WHERE k.TABLE_SCHEMA='%s' AND k.TABLE_NAME='%s' AND k.CONSTRAINT_NAME='PRIMARY'", database, table))
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) != 1 {
+		return "", nil
+	}
+	switch strings.ToLower(qr.Rows[0][1].String()) {
+	case "tinyint", "smallint", "mediumint", "int", "bigint":
+		return qr.Rows[0][0].String(), nil
+	}
+	return "", nil
+}
+
+// checksumQuery builds the row count and CRC aggregate query of the range.
+func checksumQuery(database string, table string, columns []string, where string) string {
+	quoted := make([]string, 0, len(columns))
+	nulls := make([]string, 0, len(columns))
+	for _, c := range columns {
+		quoted = append(quoted, fmt.Sprintf("`%s`", c))
+		nulls = append(nulls, fmt.Sprintf("ISNULL(`%s`)", c))
+	}
+	crc := fmt.Sprintf("CRC32(CONCAT_WS('#', %s, CONCAT(%s)))", strings.Join(quoted, ", "), strings.Join(nulls, ", "))
+	return fmt.Sprintf("SELECT COUNT(*), COALESCE(BIT_XOR(CAST(%s AS UNSIGNED)), 0) FROM `%s`.`%s`%s", crc, database, table, where)
+}
+
+func fetchChecksum(conn *Connection, query string) (int64, string, error) {
+	qr, err := conn.Fetch(query)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(qr.Rows) == 0 {
+		return 0, "0", nil
+	}
+	rows, err := strconv.ParseInt(qr.Rows[0][0].String(), 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return rows, qr.Rows[0][1].String(), nil
+}
+
+// checksumTable compares the chunked CRC aggregates of the table, returns the mismatched chunks.
+func checksumTable(log *xlog.Log, src *Connection, dst *Connection, args *Args, database string, table string, target string) ([]*ChunkDiff, error) {
+	columns, err := checksumColumns(src, args, database, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, nil
+	}
+
+	type bound struct{ lower, upper int64 }
+	var where []string
+	var bounds []bound
+
+	key, err := integerKey(src, database, table)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" && args.ChecksumChunks > 1 {
+		min, err := fetchInt(src, fmt.Sprintf("SELECT MIN(`%s`) FROM `%s`.`%s`", key, database, table))
+		if err != nil {
+			return nil, err
+		}
+		max, err := fetchInt(src, fmt.Sprintf("SELECT MAX(`%s`) FROM `%s`.`%s`", key, database, table))
+		if err != nil {
+			return nil, err
+		}
+		step := (max-min)/int64(args.ChecksumChunks) + 1
+		for lower := min; lower <= max; lower += step {
+			upper := lower + step - 1
+			if upper > max {
+				upper = max
+			}
+			bounds = append(bounds, bound{lower, upper})
+			where = append(where, fmt.Sprintf(" WHERE `%s` BETWEEN %d AND %d", key, lower, upper))
+		}
+	}
+	if len(where) == 0 {
+		bounds = append(bounds, bound{})
+		where = append(where, "")
+	}
+
+	var diffs []*ChunkDiff
+	for i, w := range where {
+		srcRows, srcCRC, err := fetchChecksum(src, checksumQuery(database, table, columns, w))
+		if err != nil {
+			return nil, err
+		}
+		dstRows, dstCRC, err := fetchChecksum(dst, checksumQuery(target, table, columns, w))
+		if err != nil {
+			return nil, err
+		}
+		if srcRows != dstRows || srcCRC != dstCRC {
+			log.Warning("checking.table[%s.%s].chunk[%d-%d].mismatch", database, table, bounds[i].lower, bounds[i].upper)
+			diffs = append(diffs, &ChunkDiff{
+				Lower:      bounds[i].lower,
+				Upper:      bounds[i].upper,
+				SourceRows: srcRows,
+				TargetRows: dstRows,
+				SourceCRC:  srcCRC,
+				TargetCRC:  dstCRC,
+			})
+		}
+	}
+	return diffs, nil
+}
+
+func checkTable(log *xlog.Log, src *Connection, dst *Connection, args *Args, database string, table string) *TableReport {
+	report := &TableReport{Database: database, Table: table}
+	target := database
+	if args.ToDatabase != "" {
+		target = args.ToDatabase
+	}
+
+	var err error
+	if report.SourceRows, err = fetchInt(src, fmt.Sprintf("SELECT COUNT(*) FROM `%s`.`%s`", database, table)); err != nil {
+		report.Error = fmt.Sprintf("source:%v", err)
+		return report
+	}
+	if report.TargetRows, err = fetchInt(dst, fmt.Sprintf("SELECT COUNT(*) FROM `%s`.`%s`", target, table)); err != nil {
+		report.Error = fmt.Sprintf("target:%v", err)
+		return report
+	}
+	report.Match = report.SourceRows == report.TargetRows
+
+	if report.Match && args.Checksum {
+		if report.Chunks, err = checksumTable(log, src, dst, args, database, table, target); err != nil {
+			report.Error = fmt.Sprintf("checksum:%v", err)
+			report.Match = false
+			return report
+		}
+		report.Match = len(report.Chunks) == 0
+	}
+	log.Info("checking.table[%s.%s].source.rows[%d].target.rows[%d].match[%v]", database, table, report.SourceRows, report.TargetRows, report.Match)
+	return report
+}
+
+// repairTables dumps the mismatched tables from the source and loads them into the target
+// database, then checks them again: only the ones matching then are repaired.
+func repairTables(log *xlog.Log, args *Args, report *CheckReport, src *Pool, dst *Pool) {
+	var databases []string
+	tables := make(map[string][]*TableReport)
+	for _, t := range report.Tables {
+		if t.Match {
+			continue
+		}
+		if _, ok := tables[t.Database]; !ok {
+			databases = append(databases, t.Database)
+		}
+		tables[t.Database] = append(tables[t.Database], t)
+	}
+
+	for _, database := range databases {
+		names := make([]string, 0, len(tables[database]))
+		for _, t := range tables[database] {
+			names = append(names, t.Table)
+		}
+		outdir := joinLocation(args.Outdir, EscapeName(database))
+
+		log.Info("repairing.database[%s].tables[%s]...", database, strings.Join(names, ","))
+		dumpArgs := *args
+		dumpArgs.Database = database
+		dumpArgs.DatabaseRegexp = ""
+		dumpArgs.Table = strings.Join(names, ",")
+		dumpArgs.Outdir = outdir
+		dumpArgs.Allbytes, dumpArgs.Allrows = 0, 0
+		AssertNil(Dumper(context.Background(), log, &dumpArgs))
+
+		loadArgs := *args
+		loadArgs.Address = args.ToAddress
+		loadArgs.User = args.ToUser
+		loadArgs.Password = args.ToPassword
+		loadArgs.TLS = args.ToTLS
+		loadArgs.Outdir = outdir
+		loadArgs.OverwriteTables = true
+		AssertNil(Loader(context.Background(), log, &loadArgs))
+
+		srcConn, err := src.Get()
+		AssertNil(err)
+		dstConn, err := dst.Get()
+		AssertNil(err)
+		for _, t := range tables[database] {
+			again := checkTable(log, srcConn, dstConn, args, database, t.Table)
+			t.Repaired = again.Match
+			if !again.Match {
+				t.Error = again.Error
+				log.Error("repairing.table[%s.%s].still.mismatch.source.rows[%d].target.rows[%d]", database, t.Table, again.SourceRows, again.TargetRows)
+			}
+		}
+		src.Put(srcConn)
+		dst.Put(dstConn)
+	}
+}
+
+// Checker used to compare the row counts (and optionally checksums) of the tables between the source and the target.
+func Checker(log *xlog.Log, args *Args) *CheckReport {
+	report := &CheckReport{Started: time.Now()}
+
+	src, err := NewPool(log, args.Threads, args.Address, args.User, args.Password, args.SessionVars, args.TLS)
+	AssertNil(err)
+	defer src.Close()
+	dst, err := NewPool(log, args.Threads, args.ToAddress, args.ToUser, args.ToPassword, args.SessionVars, args.ToTLS)
+	AssertNil(err)
+	defer dst.Close()
+
+	conn, err := src.Get()
+	AssertNil(err)
+	var databases []string
+	if args.DatabaseRegexp != "" {
+		r := regexp.MustCompile(args.DatabaseRegexp)
+		databases = filterDatabases(log, conn, r, args.DatabaseInvertRegexp)
+	} else if args.Database != "" {
+		databases = strings.Split(args.Database, ",")
+	} else {
+		databases = allDatabases(log, conn)
+	}
+	tables := make([][]string, len(databases))
+	for i, database := range databases {
+		if args.Table != "" {
+			tables[i] = strings.Split(args.Table, ",")
+		} else {
+			tables[i] = allTables(log, conn, database)
+		}
+	}
+	src.Put(conn)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, database := range databases {
+		for _, table := range tables[i] {
+			srcConn, err := src.Get()
+			AssertNil(err)
+			dstConn, err := dst.Get()
+			AssertNil(err)
+			wg.Add(1)
+
+			go func(srcConn *Connection, dstConn *Connection, database string, table string) {
+				defer func() {
+					wg.Done()
+					src.Put(srcConn)
+					dst.Put(dstConn)
+				}()
+
+				t := checkTable(log, srcConn, dstConn, args, database, table)
+				mu.Lock()
+				report.Tables = append(report.Tables, t)
+				mu.Unlock()
+			}(srcConn, dstConn, database, table)
+		}
+	}
+	wg.Wait()
+
+	sort.Slice(report.Tables, func(i, j int) bool {
+		if report.Tables[i].Database != report.Tables[j].Database {
+			return report.Tables[i].Database < report.Tables[j].Database
+		}
+		return report.Tables[i].Table < report.Tables[j].Table
+	})
+	for _, t := range report.Tables {
+		if !t.Match {
+			report.Mismatched++
+		}
+	}
+	if args.Repair && report.Mismatched > 0 {
+		repairTables(log, args, report, src, dst)
+	}
+	report.Finished = time.Now()
+	log.Info("checking.all.done.tables[%d].mismatched[%d]", len(report.Tables), report.Mismatched)
+	return report
+}
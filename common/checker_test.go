@@ -0,0 +1,158 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func intResult(values ...string) *sqltypes.Result {
+	qr := &sqltypes.Result{}
+	row := make([]sqltypes.Value, 0, len(values))
+	for i, v := range values {
+		qr.Fields = append(qr.Fields, &querypb.Field{Name: string(rune('a' + i)), Type: querypb.Type_INT64})
+		row = append(row, sqltypes.MakeTrusted(querypb.Type_INT64, []byte(v)))
+	}
+	qr.Rows = [][]sqltypes.Value{row}
+	return qr
+}
+
+func TestChecker(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	srcdbs := driver.NewTestHandler(log)
+	srcServer, err := driver.MockMysqlServer(log, srcdbs)
+	assert.Nil(t, err)
+	defer srcServer.Close()
+	dstdbs := driver.NewTestHandler(log)
+	dstServer, err := driver.MockMysqlServer(log, dstdbs)
+	assert.Nil(t, err)
+	defer dstServer.Close()
+
+	columnsResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "COLUMN_NAME", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("id"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("name"))},
+		},
+	}
+	keyResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "COLUMN_NAME", Type: querypb.Type_VARCHAR}, {Name: "DATA_TYPE", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("id")), sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("bigint"))},
+		},
+	}
+
+	// fakedbs.
+	{
+		srcdbs.AddQueryPattern("set .*", &sqltypes.Result{})
+		srcdbs.AddQueryPattern("select count\\(\\*\\) from `test`.`t1`$", intResult("10"))
+		srcdbs.AddQueryPattern("select count\\(\\*\\) from `test`.`t2`$", intResult("10"))
+		srcdbs.AddQueryPattern("select column_name from information_schema.columns .*", columnsResult)
+		srcdbs.AddQueryPattern("select k.column_name, c.data_type .*", keyResult)
+		srcdbs.AddQueryPattern("select min\\(`id`\\) .*", intResult("1"))
+		srcdbs.AddQueryPattern("select max\\(`id`\\) .*", intResult("10"))
+		srcdbs.AddQueryPattern("select count\\(\\*\\), coalesce.* between 1 and 5$", intResult("5", "1234"))
+		srcdbs.AddQueryPattern("select count\\(\\*\\), coalesce.* between 6 and 10$", intResult("5", "5678"))
+
+		dstdbs.AddQueryPattern("set .*", &sqltypes.Result{})
+		dstdbs.AddQueryPattern("select count\\(\\*\\) from `test`.`t1`$", intResult("10"))
+		dstdbs.AddQueryPattern("select count\\(\\*\\) from `test`.`t2`$", intResult("7"))
+		dstdbs.AddQueryPattern("select count\\(\\*\\), coalesce.* between 1 and 5$", intResult("5", "1234"))
+		dstdbs.AddQueryPattern("select count\\(\\*\\), coalesce.* between 6 and 10$", intResult("5", "9999"))
+	}
+
+	args := &Args{
+		Database:       "test",
+		Table:          "t1,t2",
+		User:           "mock",
+		Password:       "mock",
+		Address:        srcServer.Addr(),
+		ToUser:         "mock",
+		ToPassword:     "mock",
+		ToAddress:      dstServer.Addr(),
+		Threads:        4,
+		ChecksumChunks: 2,
+	}
+
+	// Row counts.
+	{
+		report := Checker(log, args)
+		assert.Equal(t, 2, len(report.Tables))
+		assert.Equal(t, 1, report.Mismatched)
+		assert.Equal(t, "t1", report.Tables[0].Table)
+		assert.True(t, report.Tables[0].Match)
+		assert.Equal(t, "t2", report.Tables[1].Table)
+		assert.False(t, report.Tables[1].Match)
+		assert.Equal(t, int64(10), report.Tables[1].SourceRows)
+		assert.Equal(t, int64(7), report.Tables[1].TargetRows)
+	}
+
+	// Checksums.
+	{
+		args.Checksum = true
+		args.Table = "t1"
+		report := Checker(log, args)
+		assert.Equal(t, 1, report.Mismatched)
+		assert.False(t, report.Tables[0].Match)
+		assert.Equal(t, 1, len(report.Tables[0].Chunks))
+		chunk := report.Tables[0].Chunks[0]
+		assert.Equal(t, int64(6), chunk.Lower)
+		assert.Equal(t, int64(10), chunk.Upper)
+		assert.Equal(t, "5678", chunk.SourceCRC)
+		assert.Equal(t, "9999", chunk.TargetCRC)
+	}
+
+	// Repair into the -to-db, the target still short after it is not repaired.
+	{
+		schemaResult := &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "Table", Type: querypb.Type_VARCHAR}, {Name: "Create Table", Type: querypb.Type_VARCHAR}},
+			Rows: [][]sqltypes.Value{{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t2")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t2` (`id` bigint NOT NULL) ENGINE=InnoDB")),
+			}},
+		}
+		srcdbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		srcdbs.AddQueryPattern("show create table .*", schemaResult)
+		srcdbs.AddQueryPattern("select @@max_allowed_packet", columnResult("@@max_allowed_packet", "67108864"))
+		srcdbs.AddQueryPattern("select .*", intResult("1"))
+
+		dstdbs.AddQuery("create database if not exists `other`", &sqltypes.Result{})
+		dstdbs.AddQuery("use `other`", &sqltypes.Result{})
+		dstdbs.AddQuery("drop table if exists `other`.`t2`", &sqltypes.Result{})
+		dstdbs.AddQuery("create table `t2` (`id` bigint not null) engine=innodb", &sqltypes.Result{})
+		dstdbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+		dstdbs.AddQueryPattern("select @@max_allowed_packet", columnResult("@@max_allowed_packet", "67108864"))
+		dstdbs.AddQueryPattern("select count\\(\\*\\) from `other`.`t2`$", intResult("7"))
+
+		args.Checksum = false
+		args.Table = "t2"
+		args.ToDatabase = "other"
+		args.Repair = true
+		args.Outdir = "/tmp/checkertest"
+		args.ChunksizeInMB = 1
+		args.StmtSize = 10000
+		args.IntervalMs = 500
+		os.RemoveAll(args.Outdir)
+		defer os.RemoveAll(args.Outdir)
+
+		report := Checker(log, args)
+		assert.Equal(t, 1, report.Mismatched)
+		assert.False(t, report.Tables[0].Match)
+		assert.False(t, report.Tables[0].Repaired)
+		assert.Equal(t, 1, dstdbs.GetQueryCalledNum("drop table if exists `other`.`t2`"))
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/driver"
+	"github.com/xelabs/go-mysqlstack/packet"
+	"github.com/xelabs/go-mysqlstack/proto"
+	"github.com/xelabs/go-mysqlstack/sqldb"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/common"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+var _ driver.Conn = &clientConn{}
+
+// clientConn is the driver.Conn over the connection dialed and authenticated by dialConn,
+// the driver only dials plain TCP. The packets are the driver's, the commands mirror its client.
+type clientConn struct {
+	netConn    net.Conn
+	packets    *packet.Packets
+	capability uint32
+	id         uint32
+}
+
+// newClientConn returns the connection after the handshake.
+func newClientConn(conn net.Conn, capability uint32, id uint32) *clientConn {
+	return &clientConn{netConn: conn, packets: packet.NewPackets(conn), capability: capability, id: id}
+}
+
+// NextPacket reads the next packet.
+func (c *clientConn) NextPacket() ([]byte, error) {
+	return c.packets.Next()
+}
+
+func (c *clientConn) query(command byte, data []byte) (driver.Rows, error) {
+	var err error
+	defer func() {
+		// The packet errors break the connection.
+		if err != nil {
+			c.Cleanup()
+		}
+	}()
+
+	if err = c.packets.WriteCommand(command, data); err != nil {
+		return nil, err
+	}
+	ok, colNumber, myerr, err := c.packets.ReadComQueryResponse()
+	if err != nil {
+		return nil, err
+	}
+	if myerr != nil {
+		return nil, myerr
+	}
+	rows := &clientRows{c: c, buffer: common.NewBuffer(8), rowsAffected: ok.AffectedRows, insertID: ok.LastInsertID}
+	if colNumber > 0 {
+		if rows.fields, err = c.packets.ReadColumns(colNumber); err != nil {
+			return nil, err
+		}
+		if c.capability&sqldb.CLIENT_DEPRECATE_EOF == 0 {
+			if err = c.packets.ReadEOF(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rows, nil
+}
+
+// ConnectionID is the connection id of the greeting.
+func (c *clientConn) ConnectionID() uint32 {
+	return c.id
+}
+
+// Query runs the query and returns the row cursor.
+func (c *clientConn) Query(sql string) (driver.Rows, error) {
+	return c.query(sqldb.COM_QUERY, []byte(sql))
+}
+
+// Ping pings the server.
+func (c *clientConn) Ping() error {
+	return c.Command(sqldb.COM_PING)
+}
+
+// InitDB changes the database.
+func (c *clientConn) InitDB(db string) error {
+	rows, err := c.query(sqldb.COM_INIT_DB, []byte(db))
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// Exec runs the query and drains the results.
+func (c *clientConn) Exec(sql string) error {
+	rows, err := c.Query(sql)
+	if err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		c.Cleanup()
+	}
+	return nil
+}
+
+// FetchAll fetches at most maxrows rows, all of them if negative.
+func (c *clientConn) FetchAll(sql string, maxrows int) (*sqltypes.Result, error) {
+	return c.FetchAllWithFunc(sql, maxrows, func(rows driver.Rows) error { return nil })
+}
+
+// FetchAllWithFunc fetches the rows as FetchAll, fn is called on every row and stops the fetch on error.
+func (c *clientConn) FetchAllWithFunc(sql string, maxrows int, fn driver.Func) (*sqltypes.Result, error) {
+	rows, err := c.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	var values [][]sqltypes.Value
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			break
+		}
+		if len(values) == maxrows {
+			break
+		}
+		row, err := rows.RowValues()
+		if err != nil {
+			c.Cleanup()
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	if err := rows.Close(); err != nil {
+		c.Cleanup()
+		return nil, err
+	}
+
+	affected := rows.RowsAffected()
+	if affected == 0 {
+		affected = uint64(len(values))
+	}
+	return &sqltypes.Result{
+		Fields:       rows.Fields(),
+		RowsAffected: affected,
+		InsertID:     rows.LastInsertID(),
+		Rows:         values,
+	}, err
+}
+
+// ComStatementPrepare isn't used by the dumper and the loader.
+func (c *clientConn) ComStatementPrepare(sql string) (*driver.Statement, error) {
+	return nil, errors.New("statement.prepare.unsupported")
+}
+
+// Command runs the command and drains the results.
+func (c *clientConn) Command(command byte) error {
+	rows, err := c.query(command, nil)
+	if err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		c.Cleanup()
+	}
+	return nil
+}
+
+// Quit sends the quit command.
+func (c *clientConn) Quit() {
+	c.packets.WriteCommand(sqldb.COM_QUIT, nil)
+}
+
+// Cleanup closes the connection.
+func (c *clientConn) Cleanup() {
+	if c.netConn != nil {
+		c.netConn.Close()
+		c.netConn = nil
+	}
+}
+
+// Close quits and closes the connection, the quit waits 5 seconds at most.
+func (c *clientConn) Close() error {
+	if c.netConn != nil {
+		c.netConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		c.Quit()
+		c.Cleanup()
+	}
+	return nil
+}
+
+// Closed returns true if the connection is closed or broken.
+func (c *clientConn) Closed() bool {
+	return c.netConn == nil
+}
+
+// clientRows is the text row cursor of the query.
+type clientRows struct {
+	c            *clientConn
+	end          bool
+	err          error
+	bytes        int
+	rowsAffected uint64
+	insertID     uint64
+	buffer       *common.Buffer
+	fields       []*querypb.Field
+}
+
+// Next reads the next row, false at the end or on error.
+func (r *clientRows) Next() bool {
+	if r.end {
+		return false
+	}
+	// No fields, the OK packet has no result set.
+	if len(r.fields) == 0 {
+		r.end = true
+		return false
+	}
+
+	data, err := r.c.NextPacket()
+	if err != nil {
+		r.err = err
+		r.end = true
+		r.c.Cleanup()
+		return false
+	}
+	switch data[0] {
+	case proto.EOF_PACKET:
+		// The EOF packet, or the OK one with the EOF header under CLIENT_DEPRECATE_EOF.
+		r.end = true
+		return false
+	case proto.ERR_PACKET:
+		r.err = proto.UnPackERR(data)
+		r.end = true
+		return false
+	}
+	r.buffer.Reset(data)
+	return true
+}
+
+// Close drains the rows and returns the last error.
+func (r *clientRows) Close() error {
+	for r.Next() {
+	}
+	return r.err
+}
+
+// RowValues returns the values of the row.
+func (r *clientRows) RowValues() ([]sqltypes.Value, error) {
+	if r.fields == nil {
+		return nil, errors.New("rows.fields.is.nil")
+	}
+	values := make([]sqltypes.Value, len(r.fields))
+	for i := range r.fields {
+		v, err := r.buffer.ReadLenEncodeBytes()
+		if err != nil {
+			r.c.Cleanup()
+			return nil, err
+		}
+		if v != nil {
+			r.bytes += len(v)
+			values[i] = sqltypes.MakeTrusted(r.fields[i].Type, v)
+		}
+	}
+	return values, nil
+}
+
+// Datas returns the raw row.
+func (r *clientRows) Datas() []byte {
+	return r.buffer.Datas()
+}
+
+// Bytes returns the bytes of the values read.
+func (r *clientRows) Bytes() int {
+	return r.bytes
+}
+
+// RowsAffected returns the affected rows of the OK packet.
+func (r *clientRows) RowsAffected() uint64 {
+	return r.rowsAffected
+}
+
+// LastInsertID returns the insert id of the OK packet.
+func (r *clientRows) LastInsertID() uint64 {
+	return r.insertID
+}
+
+// LastError returns the error of the rows.
+func (r *clientRows) LastError() error {
+	return r.err
+}
+
+// Fields returns the columns.
+func (r *clientRows) Fields() []*querypb.Field {
+	return r.fields
+}
@@ -10,9 +10,7 @@
 package common
 
 import (
-	"io"
 	"io/ioutil"
-	"os"
 
 	"github.com/xelabs/go-mysqlstack/sqlparser/depends/common"
 )
@@ -21,6 +19,8 @@ import (
 type Args struct {
 	Mode                 string
 	DorisHttpLoadAddress []string
+	DorisUser            string
+	DorisPassword        string
 	User                 string
 	Password             string
 	Address              string
@@ -35,41 +35,73 @@ type Args struct {
 	DatabaseInvertRegexp bool
 	Table                string
 	Outdir               string
+	DumpFile             string
 	SessionVars          string
 	Threads              int
 	ChunksizeInMB        int
+	ChunkRows            int
 	StmtSize             int
+	MaxAllowedPacket     int
 	Allbytes             uint64
 	Allrows              uint64
 	OverwriteTables      bool
+	SkipVerify           bool
+	AllowUnfinished      bool
+	Checksum             bool
+	ChecksumChunks       int
+	Repair               bool
 	Wheres               map[string]string
 	Selects              map[string]map[string]string
 	Filters              map[string]map[string]string
+	Incrementals         map[string]string
+	TableSizes           map[string]*TableSizes
+	Samples              map[string]*Sample
+	Masks                map[string]string
+	MaskSalt             string
+	DorisBuckets         int
+	DorisPartitions      map[string]string
+	Sampled              map[string]*SampledTable
+	Manifest             *Manifest
+	Metadata             *Metadata
+	Previous             *Metadata
+	Throttle             *Throttle
+
+	// TLS of the connections to Address and ToAddress, nil is plain.
+	TLS   *TLSOptions
+	ToTLS *TLSOptions
+
+	// At rest, the files are compressed then encrypted.
+	Compress          bool
+	EncryptionKeyFile string
+	Cipher            *Cipher
+
+	// Throttle, the rates are per second.
+	RateLimitMB        int
+	RateLimitRows      int
+	MaxThreadsRunning  int
+	MaxReplicaLag      int
+	ThrottleIntervalMs int
+
+	// Concurrent work of one table or database, 0 is unlimited.
+	MaxThreadsPerTable    int
+	MaxThreadsPerDatabase int
 
 	// Interval in millisecond.
 	IntervalMs int
 }
 
 // WriteFile used to write datas to file.
+// The datas go to a temporary file renamed to the file once synced, a crash never leaves it torn.
 func WriteFile(file string, data string) error {
-	flag := os.O_RDWR | os.O_TRUNC
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		flag |= os.O_CREATE
-	}
-	f, err := os.OpenFile(file, flag, 0644)
+	w, err := createAtomic(file)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	n, err := f.Write(common.StringToBytes(data))
-	if err != nil {
+	if _, err := w.Write(common.StringToBytes(data)); err != nil {
+		w.Close()
 		return err
 	}
-	if n != len(data) {
-		return io.ErrShortWrite
-	}
-	return nil
+	return w.Close()
 }
 
 // ReadFile used to read datas from file.
@@ -10,149 +10,604 @@
 package common
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	ini "github.com/dlintw/goconf"
+	"github.com/xelabs/go-mysqlstack/xlog"
 )
 
-func ParseDumperConfig(file string) (*Args, error) {
-	args := &Args{
-		StmtSize:   1000000,
-		IntervalMs: 10 * 1000,
-		Wheres:     make(map[string]string),
+// The config file is shared by mydumper and myloader. Every value is resolved by the precedence:
+//
+//	default < config file < MYDUMPER_* environment < command line flag
+//
+// The [mysql] keys are overridden by MYDUMPER_<KEY>, the others by MYDUMPER_<SECTION>_<KEY>,
+// for example MYDUMPER_PASSWORD or MYDUMPER_LOADER_THREADS.
+// The [loader] connection keys default to the [mysql] ones.
+// The socket, if set, is dialed instead of the host and port.
+
+// configDefaults are the keys of the fixed sections with their defaults.
+var configDefaults = map[string]map[string]string{
+	"mysql": {
+		"mode":                "mysql",
+		"threads":             "16",
+		"host":                "127.0.0.1",
+		"port":                "3306",
+		"user":                "",
+		"password":            "",
+		"biz":                 "",
+		"database":            "",
+		"table":               "",
+		"outdir":              "",
+		"chunksize":           "128",
+		"chunkrows":           "0",
+		"stmtsize":            "1000000",
+		"max_allowed_packet":  "0",
+		"mask_salt":           "",
+		"doris_buckets":       "10",
+		"interval_ms":         "10000",
+		"vars":                "",
+		"compress":            "off",
+		"encryption_key_file": "",
+		"socket":              "",
+		"ssl_mode":            "",
+		"ssl_ca":              "",
+		"ssl_cert":            "",
+		"ssl_key":             "",
+		"ssl_server_name":     "",
+
+		"max_threads_per_database": "0",
+	},
+	"database": {
+		"regexp":        "",
+		"invert_regexp": "off",
+	},
+	"throttle": {
+		"max_mb_per_sec":      "0",
+		"max_rows_per_sec":    "0",
+		"max_threads_running": "0",
+		"max_replica_lag":     "0",
+		"check_interval_ms":   "0",
+	},
+	"loader": {
+		"host":               "",
+		"port":               "",
+		"user":               "",
+		"password":           "",
+		"vars":               "",
+		"threads":            "",
+		"dir":                "",
+		"overwrite_tables":   "off",
+		"skip_verify":        "off",
+		"allow_unfinished":   "off",
+		"doris_load_address": "",
+		"doris_user":         "",
+		"doris_password":     "",
+		"socket":             "",
+		"ssl_mode":           "",
+		"ssl_ca":             "",
+		"ssl_cert":           "",
+		"ssl_key":            "",
+		"ssl_server_name":    "",
+
+		"max_threads_per_table":    "0",
+		"max_threads_per_database": "0",
+	},
+}
+
+// configTableSections are keyed by the table names, [select] and [filter] by table.column,
+// [mask] by the column or table.column patterns.
+var configTableSections = map[string]bool{
+	"where":           true,
+	"select":          true,
+	"filter":          true,
+	"incremental":     true,
+	"chunksize":       true,
+	"chunkrows":       true,
+	"stmtsize":        true,
+	"sample":          true,
+	"mask":            true,
+	"doris_partition": true,
+}
+
+var dumpModes = map[string]bool{"mysql": true, "doris": true, "parquet": true}
+
+// configEnv returns the environment variable overriding the key.
+func configEnv(section string, key string) string {
+	if section == "mysql" {
+		return "MYDUMPER_" + strings.ToUpper(key)
 	}
+	return "MYDUMPER_" + strings.ToUpper(section) + "_" + strings.ToUpper(key)
+}
+
+// configReader resolves the values and collects all the errors, to report them at once.
+type configReader struct {
+	cfg  *ini.ConfigFile
+	errs []string
+}
 
+func newConfigReader(file string) (*configReader, error) {
+	r := &configReader{}
 	if file == "" {
-		return args, nil
+		return r, nil
 	}
-
 	cfg, err := ini.ReadConfigFile(file)
 	if err != nil {
 		return nil, err
 	}
-	mode, err := cfg.GetString("mysql", "mode")
-	if err != nil {
-		return nil, err
+	r.cfg = cfg
+	r.checkKeys()
+	return r, nil
+}
+
+func (r *configReader) errorf(format string, v ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, v...))
+}
+
+func (r *configReader) err() error {
+	if len(r.errs) == 0 {
+		return nil
 	}
-	threads, err := cfg.GetInt("mysql", "threads")
-	if err != nil {
-		return nil, err
+	return errors.New("config.invalid: " + strings.Join(r.errs, "; "))
+}
+
+// checkKeys reports the unknown sections and keys.
+func (r *configReader) checkKeys() {
+	sections := r.cfg.GetSections()
+	sort.Strings(sections)
+	for _, section := range sections {
+		options, _ := r.cfg.GetOptions(section)
+		sort.Strings(options)
+		switch {
+		case section == ini.DefaultSection:
+			for _, key := range options {
+				r.errorf("key[%s].is.outside.of.any.section", key)
+			}
+		case configDefaults[section] != nil:
+			for _, key := range options {
+				if _, ok := configDefaults[section][key]; !ok {
+					r.errorf("[%s].unknown.key[%s]", section, key)
+				}
+			}
+		case configTableSections[section]:
+			for _, key := range options {
+				if (section == "select" || section == "filter") && len(strings.Split(key, ".")) != 2 {
+					r.errorf("[%s].key[%s].must.be.table.column", section, key)
+				}
+			}
+		default:
+			r.errorf("unknown.section[%s]", section)
+		}
 	}
-	host, err := cfg.GetString("mysql", "host")
-	if err != nil {
-		return nil, err
+}
+
+// lookup returns the value of the environment or the config file.
+func (r *configReader) lookup(section string, key string) (string, bool) {
+	if v, ok := os.LookupEnv(configEnv(section, key)); ok {
+		return v, true
 	}
-	port, err := cfg.GetInt("mysql", "port")
-	if err != nil {
-		return nil, err
+	if r.cfg != nil && r.cfg.HasSection(section) && r.cfg.HasOption(section, key) {
+		v, err := r.cfg.GetString(section, key)
+		return v, err == nil
 	}
-	user, err := cfg.GetString("mysql", "user")
-	if err != nil {
-		return nil, err
+	return "", false
+}
+
+func (r *configReader) String(section string, key string) string {
+	def, ok := configDefaults[section][key]
+	if !ok {
+		panic(fmt.Sprintf("config.key[%s.%s].not.defined", section, key))
 	}
-	password, err := cfg.GetString("mysql", "password")
-	if err != nil {
-		return nil, err
+	if v, ok := r.lookup(section, key); ok {
+		return v
 	}
-	biz, _ := cfg.GetString("mysql", "biz")
-	database, _ := cfg.GetString("mysql", "database")
-	outdir, err := cfg.GetString("mysql", "outdir")
+	return def
+}
+
+func (r *configReader) Int(section string, key string) int {
+	v := r.String(section, key)
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		return nil, err
+		r.errorf("[%s].%s[%s].is.not.an.integer", section, key, v)
 	}
-	sessionVars, err := cfg.GetString("mysql", "vars")
-	if err != nil {
-		return nil, err
+	return n
+}
+
+func (r *configReader) Bool(section string, key string) bool {
+	v := r.String(section, key)
+	b, ok := ini.BoolStrings[strings.ToLower(v)]
+	if !ok {
+		r.errorf("[%s].%s[%s].is.not.a.bool", section, key, v)
 	}
-	chunksizemb, err := cfg.GetInt("mysql", "chunksize")
-	if err != nil {
-		return nil, err
+	return b
+}
+
+// inheritInt returns the int of the key if it's set, else the one of the [mysql] key.
+func (r *configReader) inheritInt(section string, key string) int {
+	if _, ok := r.lookup(section, key); ok {
+		return r.Int(section, key)
 	}
-	table, _ := cfg.GetString("mysql", "table")
+	return r.Int("mysql", key)
+}
 
-	// Options
-	if err := loadOptions(cfg, "where", args.Wheres); err != nil {
-		return nil, err
+// inheritString returns the string of the key if it's set, else the one of the [mysql] key.
+func (r *configReader) inheritString(section string, key string, from string) string {
+	if v, ok := r.lookup(section, key); ok {
+		return v
 	}
+	return r.String("mysql", from)
+}
 
-	var selects []string
-	if selects, err = cfg.GetOptions("select"); err != nil {
-		return nil, err
+// min checks the int is at least the min.
+func (r *configReader) min(name string, v int, min int) {
+	if v < min {
+		r.errorf("%s[%d].must.be.at.least[%d]", name, v, min)
 	}
-	for _, tblcol := range selects {
-		var table, column string
-		split := strings.Split(tblcol, ".")
-		table = split[0]
-		column = split[1]
+}
 
-		if args.Selects == nil {
-			args.Selects = make(map[string]map[string]string)
+// options returns the keys and values of the table section, empty if the section is missing.
+func (r *configReader) options(section string) map[string]string {
+	opts := make(map[string]string)
+	if r.cfg == nil || !r.cfg.HasSection(section) {
+		return opts
+	}
+	keys, _ := r.cfg.GetOptions(section)
+	for _, key := range keys {
+		opts[key], _ = r.cfg.GetString(section, key)
+	}
+	return opts
+}
+
+// columnOptions returns the table.column keyed section as table => column => value.
+func (r *configReader) columnOptions(section string) map[string]map[string]string {
+	var out map[string]map[string]string
+	for key, value := range r.options(section) {
+		split := strings.Split(key, ".")
+		if len(split) != 2 {
+			continue
 		}
-		if args.Selects[table] == nil {
-			args.Selects[table] = make(map[string]string, 0)
+		if out == nil {
+			out = make(map[string]map[string]string)
 		}
-		if args.Selects[table][column], err = cfg.GetString("select", tblcol); err != nil {
-			return nil, err
+		if out[split[0]] == nil {
+			out[split[0]] = make(map[string]string)
 		}
+		out[split[0]][split[1]] = value
 	}
+	return out
+}
 
-	database_regexp, _ := cfg.GetString("database", "regexp")
-	database_invert_regexp, err := cfg.GetBool("database", "invert_regexp")
-	if err != nil {
-		database_invert_regexp = false
+// tableSizes returns the [chunksize], [chunkrows] and [stmtsize] overrides by table, nil if none.
+func (r *configReader) tableSizes() map[string]*TableSizes {
+	var out map[string]*TableSizes
+	for _, section := range []string{"chunksize", "chunkrows", "stmtsize"} {
+		opts := r.options(section)
+		for _, table := range sortedKeys(opts) {
+			n, err := strconv.Atoi(opts[table])
+			if err != nil {
+				r.errorf("[%s].%s[%s].is.not.an.integer", section, table, opts[table])
+				continue
+			}
+			// A table may set 0 rows to be split by size again.
+			min := 1
+			if section == "chunkrows" {
+				min = 0
+			}
+			r.min(fmt.Sprintf("[%s].%s", section, table), n, min)
+
+			if out == nil {
+				out = make(map[string]*TableSizes)
+			}
+			sizes, ok := out[table]
+			if !ok {
+				sizes = &TableSizes{}
+				out[table] = sizes
+			}
+			switch section {
+			case "chunksize":
+				sizes.ChunksizeInMB = n
+			case "chunkrows":
+				sizes.ChunkRows = &n
+			case "stmtsize":
+				sizes.StmtSize = n
+			}
+		}
+	}
+	return out
+}
+
+// address returns the unix socket of the section if set, else host:port.
+func (r *configReader) address(section string) string {
+	if socket := r.inheritString(section, "socket", "socket"); socket != "" {
+		return unixScheme + socket
+	}
+	port := r.inheritInt(section, "port")
+	r.min("["+section+"].port", port, 1)
+	return fmt.Sprintf("%s:%d", r.inheritString(section, "host", "host"), port)
+}
+
+// tls returns the TLS options of the section, nil if the mode isn't set.
+func (r *configReader) tls(section string) *TLSOptions {
+	opts := &TLSOptions{
+		Mode:       strings.ToLower(r.inheritString(section, "ssl_mode", "ssl_mode")),
+		CA:         r.inheritString(section, "ssl_ca", "ssl_ca"),
+		Cert:       r.inheritString(section, "ssl_cert", "ssl_cert"),
+		Key:        r.inheritString(section, "ssl_key", "ssl_key"),
+		ServerName: r.inheritString(section, "ssl_server_name", "ssl_server_name"),
+	}
+	if err := opts.Validate(); err != nil {
+		r.errorf("[%s].%v", section, err)
+	}
+	if opts.Mode == "" {
+		return nil
+	}
+	return opts
+}
+
+// readCommon reads the values shared by both tools.
+func (r *configReader) readCommon(args *Args) {
+	args.Mode = r.String("mysql", "mode")
+	if !dumpModes[args.Mode] {
+		r.errorf("[mysql].mode[%s].must.be.mysql.doris.or.parquet", args.Mode)
 	}
+	args.IntervalMs = r.Int("mysql", "interval_ms")
+	r.min("[mysql].interval_ms", args.IntervalMs, 1)
+	args.EncryptionKeyFile = r.String("mysql", "encryption_key_file")
+
+	args.RateLimitMB = r.Int("throttle", "max_mb_per_sec")
+	args.RateLimitRows = r.Int("throttle", "max_rows_per_sec")
+	args.MaxThreadsRunning = r.Int("throttle", "max_threads_running")
+	args.MaxReplicaLag = r.Int("throttle", "max_replica_lag")
+	args.ThrottleIntervalMs = r.Int("throttle", "check_interval_ms")
+	r.min("[throttle].max_mb_per_sec", args.RateLimitMB, 0)
+	r.min("[throttle].max_rows_per_sec", args.RateLimitRows, 0)
+	r.min("[throttle].max_threads_running", args.MaxThreadsRunning, 0)
+	r.min("[throttle].max_replica_lag", args.MaxReplicaLag, 0)
+	r.min("[throttle].check_interval_ms", args.ThrottleIntervalMs, 0)
+}
 
-	var filters []string
-	if filters, err = cfg.GetOptions("filter"); err != nil {
+// ParseDumperConfig reads the dumper args from the config file, the file may be empty
+// to use the defaults and the environment only.
+func ParseDumperConfig(file string) (*Args, error) {
+	r, err := newConfigReader(file)
+	if err != nil {
 		return nil, err
 	}
-	for _, tblcol := range filters {
-		var table, column string
-		split := strings.Split(tblcol, ".")
-		table = split[0]
-		column = split[1]
 
-		if args.Filters == nil {
-			args.Filters = make(map[string]map[string]string)
+	args := &Args{}
+	r.readCommon(args)
+	args.Address = r.address("mysql")
+	args.TLS = r.tls("mysql")
+	args.User = r.String("mysql", "user")
+	args.Password = r.String("mysql", "password")
+	args.Biz = r.String("mysql", "biz")
+	args.Database = r.String("mysql", "database")
+	args.Table = r.String("mysql", "table")
+	args.Outdir = r.String("mysql", "outdir")
+	args.SessionVars = r.String("mysql", "vars")
+	args.Threads = r.Int("mysql", "threads")
+	r.min("[mysql].threads", args.Threads, 1)
+	args.ChunksizeInMB = r.Int("mysql", "chunksize")
+	r.min("[mysql].chunksize", args.ChunksizeInMB, 1)
+	args.ChunkRows = r.Int("mysql", "chunkrows")
+	r.min("[mysql].chunkrows", args.ChunkRows, 0)
+	args.StmtSize = r.Int("mysql", "stmtsize")
+	r.min("[mysql].stmtsize", args.StmtSize, 1)
+	args.MaxAllowedPacket = r.Int("mysql", "max_allowed_packet")
+	r.min("[mysql].max_allowed_packet", args.MaxAllowedPacket, 0)
+	args.Compress = r.Bool("mysql", "compress")
+	args.MaxThreadsPerDatabase = r.Int("mysql", "max_threads_per_database")
+	r.min("[mysql].max_threads_per_database", args.MaxThreadsPerDatabase, 0)
+
+	args.DatabaseRegexp = r.String("database", "regexp")
+	if _, err := regexp.Compile(args.DatabaseRegexp); err != nil {
+		r.errorf("[database].regexp.invalid:%v", err)
+	}
+	args.DatabaseInvertRegexp = r.Bool("database", "invert_regexp")
+
+	args.Wheres = r.options("where")
+	args.Selects = r.columnOptions("select")
+	args.Filters = r.columnOptions("filter")
+	if incrementals := r.options("incremental"); len(incrementals) > 0 {
+		args.Incrementals = incrementals
+	}
+	args.TableSizes = r.tableSizes()
+	for table, v := range r.options("sample") {
+		s, err := ParseSample(v)
+		if err != nil {
+			r.errorf("[sample].%s.%v", table, err)
+			continue
 		}
-		if args.Filters[table] == nil {
-			args.Filters[table] = make(map[string]string, 0)
+		if args.Samples == nil {
+			args.Samples = make(map[string]*Sample)
 		}
-		if args.Filters[table][column], err = cfg.GetString("filter", tblcol); err != nil {
-			return nil, err
+		args.Samples[table] = s
+	}
+	args.MaskSalt = r.String("mysql", "mask_salt")
+	if masks := r.options("mask"); len(masks) > 0 {
+		for _, pattern := range sortedKeys(masks) {
+			if err := checkMaskRule(pattern, masks[pattern]); err != nil {
+				r.errorf("[mask].%s.%v", pattern, err)
+			}
 		}
+		if args.MaskSalt == "" {
+			r.errorf("[mysql].mask_salt.is.required.by.[mask]")
+		}
+		args.Masks = masks
+	}
+	args.DorisBuckets = r.Int("mysql", "doris_buckets")
+	r.min("[mysql].doris_buckets", args.DorisBuckets, 0)
+	if partitions := r.options("doris_partition"); len(partitions) > 0 {
+		for _, table := range sortedKeys(partitions) {
+			if _, _, err := parseDorisPartition(partitions[table]); err != nil {
+				r.errorf("[doris_partition].%s.%v", table, err)
+			}
+		}
+		args.DorisPartitions = partitions
+	}
+
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// ParseLoaderConfig reads the loader args from the config file, the [loader] section
+// with the connection keys of [mysql] as defaults.
+func ParseLoaderConfig(file string) (*Args, error) {
+	r, err := newConfigReader(file)
+	if err != nil {
+		return nil, err
 	}
 
-	args.Mode = mode
-	args.Address = fmt.Sprintf("%s:%d", host, port)
-	args.User = user
-	args.Password = password
-	args.Biz = biz
-	args.Database = database
-	args.DatabaseRegexp = database_regexp
-	args.DatabaseInvertRegexp = database_invert_regexp
-	args.Table = table
-	args.Outdir = outdir
-	args.ChunksizeInMB = chunksizemb
-	args.SessionVars = sessionVars
-	args.Threads = threads
+	args := &Args{}
+	r.readCommon(args)
+	args.Address = r.address("loader")
+	args.TLS = r.tls("loader")
+	args.User = r.inheritString("loader", "user", "user")
+	args.Password = r.inheritString("loader", "password", "password")
+	args.SessionVars = r.inheritString("loader", "vars", "vars")
+	args.Threads = r.inheritInt("loader", "threads")
+	r.min("[loader].threads", args.Threads, 1)
+	args.Outdir = r.inheritString("loader", "dir", "outdir")
+	args.OverwriteTables = r.Bool("loader", "overwrite_tables")
+	args.SkipVerify = r.Bool("loader", "skip_verify")
+	args.AllowUnfinished = r.Bool("loader", "allow_unfinished")
+	args.MaxThreadsPerTable = r.Int("loader", "max_threads_per_table")
+	r.min("[loader].max_threads_per_table", args.MaxThreadsPerTable, 0)
+	args.MaxThreadsPerDatabase = r.Int("loader", "max_threads_per_database")
+	r.min("[loader].max_threads_per_database", args.MaxThreadsPerDatabase, 0)
+	args.DorisUser = r.String("loader", "doris_user")
+	args.DorisPassword = r.String("loader", "doris_password")
+	if addrs := r.String("loader", "doris_load_address"); addrs != "" {
+		args.DorisHttpLoadAddress = strings.Split(addrs, ",")
+	}
 
+	if err := r.err(); err != nil {
+		return nil, err
+	}
 	return args, nil
 }
 
-func loadOptions(cfg *ini.ConfigFile, section string, optMap map[string]string) error {
-	var err error
-	var opts []string
+// checkTableOptions checks the [where], [select], [filter], [incremental], [sample], [doris_partition]
+// and the size entries refer to the existing tables and columns of the dumped databases, before dumping anything.
+func checkTableOptions(log *xlog.Log, conn *Connection, args *Args, databases []string) error {
+	if len(args.Wheres) == 0 && len(args.Selects) == 0 && len(args.Filters) == 0 && len(args.Incrementals) == 0 && len(args.TableSizes) == 0 && len(args.Samples) == 0 && len(args.DorisPartitions) == 0 {
+		return nil
+	}
 
-	if opts, err = cfg.GetOptions(section); err != nil {
-		return err
+	// table => the databases having it.
+	owners := make(map[string][]string)
+	for _, database := range databases {
+		for _, table := range allTables(log, conn, database) {
+			owners[table] = append(owners[table], database)
+		}
+	}
+	// column => nullable in any of the databases.
+	columns := func(table string) (map[string]bool, error) {
+		cols := make(map[string]bool)
+		for _, database := range owners[table] {
+			qr, err := conn.Fetch(fmt.Sprintf("SHOW COLUMNS FROM `%s`.`%s`", database, table))
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range qr.Rows {
+				nullable := len(row) > 2 && row[2].String() == "YES"
+				cols[row[0].String()] = cols[row[0].String()] || nullable
+			}
+		}
+		return cols, nil
 	}
 
-	for _, key := range opts {
-		if optMap[key], err = cfg.GetString(section, key); err != nil {
+	var errs []string
+	checkTable := func(section string, table string) bool {
+		if len(owners[table]) == 0 {
+			errs = append(errs, fmt.Sprintf("[%s].table[%s].not.found.in%v", section, table, databases))
+			return false
+		}
+		return true
+	}
+	checkColumns := func(section string, table string, names []string) (map[string]bool, error) {
+		if !checkTable(section, table) {
+			return nil, nil
+		}
+		cols, err := columns(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if _, ok := cols[name]; !ok {
+				errs = append(errs, fmt.Sprintf("[%s].column[%s.%s].not.found", section, table, name))
+			}
+		}
+		return cols, nil
+	}
+	for _, table := range sortedKeys(args.Wheres) {
+		checkTable("where", table)
+	}
+	sized := make([]string, 0, len(args.TableSizes))
+	for table := range args.TableSizes {
+		sized = append(sized, table)
+	}
+	sort.Strings(sized)
+	for _, table := range sized {
+		checkTable("chunksize/chunkrows/stmtsize", table)
+	}
+	sampled := make([]string, 0, len(args.Samples))
+	for table := range args.Samples {
+		sampled = append(sampled, table)
+	}
+	sort.Strings(sampled)
+	for _, table := range sampled {
+		checkTable("sample", table)
+	}
+	for _, table := range sortedKeys(args.Incrementals) {
+		if _, err := checkColumns("incremental", table, []string{args.Incrementals[table]}); err != nil {
 			return err
 		}
 	}
+	for _, table := range sortedKeys(args.DorisPartitions) {
+		column, _, _ := parseDorisPartition(args.DorisPartitions[table])
+		cols, err := checkColumns("doris_partition", table, []string{column})
+		if err != nil {
+			return err
+		}
+		// The auto partitions reject the NULL dates.
+		if cols[column] {
+			errs = append(errs, fmt.Sprintf("[doris_partition].column[%s.%s].is.nullable", table, column))
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		options map[string]map[string]string
+	}{{"select", args.Selects}, {"filter", args.Filters}} {
+		tables := make([]string, 0, len(section.options))
+		for table := range section.options {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			if _, err := checkColumns(section.name, table, sortedKeys(section.options[table])); err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("config.invalid: " + strings.Join(errs, "; "))
+	}
 	return nil
 }
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,277 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// columnResult is the one column result of the values.
+func columnResult(name string, values ...string) *sqltypes.Result {
+	qr := &sqltypes.Result{Fields: []*querypb.Field{{Name: name, Type: querypb.Type_VARCHAR}}}
+	for _, v := range values {
+		qr.Rows = append(qr.Rows, []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v))})
+	}
+	return qr
+}
+
+func writeConfig(t *testing.T, data string) string {
+	file := "/tmp/mydumper-test.ini"
+	assert.Nil(t, ioutil.WriteFile(file, []byte(data), 0644))
+	return file
+}
+
+func TestParseDumperConfig(t *testing.T) {
+	// The sample comments out mode and threads, the defaults apply.
+	args, err := ParseDumperConfig("../conf/mydumper.ini.sample")
+	assert.Nil(t, err)
+	assert.Equal(t, "mysql", args.Mode)
+	assert.Equal(t, 16, args.Threads)
+	assert.Equal(t, "127.0.0.1:3306", args.Address)
+	assert.Equal(t, 128, args.ChunksizeInMB)
+	assert.Equal(t, 1000000, args.StmtSize)
+	assert.Equal(t, 10000, args.IntervalMs)
+	assert.Equal(t, 10, args.DorisBuckets)
+
+	file := writeConfig(t, `[mysql]
+host = 10.0.0.1
+user = root
+password = pwd
+stmtsize = 4096
+threads = 4
+doris_buckets = 16
+
+[where]
+t1 = id > 10
+
+[select]
+t1.name = 'x'
+
+[filter]
+t2.blob = ignore
+
+[chunksize]
+t1 = 16
+
+[chunkrows]
+t2 = 100000
+
+[stmtsize]
+t1 = 65536
+
+[sample]
+t1 = 5%
+
+[mask]
+*email* = email
+users.ssn = redact(4)
+
+[doris_partition]
+t1 = created_at day
+`)
+	defer os.Remove(file)
+
+	// The environment overrides the file.
+	os.Setenv("MYDUMPER_PASSWORD", "secret")
+	os.Setenv("MYDUMPER_MASK_SALT", "pepper")
+	defer os.Unsetenv("MYDUMPER_MASK_SALT")
+	os.Setenv("MYDUMPER_THROTTLE_MAX_MB_PER_SEC", "8")
+	defer os.Unsetenv("MYDUMPER_PASSWORD")
+	defer os.Unsetenv("MYDUMPER_THROTTLE_MAX_MB_PER_SEC")
+
+	args, err = ParseDumperConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:3306", args.Address)
+	assert.Equal(t, "secret", args.Password)
+	assert.Equal(t, 8, args.RateLimitMB)
+	assert.Equal(t, 4096, args.StmtSize)
+	assert.Equal(t, 4, args.Threads)
+	assert.Equal(t, map[string]string{"t1": "id > 10"}, args.Wheres)
+	assert.Equal(t, map[string]map[string]string{"t1": {"name": "'x'"}}, args.Selects)
+	assert.Equal(t, map[string]map[string]string{"t2": {"blob": "ignore"}}, args.Filters)
+	assert.Equal(t, map[string]*Sample{"t1": {Percent: 5}}, args.Samples)
+	assert.Equal(t, map[string]string{"*email*": "email", "users.ssn": "redact(4)"}, args.Masks)
+	assert.Equal(t, "pepper", args.MaskSalt)
+	assert.Equal(t, 16, args.DorisBuckets)
+	assert.Equal(t, dorisOptions{buckets: 16, partition: "created_at", unit: "day"}, tableDorisOptions(args, "t1"))
+	rows := 100000
+	assert.Equal(t, map[string]*TableSizes{
+		"t1": {ChunksizeInMB: 16, StmtSize: 65536},
+		"t2": {ChunkRows: &rows},
+	}, args.TableSizes)
+	assert.Equal(t, chunking{chunkBytes: 16 << 20, stmtSize: 65536}, tableChunking(args, "t1"))
+	assert.Equal(t, chunking{chunkBytes: 128 << 20, chunkRows: 100000, stmtSize: 4096}, tableChunking(args, "t2"))
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	file := writeConfig(t, `[mysql]
+mode = oracle
+threads = 0
+port = x
+hosts = 10.0.0.1
+ssl_mode = always
+
+[loader]
+overwrite_tables = maybe
+
+[select]
+name = 'x'
+
+[wheres]
+t1 = 1
+
+[stmtsize]
+t1 = big
+t2 = 0
+
+[sample]
+t1 = all
+
+[mask]
+phone = scramble
+
+[doris_partition]
+t1 = created_at hour
+`)
+	defer os.Remove(file)
+
+	// All the errors are reported at once.
+	_, err := ParseDumperConfig(file)
+	assert.NotNil(t, err)
+	for _, want := range []string{
+		"[mysql].unknown.key[hosts]",
+		"[select].key[name].must.be.table.column",
+		"unknown.section[wheres]",
+		"[mysql].mode[oracle]",
+		"[mysql].threads[0].must.be.at.least[1]",
+		"[mysql].port[x].is.not.an.integer",
+		"[mysql].ssl.mode[always]",
+		"[stmtsize].t1[big].is.not.an.integer",
+		"[stmtsize].t2[0].must.be.at.least[1]",
+		"[sample].t1.sample[all].must.be.a.percent.or.a.row.count",
+		"[mask].phone.masker[scramble].unknown",
+		"[mysql].mask_salt.is.required.by.[mask]",
+		"[doris_partition].t1.partition[created_at hour].unit.must.be.day.week.month.or.year",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+
+	_, err = ParseLoaderConfig(file)
+	assert.Contains(t, err.Error(), "[loader].overwrite_tables[maybe].is.not.a.bool")
+}
+
+func TestParseLoaderConfig(t *testing.T) {
+	file := writeConfig(t, `[mysql]
+host = 10.0.0.1
+port = 3307
+user = root
+password = pwd
+outdir = /data/dump
+threads = 4
+ssl_mode = verify_identity
+ssl_ca = /etc/mysql/ca.pem
+
+[loader]
+host = 10.0.0.2
+threads = 8
+overwrite_tables = on
+doris_load_address = 10.0.0.3:8040,10.0.0.4:8040
+ssl_server_name = mysql.test
+max_threads_per_table = 2
+`)
+	defer os.Remove(file)
+
+	os.Setenv("MYDUMPER_LOADER_USER", "loader")
+	defer os.Unsetenv("MYDUMPER_LOADER_USER")
+
+	args, err := ParseLoaderConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:3307", args.Address)
+	assert.Equal(t, "loader", args.User)
+	assert.Equal(t, "pwd", args.Password)
+	assert.Equal(t, "/data/dump", args.Outdir)
+	assert.Equal(t, 8, args.Threads)
+	assert.True(t, args.OverwriteTables)
+	assert.False(t, args.SkipVerify)
+	assert.False(t, args.AllowUnfinished)
+	assert.Equal(t, 2, args.MaxThreadsPerTable)
+	assert.Equal(t, 0, args.MaxThreadsPerDatabase)
+	assert.Equal(t, []string{"10.0.0.3:8040", "10.0.0.4:8040"}, args.DorisHttpLoadAddress)
+	assert.Equal(t, &TLSOptions{Mode: SSLVerifyIdentity, CA: "/etc/mysql/ca.pem", ServerName: "mysql.test"}, args.TLS)
+
+	// The socket wins over the host and port.
+	os.Setenv("MYDUMPER_LOADER_SOCKET", "/var/run/mysqld/mysqld.sock")
+	defer os.Unsetenv("MYDUMPER_LOADER_SOCKET")
+	args, err = ParseLoaderConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "unix:/var/run/mysqld/mysqld.sock", args.Address)
+}
+
+func TestCheckTableOptions(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fakedbs.AddQueryPattern("show tables from .*", columnResult("Tables_in_test", "t1", "t2"))
+	fakedbs.AddQueryPattern("show columns from .*", columnResult("Field", "id", "name"))
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	defer pool.Put(conn)
+
+	args := &Args{
+		Wheres:  map[string]string{"t1": "id > 0"},
+		Selects: map[string]map[string]string{"t2": {"name": "'x'"}},
+	}
+	assert.Nil(t, checkTableOptions(log, conn, args, []string{"test"}))
+
+	args.Wheres["t3"] = "id > 0"
+	args.Filters = map[string]map[string]string{"t1": {"blob": "ignore"}}
+	err = checkTableOptions(log, conn, args, []string{"test"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "[where].table[t3].not.found")
+	assert.Contains(t, err.Error(), "[filter].column[t1.blob].not.found")
+
+	// The auto partitions reject the NULL dates.
+	columns := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Field", Type: querypb.Type_VARCHAR},
+			{Name: "Type", Type: querypb.Type_VARCHAR},
+			{Name: "Null", Type: querypb.Type_VARCHAR},
+		},
+	}
+	for _, row := range [][]string{{"id", "int", "NO"}, {"created_at", "datetime", "NO"}, {"deleted_at", "datetime", "YES"}} {
+		var values []sqltypes.Value
+		for _, v := range row {
+			values = append(values, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+		}
+		columns.Rows = append(columns.Rows, values)
+	}
+	fakedbs.AddQuery("show columns from `test`.`t2`", columns)
+	args = &Args{DorisPartitions: map[string]string{"t2": "created_at day"}}
+	assert.Nil(t, checkTableOptions(log, conn, args, []string{"test"}))
+	args.DorisPartitions["t2"] = "deleted_at"
+	err = checkTableOptions(log, conn, args, []string{"test"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "[doris_partition].column[t2.deleted_at].is.nullable")
+}
@@ -0,0 +1,235 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials are the sources of the user and password which don't show up in ps or the
+// shell history, unlike the -p flag.
+type Credentials struct {
+	// DefaultsFile is a MySQL option file, its [client] group then the group of the tool are read.
+	DefaultsFile string
+
+	// PasswordFrom is env:NAME, file:PATH or prompt.
+	PasswordFrom string
+}
+
+// Apply fills the user, password and address from the sources, the password source last.
+// The socket of the option file wins over its host and port, as with mysql.
+func (c *Credentials) Apply(group string, user *string, password *string, address *string) error {
+	if c.DefaultsFile != "" {
+		opts, err := ReadOptionFile(c.DefaultsFile, "client", group)
+		if err != nil {
+			return err
+		}
+		if v, ok := opts["user"]; ok {
+			*user = v
+		}
+		if v, ok := opts["password"]; ok {
+			*password = v
+		}
+		_, hasHost := opts["host"]
+		_, hasPort := opts["port"]
+		if socket, ok := opts["socket"]; ok && address != nil {
+			*address = unixScheme + socket
+		} else if address != nil && (hasHost || hasPort) {
+			host, port, err := net.SplitHostPort(*address)
+			if err != nil {
+				port = "3306"
+			}
+			if hasHost {
+				host = opts["host"]
+			}
+			if hasPort {
+				port = opts["port"]
+			}
+			*address = net.JoinHostPort(host, port)
+		}
+	}
+	if c.PasswordFrom != "" {
+		v, err := ReadSecret(c.PasswordFrom, fmt.Sprintf("Enter password for %s: ", *user))
+		if err != nil {
+			return err
+		}
+		*password = v
+	}
+	return nil
+}
+
+// ReadSecret reads the secret from the source:
+//
+//	env:NAME   the environment variable
+//	file:PATH  the first line of the file
+//	prompt     the terminal, without echo
+func ReadSecret(source string, prompt string) (string, error) {
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret.env[%s].not.set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(source, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.SplitN(string(data), "\n", 2)[0], nil
+	case source == "prompt":
+		return promptSecret(prompt)
+	}
+	return "", fmt.Errorf("secret.source[%s].must.be.env:NAME.file:PATH.or.prompt", source)
+}
+
+// promptSecret reads one line from the terminal, the echo is off while typing.
+func promptSecret(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("secret.prompt.needs.a.terminal:%v", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	if err := stty(tty, "-echo"); err == nil {
+		defer func() {
+			stty(tty, "echo")
+			fmt.Fprintln(tty)
+		}()
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(tty *os.File, arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
+
+// ReadOptionFile reads the options of the groups from the MySQL option file, the later
+// groups override the earlier ones. As mysql, the keys are case insensitive with '-' and '_'
+// alike, the values may be quoted, and !include is followed.
+func ReadOptionFile(file string, groups ...string) (map[string]string, error) {
+	// group => key => value
+	values := make(map[string]map[string]string)
+	if err := readOptionFile(file, values, 0); err != nil {
+		return nil, err
+	}
+
+	opts := make(map[string]string)
+	for _, g := range groups {
+		for k, v := range values[strings.ToLower(g)] {
+			opts[k] = v
+		}
+	}
+	return opts, nil
+}
+
+func readOptionFile(file string, values map[string]map[string]string, depth int) error {
+	if depth > 10 {
+		return fmt.Errorf("option.file[%s].includes.too.deep", file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	group := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case strings.HasPrefix(line, "!include "):
+			inc := strings.TrimSpace(strings.TrimPrefix(line, "!include "))
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(file), inc)
+			}
+			if err := readOptionFile(inc, values, depth+1); err != nil {
+				return err
+			}
+			continue
+		case line[0] == '!':
+			continue
+		case line[0] == '[':
+			if !strings.HasSuffix(line, "]") {
+				return fmt.Errorf("option.file[%s].line[%d].invalid.group", file, i+1)
+			}
+			group = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		if group == "" {
+			return fmt.Errorf("option.file[%s].line[%d].outside.of.any.group", file, i+1)
+		}
+
+		key, value := line, ""
+		if idx := strings.Index(line, "="); idx >= 0 {
+			key = strings.TrimSpace(line[:idx])
+			value = optionValue(strings.TrimSpace(line[idx+1:]))
+		}
+		key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+		if values[group] == nil {
+			values[group] = make(map[string]string)
+		}
+		values[group][key] = value
+	}
+	return nil
+}
+
+// optionValue unquotes the value, or strips its trailing comment if it isn't quoted.
+func optionValue(v string) string {
+	if len(v) > 0 && (v[0] == '"' || v[0] == '\'') {
+		quote := v[0]
+		var b strings.Builder
+		for i := 1; i < len(v); i++ {
+			c := v[i]
+			switch {
+			case c == quote:
+				return b.String()
+			case c == '\\' && i+1 < len(v):
+				i++
+				switch v[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case 'b':
+					b.WriteByte('\b')
+				case 's':
+					b.WriteByte(' ')
+				default:
+					b.WriteByte(v[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return b.String()
+	}
+	if idx := strings.Index(v, " #"); idx >= 0 {
+		v = strings.TrimSpace(v[:idx])
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOptionFile(t *testing.T) {
+	dir := "/tmp/mydumper-test-cnf"
+	os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(dir, 0700))
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/extra.cnf", []byte("[mydumper]\nport = 3307\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(dir+"/my.cnf", []byte(`# comment
+[client]
+user = root
+password = "p#ss \"word\"" # trailing
+host=10.0.0.1
+skip-ssl
+
+[mysqld]
+user = mysql
+
+[mydumper]
+User = dumper
+!include extra.cnf
+`), 0600))
+
+	opts, err := ReadOptionFile(dir+"/my.cnf", "client", "mydumper")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"user":     "dumper",
+		"password": "p#ss \"word\"",
+		"host":     "10.0.0.1",
+		"port":     "3307",
+		"skip_ssl": "",
+	}, opts)
+
+	c := &Credentials{DefaultsFile: dir + "/my.cnf"}
+	user, password, address := "", "", "127.0.0.1:3306"
+	assert.Nil(t, c.Apply("mydumper", &user, &password, &address))
+	assert.Equal(t, "dumper", user)
+	assert.Equal(t, "p#ss \"word\"", password)
+	assert.Equal(t, "10.0.0.1:3307", address)
+
+	// The socket wins over the host and port.
+	assert.Nil(t, ioutil.WriteFile(dir+"/socket.cnf", []byte("[client]\nhost = 10.0.0.1\nsocket = /tmp/mysql.sock\n"), 0600))
+	c = &Credentials{DefaultsFile: dir + "/socket.cnf"}
+	assert.Nil(t, c.Apply("mydumper", &user, &password, &address))
+	assert.Equal(t, "unix:/tmp/mysql.sock", address)
+
+	assert.Nil(t, ioutil.WriteFile(dir+"/bad.cnf", []byte("user = root\n"), 0600))
+	_, err = ReadOptionFile(dir+"/bad.cnf", "client")
+	assert.NotNil(t, err)
+}
+
+func TestReadSecret(t *testing.T) {
+	os.Setenv("MYDUMPER_TEST_SECRET", "from-env")
+	defer os.Unsetenv("MYDUMPER_TEST_SECRET")
+	v, err := ReadSecret("env:MYDUMPER_TEST_SECRET", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env", v)
+
+	_, err = ReadSecret("env:MYDUMPER_TEST_SECRET_MISSING", "")
+	assert.NotNil(t, err)
+
+	file := "/tmp/mydumper-test-secret"
+	defer os.Remove(file)
+	assert.Nil(t, ioutil.WriteFile(file, []byte("from-file\n"), 0600))
+	v, err = ReadSecret("file:"+file, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-file", v)
+
+	_, err = ReadSecret("plain", "")
+	assert.NotNil(t, err)
+
+	c := &Credentials{PasswordFrom: "env:MYDUMPER_TEST_SECRET"}
+	user, password := "root", "old"
+	assert.Nil(t, c.Apply("myloader", &user, &password, nil))
+	assert.Equal(t, "from-env", password)
+}
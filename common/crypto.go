@@ -0,0 +1,319 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// The encrypted files are AES-256-GCM in segments, as the STREAM construction, under a key of
+// their own derived from the dump key by HKDF-SHA256 and the random salt of the file:
+//
+//	header:  magic(4) version(1) len(1) keyID(len) salt(32) prefix(7)
+//	segment: AES-GCM(plain, nonce=prefix|counter(4)|last(1), aad=header)
+//
+// Every segment holds encryptSegmentSize plain bytes but the last one, which is flagged
+// so that truncating, reordering or tampering with the segments fails the authentication.
+const (
+	encryptMagic       = "MYDE"
+	encryptVersion     = 2
+	encryptSegmentSize = 64 * 1024
+	encryptSaltSize    = 32
+	encryptPrefixSize  = 7
+	encryptionName     = "AES-256-GCM"
+	encryptInfo        = "go-mydumper file key"
+
+	encryptionKeyEnv = "MYDUMPER_ENCRYPTION_KEY"
+)
+
+// ErrTampered is returned when an encrypted file fails the authentication.
+var ErrTampered = errors.New("encrypted.file.tampered.or.truncated")
+
+// Cipher encrypts and decrypts the dump files with one key.
+type Cipher struct {
+	key []byte
+	id  string
+}
+
+// NewCipher creates the cipher of the 32 bytes key, its ID is derived from the key.
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption.key.must.be.32.bytes.got[%d]", len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &Cipher{key: append([]byte(nil), key...), id: hex.EncodeToString(sum[:8])}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdf derives the 32 bytes key of the salt, HKDF-SHA256 (RFC 5869) of one block.
+func hkdf(key []byte, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// fileAEAD returns the AEAD of the file key derived from the salt.
+func (c *Cipher) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	return newGCM(hkdf(c.key, salt, encryptInfo))
+}
+
+// parseKey accepts the raw 32 bytes, or their hex or base64 encoding.
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption.key.must.be.32.bytes.raw.hex.or.base64")
+}
+
+// LoadCipher loads the key from the key file, or from the MYDUMPER_ENCRYPTION_KEY environment
+// if the file is empty. It returns nil if there is no key at all.
+func LoadCipher(keyFile string) (*Cipher, error) {
+	var data []byte
+	if keyFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(keyFile); err != nil {
+			return nil, err
+		}
+	} else if v := os.Getenv(encryptionKeyEnv); v != "" {
+		data = []byte(v)
+	} else {
+		return nil, nil
+	}
+	key, err := parseKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(key)
+}
+
+// ID returns the key ID recorded in the files and the metadata.
+func (c *Cipher) ID() string {
+	return c.id
+}
+
+func segmentNonce(aead cipher.AEAD, prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], counter)
+	if last {
+		nonce[encryptPrefixSize+4] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// Encrypt returns the writer encrypting to w, Close writes the last segment but doesn't close w.
+func (c *Cipher) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	random := make([]byte, encryptSaltSize+encryptPrefixSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	salt, prefix := random[:encryptSaltSize], random[encryptSaltSize:]
+	aead, err := c.fileAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	header := []byte(encryptMagic)
+	header = append(header, encryptVersion, byte(len(c.id)))
+	header = append(header, c.id...)
+	header = append(header, random...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{aead: aead, w: w, header: header, prefix: prefix}, nil
+}
+
+func (e *encryptWriter) seal(plain []byte, last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("encrypted.file.too.large")
+	}
+	out := e.aead.Seal(nil, segmentNonce(e.aead, e.prefix, e.counter, last), plain, e.header)
+	e.counter++
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// A full segment is kept until more comes, it may be the last one.
+	for len(e.buf) > encryptSegmentSize {
+		if err := e.seal(e.buf[:encryptSegmentSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[encryptSegmentSize:]...)
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+type decryptReader struct {
+	aead    cipher.AEAD
+	r       *bufio.Reader
+	header  []byte
+	prefix  []byte
+	counter uint32
+	seg     []byte
+	plain   []byte
+	done    bool
+}
+
+// Decrypt returns the reader of the plain data, the errors are ErrTampered if the file fails the authentication.
+func (c *Cipher) Decrypt(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(encryptMagic)+2)
+	if _, err := io.ReadFull(br, head); err != nil || string(head[:len(encryptMagic)]) != encryptMagic {
+		return nil, errors.New("file.is.not.encrypted")
+	}
+	if head[4] != encryptVersion {
+		return nil, fmt.Errorf("encryption.version[%d].unsupported", head[4])
+	}
+	idSize := int(head[5])
+	rest := make([]byte, idSize+encryptSaltSize+encryptPrefixSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, ErrTampered
+	}
+	if id := string(rest[:idSize]); id != c.id {
+		return nil, fmt.Errorf("file.encrypted.with.key[%s].but.key[%s].given", id, c.id)
+	}
+	aead, err := c.fileAEAD(rest[idSize : idSize+encryptSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		aead:   aead,
+		r:      br,
+		header: append(head, rest...),
+		prefix: rest[idSize+encryptSaltSize:],
+		seg:    make([]byte, encryptSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.seg)
+		last := false
+		switch err {
+		case nil:
+			_, err := d.r.Peek(1)
+			last = err == io.EOF
+		case io.ErrUnexpectedEOF, io.EOF:
+			last = true
+		default:
+			return 0, err
+		}
+		plain, err := d.aead.Open(d.seg[:0:0], segmentNonce(d.aead, d.prefix, d.counter, last), d.seg[:n], d.header)
+		if err != nil {
+			return 0, ErrTampered
+		}
+		d.counter++
+		d.plain = plain
+		d.done = last
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// encodeDumpData compresses then encrypts the file data, as configured.
+func encodeDumpData(args *Args, data string) (string, error) {
+	if !args.Compress && args.Cipher == nil {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var closers []io.Closer
+	if args.Cipher != nil {
+		enc, err := args.Cipher.Encrypt(w)
+		if err != nil {
+			return "", err
+		}
+		w = enc
+		closers = append(closers, enc)
+	}
+	if args.Compress {
+		gz := newGzipWriter(w)
+		w = gz
+		closers = append(closers, gz)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		return "", err
+	}
+	// The innermost layer first.
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// checkDumpKey fails early if the dump is encrypted with another key than the given one.
+func checkDumpKey(log *xlog.Log, args *Args) {
+	m, err := ReadMetadata(args.Outdir)
+	if err != nil || m.KeyID == "" {
+		return
+	}
+	switch {
+	case args.Cipher == nil:
+		log.Panicf("loader.dump.encrypted.with.key[%s].set.the.key.file.or.%s", m.KeyID, encryptionKeyEnv)
+	case args.Cipher.ID() != m.KeyID:
+		log.Panicf("loader.dump.encrypted.with.key[%s].but.key[%s].given", m.KeyID, args.Cipher.ID())
+	}
+	log.Info("loader.dump.encrypted.with.key[%s]...", m.KeyID)
+}
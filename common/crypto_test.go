@@ -0,0 +1,167 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func testCipher(t *testing.T, b byte) *Cipher {
+	c, err := NewCipher(bytes.Repeat([]byte{b}, 32))
+	assert.Nil(t, err)
+	return c
+}
+
+func encryptBytes(t *testing.T, c *Cipher, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := c.Encrypt(&buf)
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func decryptBytes(c *Cipher, data []byte) ([]byte, error) {
+	r, err := c.Decrypt(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestCipherRoundtrip(t *testing.T) {
+	c := testCipher(t, 1)
+	for _, size := range []int{0, 1, encryptSegmentSize, encryptSegmentSize + 1, 3 * encryptSegmentSize} {
+		data := bytes.Repeat([]byte("x"), size)
+		sealed := encryptBytes(t, c, data)
+		plain, err := decryptBytes(c, sealed)
+		assert.Nil(t, err)
+		assert.Equal(t, data, plain, "size[%d]", size)
+	}
+
+	// Same data, different salts and prefixes.
+	assert.NotEqual(t, encryptBytes(t, c, []byte("x")), encryptBytes(t, c, []byte("x")))
+}
+
+func TestCipherFileKeys(t *testing.T) {
+	// RFC 5869 test case 1, the first 32 bytes.
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf", hex.EncodeToString(hkdf(ikm, salt, string(info))))
+
+	// The files of the same prefix are still under keys of their own.
+	c := testCipher(t, 1)
+	a, err := c.fileAEAD(bytes.Repeat([]byte{1}, encryptSaltSize))
+	assert.Nil(t, err)
+	b, err := c.fileAEAD(bytes.Repeat([]byte{2}, encryptSaltSize))
+	assert.Nil(t, err)
+	nonce := segmentNonce(a, make([]byte, encryptPrefixSize), 0, true)
+	assert.NotEqual(t, a.Seal(nil, nonce, []byte("x"), nil), b.Seal(nil, nonce, []byte("x"), nil))
+
+	// The other versions are refused.
+	sealed := encryptBytes(t, c, []byte("x"))
+	sealed[len(encryptMagic)] = 1
+	_, err = decryptBytes(c, sealed)
+	assert.NotNil(t, err)
+}
+
+func TestCipherTampered(t *testing.T) {
+	c := testCipher(t, 1)
+	data := bytes.Repeat([]byte("0123456789"), encryptSegmentSize/5)
+	sealed := encryptBytes(t, c, data)
+
+	// Flipped bit.
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	_, err := decryptBytes(c, flipped)
+	assert.Equal(t, ErrTampered, err)
+
+	// Truncated at the segment boundary, the last segment is gone.
+	header := len(encryptMagic) + 2 + len(c.ID()) + encryptSaltSize + encryptPrefixSize
+	segment := encryptSegmentSize + 16
+	_, err = decryptBytes(c, sealed[:header+segment])
+	assert.Equal(t, ErrTampered, err)
+
+	// Tampered header.
+	header0 := append([]byte(nil), sealed...)
+	header0[header-1] ^= 1
+	_, err = decryptBytes(c, header0)
+	assert.Equal(t, ErrTampered, err)
+
+	// Wrong key.
+	_, err = decryptBytes(testCipher(t, 2), sealed)
+	assert.NotNil(t, err)
+}
+
+func TestLoadCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	want, err := NewCipher(key)
+	assert.Nil(t, err)
+
+	file := "/tmp/mydumper-test.key"
+	defer os.Remove(file)
+	assert.Nil(t, ioutil.WriteFile(file, []byte(hex.EncodeToString(key)+"\n"), 0600))
+	c, err := LoadCipher(file)
+	assert.Nil(t, err)
+	assert.Equal(t, want.ID(), c.ID())
+
+	os.Setenv(encryptionKeyEnv, "short")
+	defer os.Unsetenv(encryptionKeyEnv)
+	_, err = LoadCipher("")
+	assert.NotNil(t, err)
+
+	os.Unsetenv(encryptionKeyEnv)
+	c, err = LoadCipher("")
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+}
+
+func TestEncryptedDumpFile(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	dir := "/tmp/dumpertest-encrypted"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	args := &Args{Manifest: NewManifest(), Compress: true, Cipher: testCipher(t, 1)}
+	data := "INSERT INTO `t1`(`a`) VALUES\n" + strings.Repeat("(1),\n", encryptSegmentSize) + "(2);\n"
+	file := tableDataFile(dir, "test", "t1", 1, tableSuffix)
+	assert.Nil(t, writeDumpFile(args, file, data, "test", "t1", uint64(encryptSegmentSize+1)))
+	assert.Nil(t, args.Manifest.Write(dir))
+
+	stored, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, encryptMagic, string(stored[:len(encryptMagic)]))
+	assert.True(t, len(stored) < len(data))
+
+	got, err := readDumpFile(args, file)
+	assert.Nil(t, err)
+	assert.Equal(t, data, string(got))
+
+	// The manifest is of the stored bytes, verified without the key.
+	assert.Nil(t, VerifyDump(log, dir, 2))
+
+	_, err = readDumpFile(&Args{}, file)
+	assert.NotNil(t, err)
+
+	stored[len(stored)-1] ^= 1
+	assert.Nil(t, ioutil.WriteFile(file, stored, 0644))
+	_, err = readDumpFile(args, file)
+	assert.Equal(t, ErrTampered, err)
+}
@@ -0,0 +1,430 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/driver"
+	"github.com/xelabs/go-mysqlstack/proto"
+	"github.com/xelabs/go-mysqlstack/sqldb"
+)
+
+// The TLS modes, as the mysql client --ssl-mode.
+const (
+	SSLDisabled       = "disabled"
+	SSLPreferred      = "preferred"
+	SSLRequired       = "required"
+	SSLVerifyCA       = "verify_ca"
+	SSLVerifyIdentity = "verify_identity"
+
+	// unixScheme prefixes the unix socket addresses.
+	unixScheme = "unix:"
+
+	dialTimeout = 30 * time.Second
+)
+
+var sslModes = map[string]bool{
+	"":                true,
+	SSLDisabled:       true,
+	SSLPreferred:      true,
+	SSLRequired:       true,
+	SSLVerifyCA:       true,
+	SSLVerifyIdentity: true,
+}
+
+// TLSOptions are the TLS settings of the connections.
+type TLSOptions struct {
+	Mode       string
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+}
+
+// Enabled returns true if the connections may use TLS.
+func (o *TLSOptions) Enabled() bool {
+	return o != nil && o.Mode != "" && o.Mode != SSLDisabled
+}
+
+// Validate checks the mode and the files.
+func (o *TLSOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if !sslModes[o.Mode] {
+		return fmt.Errorf("ssl.mode[%s].must.be.disabled.preferred.required.verify_ca.or.verify_identity", o.Mode)
+	}
+	if (o.Cert == "") != (o.Key == "") {
+		return errors.New("ssl.cert.and.ssl.key.must.be.given.together")
+	}
+	return nil
+}
+
+// TLSFlags are the -ssl-* flags of the command line, prefixed for the target of the checker.
+type TLSFlags struct {
+	prefix string
+	opts   TLSOptions
+}
+
+// NewTLSFlags registers the flags on the flag set, the side names the server in the usages.
+func NewTLSFlags(fs *flag.FlagSet, prefix string, side string) *TLSFlags {
+	f := &TLSFlags{prefix: prefix}
+	fs.StringVar(&f.opts.Mode, prefix+"ssl-mode", "", "TLS of the "+side+" connections: disabled, preferred, required, verify_ca or verify_identity (default disabled)")
+	fs.StringVar(&f.opts.CA, prefix+"ssl-ca", "", "CA file to verify the "+side+" server certificate")
+	fs.StringVar(&f.opts.Cert, prefix+"ssl-cert", "", "Client certificate file for the "+side+" server")
+	fs.StringVar(&f.opts.Key, prefix+"ssl-key", "", "Client key file for the "+side+" server")
+	fs.StringVar(&f.opts.ServerName, prefix+"ssl-server-name", "", "Name to verify the "+side+" server certificate against with verify_identity (default the host)")
+	return f
+}
+
+// Override returns the options overridden by the flags given, set has the names of the given flags.
+func (f *TLSFlags) Override(opts *TLSOptions, set map[string]bool) (*TLSOptions, error) {
+	out := &TLSOptions{}
+	if opts != nil {
+		*out = *opts
+	}
+	for _, o := range []struct {
+		name string
+		dst  *string
+		src  string
+	}{
+		{"ssl-mode", &out.Mode, strings.ToLower(f.opts.Mode)},
+		{"ssl-ca", &out.CA, f.opts.CA},
+		{"ssl-cert", &out.Cert, f.opts.Cert},
+		{"ssl-key", &out.Key, f.opts.Key},
+		{"ssl-server-name", &out.ServerName, f.opts.ServerName},
+	} {
+		if set[f.prefix+o.name] {
+			*o.dst = o.src
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	if out.Mode == "" {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// config returns the tls config to the host.
+func (o *TLSOptions) config(host string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CA != "" {
+		data, err := ioutil.ReadFile(o.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ssl.ca[%s].has.no.certificate", o.CA)
+		}
+	}
+	if o.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch o.Mode {
+	case SSLVerifyIdentity:
+		cfg.ServerName = o.ServerName
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+	case SSLVerifyCA:
+		// The chain is verified, the name isn't.
+		roots := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(raw))
+			for i, b := range raw {
+				cert, err := x509.ParseCertificate(b)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return errors.New("ssl.server.sent.no.certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		}
+	default:
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// splitAddress returns the network and the address to dial, unix:/path is the unix socket.
+func splitAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixScheme) {
+		return "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	return "tcp", address
+}
+
+// dialConn opens the client connection to the address. The driver only dials plain TCP, the
+// connection is dialed here and the handshake, TLS and auth are done on it before the commands.
+func dialConn(address string, user string, password string, tlsOpts *TLSOptions) (driver.Conn, error) {
+	network, addr := splitAddress(address)
+	var cfg *tls.Config
+	if tlsOpts.Enabled() {
+		host, _, _ := net.SplitHostPort(addr)
+		var err error
+		if cfg, err = tlsOpts.config(host); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialTimeout(network, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(180 * time.Second)
+	}
+	h := &handshake{conn: conn, user: user, password: password, tls: cfg, mode: tlsOpts.mode(), secure: network == "unix"}
+	if err := h.run(); err != nil {
+		h.conn.Close()
+		return nil, err
+	}
+	return newClientConn(h.conn, h.capability, h.id), nil
+}
+
+// mode returns the TLS mode, disabled if nil.
+func (o *TLSOptions) mode() string {
+	if o == nil {
+		return SSLDisabled
+	}
+	return o.Mode
+}
+
+// handshake authenticates the connection as the mysql client: the greeting is plain, the SSL
+// request precedes the TLS handshake and the auth goes through TLS, then the auth switch and the
+// caching_sha2 rounds until the OK or ERR packet.
+type handshake struct {
+	conn     net.Conn
+	user     string
+	password string
+	tls      *tls.Config
+	mode     string
+
+	// secure is the unix socket or TLS, the password may go in clear.
+	secure     bool
+	seq        byte
+	capability uint32
+	id         uint32
+}
+
+func (h *handshake) read() ([]byte, error) {
+	seq, data, err := readPacket(h.conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("handshake.empty.packet")
+	}
+	h.seq = seq + 1
+	return data, nil
+}
+
+func (h *handshake) write(data []byte) error {
+	err := writePacket(h.conn, h.seq, data)
+	h.seq++
+	return err
+}
+
+func (h *handshake) run() error {
+	h.conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer func() { h.conn.SetDeadline(time.Time{}) }()
+
+	data, err := h.read()
+	if err != nil {
+		return err
+	}
+	if data[0] == proto.ERR_PACKET {
+		return proto.UnPackERR(data)
+	}
+	greeting := proto.NewGreeting(0, "")
+	if err := greeting.UnPack(data); err != nil {
+		return err
+	}
+	if greeting.Capability&sqldb.CLIENT_PROTOCOL_41 == 0 {
+		return sqldb.NewSQLError(sqldb.CR_VERSION_ERROR, "cannot connect to servers earlier than 4.1")
+	}
+	h.id = greeting.ConnectionID
+	h.capability = greeting.Capability & proto.DefaultClientCapability
+	salt := greeting.Salt
+
+	capability := proto.DefaultClientCapability
+	if h.tls != nil && greeting.Capability&sqldb.CLIENT_SSL == 0 {
+		if h.mode != SSLPreferred {
+			return errors.New("ssl.required.but.the.server.does.not.support.it")
+		}
+		h.tls = nil
+	}
+	if h.tls != nil {
+		capability |= sqldb.CLIENT_SSL
+	}
+	auth := proto.NewAuth().Pack(capability, sqldb.CharacterSetUtf8, h.user, h.password, salt, "")
+	if h.tls != nil {
+		// The SSL request is the head of the auth packet.
+		if err := h.write(auth[:32]); err != nil {
+			return err
+		}
+		conn := tls.Client(h.conn, h.tls)
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		h.conn = conn
+		h.secure = true
+	}
+	if err := h.write(auth); err != nil {
+		return err
+	}
+	return h.auth(salt)
+}
+
+// auth answers the server until the OK or ERR packet.
+func (h *handshake) auth(salt []byte) error {
+	for {
+		data, err := h.read()
+		if err != nil {
+			return err
+		}
+		switch {
+		case data[0] == proto.OK_PACKET:
+			return nil
+		case data[0] == proto.ERR_PACKET:
+			return proto.UnPackERR(data)
+		case data[0] == proto.EOF_PACKET:
+			// The auth switch: plugin name, NUL, salt.
+			end := bytes.IndexByte(data[1:], 0)
+			if end < 0 {
+				return errors.New("handshake.malformed.auth.switch")
+			}
+			plugin := string(data[1 : 1+end])
+			salt = bytes.TrimSuffix(data[2+end:], []byte{0})
+			answer, err := h.scramble(plugin, salt)
+			if err != nil {
+				return err
+			}
+			if err := h.write(answer); err != nil {
+				return err
+			}
+		case len(data) == 2 && data[0] == 0x01 && data[1] == 0x03:
+			// The caching_sha2 fast auth, the OK packet follows.
+		case len(data) == 2 && data[0] == 0x01 && data[1] == 0x04:
+			// The caching_sha2 full auth wants the password.
+			if !h.secure {
+				return errors.New("caching_sha2_password.full.auth.needs.tls.or.a.unix.socket")
+			}
+			if err := h.write(append([]byte(h.password), 0)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("handshake.unexpected.auth.packet[%x]", data[0])
+		}
+	}
+}
+
+// scramble returns the answer to the auth switch to the plugin.
+func (h *handshake) scramble(plugin string, salt []byte) ([]byte, error) {
+	switch plugin {
+	case "mysql_native_password":
+		return scrambleNative(h.password, salt), nil
+	case "caching_sha2_password":
+		return scrambleSHA256(h.password, salt), nil
+	case "mysql_clear_password":
+		if !h.secure {
+			return nil, errors.New("mysql_clear_password.needs.tls.or.a.unix.socket")
+		}
+		return append([]byte(h.password), 0), nil
+	}
+	return nil, fmt.Errorf("auth.plugin[%s].unsupported", plugin)
+}
+
+// scrambleNative is SHA1(password) XOR SHA1(salt + SHA1(SHA1(password))).
+func scrambleNative(password string, salt []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(salt)
+	h.Write(stage2[:])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// scrambleSHA256 is SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt).
+func scrambleSHA256(password string, salt []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(salt)
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// readPacket reads one MySQL packet.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+// writePacket writes one MySQL packet.
+func writePacket(w io.Writer, seq byte, payload []byte) error {
+	size := len(payload)
+	header := []byte{byte(size), byte(size >> 8), byte(size >> 16), seq}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
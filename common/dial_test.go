@@ -0,0 +1,349 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	"github.com/xelabs/go-mysqlstack/proto"
+	"github.com/xelabs/go-mysqlstack/sqldb"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// testCert returns the self signed certificate of 127.0.0.1 and mysql.test, with its PEM.
+func testCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mysql.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"mysql.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// tlsFront is the TLS terminating proxy in front of the mock server, which has no TLS.
+func tlsFront(t *testing.T, upstream string, cert tls.Certificate) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(client net.Conn) {
+				server, err := net.Dial("tcp", upstream)
+				if err != nil {
+					client.Close()
+					return
+				}
+				fail := func() {
+					client.Close()
+					server.Close()
+				}
+
+				// Advertise the TLS support.
+				seq, greeting, err := readPacket(server)
+				if err != nil {
+					fail()
+					return
+				}
+				end := 1
+				for greeting[end] != 0 {
+					end++
+				}
+				pos := end + 1 + 4 + 8 + 1
+				binary.LittleEndian.PutUint16(greeting[pos:], binary.LittleEndian.Uint16(greeting[pos:])|uint16(sqldb.CLIENT_SSL))
+				writePacket(client, seq, greeting)
+
+				if _, _, err := readPacket(client); err != nil {
+					fail()
+					return
+				}
+				secure := tls.Server(client, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if err := secure.Handshake(); err != nil {
+					fail()
+					return
+				}
+
+				// The server sees the plain auth.
+				seq, auth, err := readPacket(secure)
+				if err != nil {
+					fail()
+					return
+				}
+				binary.LittleEndian.PutUint32(auth, binary.LittleEndian.Uint32(auth)&^sqldb.CLIENT_SSL)
+				writePacket(server, seq-1, auth)
+				seq, resp, err := readPacket(server)
+				if err != nil {
+					fail()
+					return
+				}
+				writePacket(secure, seq+1, resp)
+				pipeConns(secure, server)
+			}(client)
+		}
+	}()
+	return ln
+}
+
+// pipeConns copies both ways until one side closes.
+func pipeConns(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+}
+
+func TestDialTLS(t *testing.T) {
+	defer fastPool(1)()
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	fakedbs.AddQueryPattern("select .*", &sqltypes.Result{})
+
+	cert, certPEM := testCert(t)
+	dir, err := ioutil.TempDir("", "dial")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(ca, certPEM, 0644))
+
+	front := tlsFront(t, server.Addr(), cert)
+	defer front.Close()
+
+	tests := []struct {
+		name string
+		opts *TLSOptions
+		ok   bool
+	}{
+		{"required", &TLSOptions{Mode: SSLRequired}, true},
+		{"verify.ca", &TLSOptions{Mode: SSLVerifyCA, CA: ca, ServerName: "wrong.test"}, true},
+		{"verify.identity", &TLSOptions{Mode: SSLVerifyIdentity, CA: ca, ServerName: "mysql.test"}, true},
+		{"verify.identity.host", &TLSOptions{Mode: SSLVerifyIdentity, CA: ca}, true},
+		{"verify.identity.wrong.name", &TLSOptions{Mode: SSLVerifyIdentity, CA: ca, ServerName: "wrong.test"}, false},
+		{"verify.ca.unknown.ca", &TLSOptions{Mode: SSLVerifyCA}, false},
+	}
+	for _, test := range tests {
+		pool, err := NewPool(log, 2, front.Addr().String(), "mock", "mock", "", test.opts)
+		if !test.ok {
+			assert.NotNil(t, err, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		conn, err := pool.Get()
+		assert.Nil(t, err)
+		_, err = conn.Fetch("select 1")
+		assert.Nil(t, err, test.name)
+		pool.Put(conn)
+		pool.Close()
+	}
+
+	// The mock has no TLS.
+	_, err = NewPool(log, 1, server.Addr(), "mock", "mock", "", &TLSOptions{Mode: SSLRequired})
+	assert.NotNil(t, err)
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock", "", &TLSOptions{Mode: SSLPreferred})
+	assert.Nil(t, err)
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	_, err = conn.Fetch("select 1")
+	assert.Nil(t, err)
+	pool.Put(conn)
+	pool.Close()
+}
+
+func TestDialAuthRounds(t *testing.T) {
+	cert, _ := testCert(t)
+	greeting := proto.NewGreeting(1, "5.7.0")
+	greeting.Capability |= sqldb.CLIENT_SSL
+	salt := []byte("01234567890123456789")
+	ok := []byte{0x00, 0, 0, 2, 0, 0, 0}
+	native := append(append([]byte{0xfe}, "mysql_native_password\x00"...), append(salt, 0)...)
+	sha2 := append(append([]byte{0xfe}, "caching_sha2_password\x00"...), append(salt, 0)...)
+	clear := []byte("\xfemysql_clear_password\x00")
+
+	// The answers of the rounds, nil for none.
+	tests := []struct {
+		name    string
+		tls     bool
+		rounds  [][]byte
+		answers [][]byte
+		ok      bool
+	}{
+		{"ok", false, nil, nil, true},
+		{"auth.switch.native", false, [][]byte{native}, [][]byte{scrambleNative("pw", salt)}, true},
+		{"caching.sha2.fast", true, [][]byte{{0x01, 0x03}}, [][]byte{nil}, true},
+		{"caching.sha2.full", true, [][]byte{{0x01, 0x04}}, [][]byte{[]byte("pw\x00")}, true},
+		{"auth.switch.caching.sha2.fast", true, [][]byte{sha2, {0x01, 0x03}}, [][]byte{scrambleSHA256("pw", salt), nil}, true},
+		{"auth.switch.caching.sha2.full", true, [][]byte{sha2, {0x01, 0x04}}, [][]byte{scrambleSHA256("pw", salt), []byte("pw\x00")}, true},
+		{"auth.switch.clear", true, [][]byte{clear}, [][]byte{[]byte("pw\x00")}, true},
+		{"caching.sha2.full.plain", false, [][]byte{{0x01, 0x04}}, [][]byte{nil}, false},
+		{"auth.switch.clear.plain", false, [][]byte{clear}, [][]byte{nil}, false},
+		{"auth.switch.unknown", false, [][]byte{[]byte("\xfesha256_password\x00")}, [][]byte{nil}, false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			done <- func() error {
+				var conn net.Conn = server
+				if err := writePacket(conn, 0, greeting.Pack()); err != nil {
+					return err
+				}
+				want := byte(1)
+				if test.tls {
+					seq, req, err := readPacket(conn)
+					if err != nil {
+						return err
+					}
+					if seq != want || len(req) != 32 || binary.LittleEndian.Uint32(req)&sqldb.CLIENT_SSL == 0 {
+						return fmt.Errorf("ssl.request.seq[%d].len[%d]", seq, len(req))
+					}
+					conn = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+					want++
+				}
+				seq, _, err := readPacket(conn)
+				if err != nil {
+					return err
+				}
+				if seq != want {
+					return fmt.Errorf("auth.seq[%d].want[%d]", seq, want)
+				}
+				for i, round := range test.rounds {
+					if err := writePacket(conn, seq+1, round); err != nil {
+						return err
+					}
+					seq++
+					if test.answers[i] == nil {
+						continue
+					}
+					got, data, err := readPacket(conn)
+					if err != nil {
+						return err
+					}
+					if got != seq+1 || !bytes.Equal(data, test.answers[i]) {
+						return fmt.Errorf("answer.seq[%d].data[%q]", got, data)
+					}
+					seq = got
+				}
+				return writePacket(conn, seq+1, ok)
+			}()
+		}()
+
+		h := &handshake{conn: client, user: "mock", password: "pw", mode: SSLRequired}
+		if test.tls {
+			h.tls = &tls.Config{InsecureSkipVerify: true}
+		}
+		err := h.run()
+		h.conn.Close()
+		if !test.ok {
+			assert.NotNil(t, err, test.name)
+			<-done
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.Nil(t, <-done, test.name)
+		assert.Equal(t, uint32(1), h.id, test.name)
+	}
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	defer fastPool(1)()
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	fakedbs.AddQueryPattern("select .*", &sqltypes.Result{})
+
+	dir, err := ioutil.TempDir("", "dial")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "mysql.sock")
+	ln, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", server.Addr())
+			if err != nil {
+				client.Close()
+				return
+			}
+			go pipeConns(client, upstream)
+		}
+	}()
+
+	pool, err := NewPool(log, 2, "unix:"+socket, "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	_, err = conn.Fetch("select 1")
+	assert.Nil(t, err)
+	pool.Put(conn)
+
+	_, err = NewPool(log, 1, "unix:"+filepath.Join(dir, "none.sock"), "mock", "mock", "", nil)
+	assert.NotNil(t, err)
+}
+
+func TestTLSOptionsValidate(t *testing.T) {
+	assert.Nil(t, (*TLSOptions)(nil).Validate())
+	assert.Nil(t, (&TLSOptions{Mode: SSLVerifyIdentity}).Validate())
+	assert.NotNil(t, (&TLSOptions{Mode: "always"}).Validate())
+	assert.NotNil(t, (&TLSOptions{Mode: SSLRequired, Cert: "client.pem"}).Validate())
+	assert.False(t, (&TLSOptions{Mode: SSLDisabled}).Enabled())
+	assert.True(t, (&TLSOptions{Mode: SSLPreferred}).Enabled())
+}
@@ -0,0 +1,547 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dorisMaxVarchar is the longest Doris VARCHAR, in bytes.
+const dorisMaxVarchar = 65533
+
+// dorisPartitionUnits are the date_trunc units of the auto partitions.
+var dorisPartitionUnits = map[string]bool{"day": true, "week": true, "month": true, "year": true}
+
+var (
+	tableCharsetRegexp = regexp.MustCompile(`(?i)DEFAULT CHARSET=(\w+)`)
+	tableNameRegexp    = regexp.MustCompile("(?i)^CREATE TABLE `((?:[^`]|``)+)`")
+)
+
+// mysqlColumn is a column of the MySQL DDL.
+type mysqlColumn struct {
+	name     string
+	typ      string
+	args     string
+	unsigned bool
+	charset  string
+	notNull  bool
+	comment  string
+}
+
+// mysqlTable is the MySQL DDL of SHOW CREATE TABLE.
+type mysqlTable struct {
+	name    string
+	charset string
+	comment string
+	columns []*mysqlColumn
+	primary []string
+}
+
+// ddlTokens splits the column definition by the spaces, the quoted strings and the
+// parenthesized groups kept whole.
+func ddlTokens(s string) []string {
+	var tokens []string
+	var cur strings.Builder
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			cur.WriteByte(c)
+			if c == '\\' && i+1 < len(s) {
+				i++
+				cur.WriteByte(s[i])
+			} else if c == quote {
+				if i+1 < len(s) && s[i+1] == quote {
+					i++
+					cur.WriteByte(s[i])
+				} else {
+					quote = 0
+				}
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			cur.WriteByte(c)
+		case c == '(':
+			depth++
+			cur.WriteByte(c)
+		case c == ')':
+			depth--
+			cur.WriteByte(c)
+		case c == ' ' && depth == 0:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// ddlName returns the name of the quoted identifier.
+func ddlName(s string) string {
+	return strings.ReplaceAll(strings.Trim(s, "`"), "``", "`")
+}
+
+// ddlColumns returns the names of the column list, such as (`a`,`b`(10)).
+func ddlColumns(s string) []string {
+	var names []string
+	for _, part := range strings.Split(strings.Trim(s, "()"), ",") {
+		part = strings.TrimSpace(part)
+		if i := strings.Index(part, "("); i > 0 {
+			part = part[:i]
+		}
+		names = append(names, ddlName(part))
+	}
+	return names
+}
+
+// parseMySQLTable parses the MySQL DDL, one definition per line as SHOW CREATE TABLE
+// writes it.
+func parseMySQLTable(ddl string) (*mysqlTable, error) {
+	lines := strings.Split(strings.TrimSpace(ddl), "\n")
+	m := tableNameRegexp.FindStringSubmatch(lines[0])
+	if m == nil {
+		return nil, fmt.Errorf("ddl.not.a.create.table[%.64s]", lines[0])
+	}
+	t := &mysqlTable{name: ddlName("`" + m[1] + "`")}
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+		switch {
+		case strings.HasPrefix(line, "`"):
+			c, err := parseMySQLColumn(line)
+			if err != nil {
+				return nil, err
+			}
+			t.columns = append(t.columns, c)
+		case strings.HasPrefix(line, "PRIMARY KEY "):
+			tokens := ddlTokens(line)
+			t.primary = ddlColumns(tokens[2])
+		case strings.HasPrefix(line, ")"):
+			if m := tableCharsetRegexp.FindStringSubmatch(line); m != nil {
+				t.charset = strings.ToLower(m[1])
+			}
+			for _, token := range ddlTokens(line[1:]) {
+				if strings.HasPrefix(token, "COMMENT='") {
+					t.comment = strings.TrimPrefix(token, "COMMENT=")
+				}
+			}
+		}
+	}
+	if len(t.columns) == 0 {
+		return nil, fmt.Errorf("ddl.table[%s].has.no.columns", t.name)
+	}
+	return t, nil
+}
+
+func parseMySQLColumn(line string) (*mysqlColumn, error) {
+	tokens := ddlTokens(line)
+	if len(tokens) < 2 {
+		return nil, fmt.Errorf("ddl.column[%s].invalid", line)
+	}
+	c := &mysqlColumn{name: ddlName(tokens[0])}
+	typ := tokens[1]
+	if i := strings.Index(typ, "("); i > 0 {
+		c.args = strings.TrimSuffix(typ[i+1:], ")")
+		typ = typ[:i]
+	}
+	c.typ = strings.ToLower(typ)
+	for i := 2; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i]) {
+		case "UNSIGNED":
+			c.unsigned = true
+		case "CHARACTER":
+			if i+2 < len(tokens) {
+				c.charset = strings.ToLower(tokens[i+2])
+				i += 2
+			}
+		case "NOT":
+			if i+1 < len(tokens) && strings.ToUpper(tokens[i+1]) == "NULL" {
+				c.notNull = true
+				i++
+			}
+		case "COMMENT":
+			if i+1 < len(tokens) {
+				c.comment = tokens[i+1]
+				i++
+			}
+		case "DEFAULT":
+			// The defaults are not kept, the value is skipped not to read it as a keyword.
+			i++
+		}
+	}
+	return c, nil
+}
+
+// utf8Bytes returns the most UTF-8 bytes of one char of the charset, Doris counts the bytes.
+func utf8Bytes(charset string) int {
+	switch charset {
+	case "ascii", "binary":
+		return 1
+	case "latin1":
+		return 2
+	case "utf8", "utf8mb3", "gbk", "gb2312", "big5":
+		return 3
+	}
+	return 4
+}
+
+// enumLength returns the longest value of the enum, or the sum of the set values.
+func enumLength(args string, set bool) int {
+	var n, longest int
+	for _, v := range ddlValues(args) {
+		n += len([]rune(v)) + 1
+		if len([]rune(v)) > longest {
+			longest = len([]rune(v))
+		}
+	}
+	if set {
+		return n
+	}
+	return longest
+}
+
+// ddlValues returns the quoted values of the enum or set arguments.
+func ddlValues(args string) []string {
+	var values []string
+	for i := 0; i < len(args); i++ {
+		if args[i] != '\'' {
+			continue
+		}
+		var v strings.Builder
+		for i++; i < len(args); i++ {
+			if args[i] == '\'' {
+				if i+1 < len(args) && args[i+1] == '\'' {
+					i++
+				} else {
+					break
+				}
+			}
+			v.WriteByte(args[i])
+		}
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// dorisVarchar returns the VARCHAR of the chars, STRING if too long.
+func dorisVarchar(chars int, mult int) string {
+	if n := chars * mult; n <= dorisMaxVarchar {
+		return fmt.Sprintf("VARCHAR(%d)", n)
+	}
+	return "STRING"
+}
+
+// dorisType returns the Doris type of the MySQL column.
+func dorisType(c *mysqlColumn, charset string) string {
+	if c.charset != "" {
+		charset = c.charset
+	}
+	mult := utf8Bytes(charset)
+	n, _ := strconv.Atoi(c.args)
+	switch c.typ {
+	case "tinyint":
+		if c.unsigned {
+			return "SMALLINT"
+		}
+		return "TINYINT"
+	case "smallint":
+		if c.unsigned {
+			return "INT"
+		}
+		return "SMALLINT"
+	case "mediumint":
+		return "INT"
+	case "int", "integer":
+		if c.unsigned {
+			return "BIGINT"
+		}
+		return "INT"
+	case "bigint":
+		if c.unsigned {
+			return "LARGEINT"
+		}
+		return "BIGINT"
+	case "float":
+		return "FLOAT"
+	case "double", "real":
+		return "DOUBLE"
+	case "decimal", "numeric":
+		if c.args == "" {
+			return "DECIMAL(10,0)"
+		}
+		if p, _ := strconv.Atoi(strings.Split(c.args, ",")[0]); p > 38 {
+			return "STRING"
+		}
+		return "DECIMAL(" + c.args + ")"
+	case "year":
+		return "SMALLINT"
+	case "date":
+		return "DATE"
+	case "datetime", "timestamp":
+		if c.args != "" && c.args != "0" {
+			return "DATETIME(" + c.args + ")"
+		}
+		return "DATETIME"
+	case "char":
+		if n == 0 {
+			n = 1
+		}
+		if n*mult <= 255 {
+			return fmt.Sprintf("CHAR(%d)", n*mult)
+		}
+		return dorisVarchar(n, mult)
+	case "varchar":
+		return dorisVarchar(n, mult)
+	case "enum":
+		return dorisVarchar(enumLength(c.args, false), mult)
+	case "set":
+		return dorisVarchar(enumLength(c.args, true), mult)
+	case "json":
+		return "JSON"
+	}
+	// The texts, blobs, binaries, times, bits and spatial types.
+	return "STRING"
+}
+
+// dorisKeyType returns true if the Doris type may be a key column.
+func dorisKeyType(typ string) bool {
+	switch typ {
+	case "STRING", "JSON", "FLOAT", "DOUBLE":
+		return false
+	}
+	return true
+}
+
+// dorisOptions are the Doris table options of the config.
+type dorisOptions struct {
+	// buckets of the hash distribution, 0 is AUTO.
+	buckets int
+	// partition is the date column of the auto range partitions by unit, none if empty.
+	partition string
+	unit      string
+}
+
+// parseDorisPartition parses the "column [unit]" of a [doris_partition] entry, month by default.
+func parseDorisPartition(v string) (string, string, error) {
+	fields := strings.Fields(v)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", "", fmt.Errorf("partition[%s].must.be.column.[unit]", v)
+	}
+	unit := "month"
+	if len(fields) == 2 {
+		unit = strings.ToLower(fields[1])
+	}
+	if !dorisPartitionUnits[unit] {
+		return "", "", fmt.Errorf("partition[%s].unit.must.be.day.week.month.or.year", v)
+	}
+	return fields[0], unit, nil
+}
+
+// tableDorisOptions returns the Doris options of the table.
+func tableDorisOptions(args *Args, table string) dorisOptions {
+	opts := dorisOptions{buckets: args.DorisBuckets}
+	if v, ok := args.DorisPartitions[table]; ok {
+		opts.partition, opts.unit, _ = parseDorisPartition(v)
+	}
+	return opts
+}
+
+// hasDbusColumns returns true if the columns end with the dbus ones, the source carries them
+// already, else the Doris dump adds them to the data.
+func hasDbusColumns(columns []string) bool {
+	n := len(columns)
+	return n >= 2 && strings.Trim(columns[n-2], "`") == DBUS_ACTION && strings.Trim(columns[n-1], "`") == DBUS_TS
+}
+
+// dorisDDL translates the MySQL DDL into the Doris one: the types mapped with the VARCHAR
+// lengths in UTF-8 bytes, the UNIQUE model on the primary key or else the DUPLICATE one, the
+// keys first as Doris requires, hashed into the buckets, and auto range partitions on the date
+// column if set. The dbus columns of the data are added, dbus__timestamp is the sequence of the
+// UNIQUE model so the latest change wins.
+func dorisDDL(ddl string, opts dorisOptions) (string, error) {
+	t, err := parseMySQLTable(ddl)
+	if err != nil {
+		return "", err
+	}
+	types := make(map[string]string, len(t.columns))
+	byName := make(map[string]*mysqlColumn, len(t.columns))
+	names := make([]string, 0, len(t.columns))
+	for _, c := range t.columns {
+		types[c.name] = dorisType(c, t.charset)
+		byName[c.name] = c
+		names = append(names, c.name)
+	}
+	if hasDbusColumns(names) {
+		types[DBUS_ACTION], types[DBUS_TS] = "VARCHAR(8)", "BIGINT"
+	}
+
+	if opts.partition != "" {
+		c, ok := byName[opts.partition]
+		if !ok {
+			return "", fmt.Errorf("doris.table[%s].partition.column[%s].not.found", t.name, opts.partition)
+		}
+		if types[c.name] != "DATE" && !strings.HasPrefix(types[c.name], "DATETIME") {
+			return "", fmt.Errorf("doris.table[%s].partition.column[%s].is.not.a.date", t.name, c.name)
+		}
+		// The auto partitions reject the NULL dates, the stream load would fail on them.
+		if !c.notNull {
+			return "", fmt.Errorf("doris.table[%s].partition.column[%s].is.nullable", t.name, c.name)
+		}
+	}
+
+	// The UNIQUE model needs the key types, the keys are at most VARCHAR.
+	unique := len(t.primary) > 0
+	for _, name := range t.primary {
+		typ, ok := types[name]
+		switch {
+		case !ok:
+			return "", fmt.Errorf("doris.table[%s].primary.column[%s].not.found", t.name, name)
+		case typ == "STRING" && byName[name].typ != "json":
+			types[name] = fmt.Sprintf("VARCHAR(%d)", dorisMaxVarchar)
+		case !dorisKeyType(typ):
+			unique = false
+		}
+	}
+	var keys []string
+	switch {
+	case unique:
+		keys = t.primary
+		if opts.partition != "" && !containsString(keys, opts.partition) {
+			return "", fmt.Errorf("doris.table[%s].partition.column[%s].not.in.the.primary.key", t.name, opts.partition)
+		}
+	case opts.partition != "":
+		keys = []string{opts.partition}
+	default:
+		for _, c := range t.columns {
+			if dorisKeyType(types[c.name]) {
+				keys = []string{c.name}
+				break
+			}
+		}
+	}
+
+	// The keys first, in the key order.
+	columns := make([]*mysqlColumn, 0, len(t.columns))
+	for _, name := range keys {
+		columns = append(columns, byName[name])
+	}
+	for _, c := range t.columns {
+		if !containsString(keys, c.name) {
+			columns = append(columns, c)
+		}
+	}
+
+	quoted := func(names []string) string {
+		out := make([]string, len(names))
+		for i, name := range names {
+			out[i] = quoteIdent(name)
+		}
+		return strings.Join(out, ", ")
+	}
+	var defs []string
+	for _, c := range columns {
+		def := fmt.Sprintf("  %s %s", quoted([]string{c.name}), types[c.name])
+		if c.notNull || (unique && containsString(keys, c.name)) {
+			def += " NOT NULL"
+		} else {
+			def += " NULL"
+		}
+		if c.comment != "" {
+			def += " COMMENT " + c.comment
+		}
+		defs = append(defs, def)
+	}
+	if !hasDbusColumns(names) {
+		defs = append(defs,
+			fmt.Sprintf("  `%s` VARCHAR(8) NULL COMMENT 'change action'", DBUS_ACTION),
+			fmt.Sprintf("  `%s` BIGINT NULL COMMENT 'change unix time'", DBUS_TS))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE %s (\n%s\n) ENGINE=OLAP\n", quoted([]string{t.name}), strings.Join(defs, ",\n"))
+	switch {
+	case unique:
+		fmt.Fprintf(&b, "UNIQUE KEY(%s)\n", quoted(keys))
+	case len(keys) > 0:
+		fmt.Fprintf(&b, "DUPLICATE KEY(%s)\n", quoted(keys))
+	}
+	if t.comment != "" {
+		fmt.Fprintf(&b, "COMMENT %s\n", t.comment)
+	}
+	if opts.partition != "" {
+		fmt.Fprintf(&b, "AUTO PARTITION BY RANGE (date_trunc(%s, '%s')) ()\n", quoted([]string{opts.partition}), opts.unit)
+	}
+	buckets := "AUTO"
+	if opts.buckets > 0 {
+		buckets = strconv.Itoa(opts.buckets)
+	}
+	if len(keys) > 0 {
+		fmt.Fprintf(&b, "DISTRIBUTED BY HASH(%s) BUCKETS %s", quoted(keys), buckets)
+	} else {
+		fmt.Fprintf(&b, "DISTRIBUTED BY RANDOM BUCKETS %s", buckets)
+	}
+	if unique {
+		fmt.Fprintf(&b, "\nPROPERTIES (\n  \"function_column.sequence_col\" = \"%s\"\n)", DBUS_TS)
+	}
+	return b.String(), nil
+}
+
+// dorisSourceDDL returns the DDL of a Doris source table for a Doris target: the REPLACE of the
+// value columns of the UNIQUE model printed by SHOW CREATE TABLE is dropped, and the dbus
+// columns of the data are added if the table has none.
+func dorisSourceDDL(ddl string) string {
+	if strings.Contains(ddl, "UNIQUE KEY") {
+		ddl = strings.ReplaceAll(ddl, " REPLACE ", " ")
+		ddl = strings.ReplaceAll(ddl, " REPLACE,", ",")
+	}
+	lines := strings.Split(ddl, "\n")
+	last := -1
+	var names []string
+	for i, line := range lines {
+		if tokens := ddlTokens(strings.TrimSpace(line)); len(tokens) > 0 && strings.HasPrefix(tokens[0], "`") && i > 0 {
+			names = append(names, ddlName(tokens[0]))
+			last = i
+		}
+	}
+	if last < 0 || hasDbusColumns(names) {
+		return ddl
+	}
+	sep := ""
+	if strings.HasSuffix(lines[last], ",") {
+		sep = ","
+	} else {
+		lines[last] += ","
+	}
+	columns := []string{
+		fmt.Sprintf("  `%s` varchar(8) NULL COMMENT 'change action',", DBUS_ACTION),
+		fmt.Sprintf("  `%s` bigint(20) NULL COMMENT 'change unix time'%s", DBUS_TS, sep),
+	}
+	lines = append(lines[:last+1], append(columns, lines[last+1:]...)...)
+	return strings.Join(lines, "\n")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
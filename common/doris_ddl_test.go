@@ -0,0 +1,141 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDorisDDL(t *testing.T) {
+	ddl := "CREATE TABLE `orders` (\n" +
+		"  `note` text COMMENT 'free, text',\n" +
+		"  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,\n" +
+		"  `shop` varchar(255) NOT NULL DEFAULT 'a b',\n" +
+		"  `code` char(8) CHARACTER SET latin1 DEFAULT NULL,\n" +
+		"  `kind` enum('new','paid') DEFAULT 'new',\n" +
+		"  `amount` decimal(12,2) NOT NULL,\n" +
+		"  `flags` tinyint(3) unsigned DEFAULT NULL,\n" +
+		"  `attrs` json DEFAULT NULL,\n" +
+		"  `created_at` datetime(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),\n" +
+		"  `born` date DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`,`created_at`),\n" +
+		"  KEY `idx_shop` (`shop`)\n" +
+		") ENGINE=InnoDB AUTO_INCREMENT=7 DEFAULT CHARSET=utf8mb4 COMMENT='the orders'"
+	out, err := dorisDDL(ddl, dorisOptions{buckets: 8, partition: "created_at", unit: "month"})
+	assert.Nil(t, err)
+	want := "CREATE TABLE `orders` (\n" +
+		"  `id` LARGEINT NOT NULL,\n" +
+		"  `created_at` DATETIME(3) NOT NULL,\n" +
+		"  `note` STRING NULL COMMENT 'free, text',\n" +
+		"  `shop` VARCHAR(1020) NOT NULL,\n" +
+		"  `code` CHAR(16) NULL,\n" +
+		"  `kind` VARCHAR(16) NULL,\n" +
+		"  `amount` DECIMAL(12,2) NOT NULL,\n" +
+		"  `flags` SMALLINT NULL,\n" +
+		"  `attrs` JSON NULL,\n" +
+		"  `born` DATE NULL,\n" +
+		"  `dbus__action` VARCHAR(8) NULL COMMENT 'change action',\n" +
+		"  `dbus__timestamp` BIGINT NULL COMMENT 'change unix time'\n" +
+		") ENGINE=OLAP\n" +
+		"UNIQUE KEY(`id`, `created_at`)\n" +
+		"COMMENT 'the orders'\n" +
+		"AUTO PARTITION BY RANGE (date_trunc(`created_at`, 'month')) ()\n" +
+		"DISTRIBUTED BY HASH(`id`, `created_at`) BUCKETS 8\n" +
+		"PROPERTIES (\n" +
+		"  \"function_column.sequence_col\" = \"dbus__timestamp\"\n" +
+		")"
+	assert.Equal(t, want, out)
+
+	// The partition column must be in the primary key.
+	_, err = dorisDDL(ddl, dorisOptions{partition: "born", unit: "day"})
+	assert.NotNil(t, err)
+	_, err = dorisDDL(ddl, dorisOptions{partition: "shop", unit: "day"})
+	assert.NotNil(t, err)
+}
+
+func TestDorisDDLDuplicate(t *testing.T) {
+	ddl := "CREATE TABLE `logs` (\n" +
+		"  `body` longtext,\n" +
+		"  `level` varchar(30000) DEFAULT NULL,\n" +
+		"  `at` timestamp NULL DEFAULT NULL\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	out, err := dorisDDL(ddl, dorisOptions{})
+	assert.Nil(t, err)
+	want := "CREATE TABLE `logs` (\n" +
+		"  `at` DATETIME NULL,\n" +
+		"  `body` STRING NULL,\n" +
+		"  `level` STRING NULL,\n" +
+		"  `dbus__action` VARCHAR(8) NULL COMMENT 'change action',\n" +
+		"  `dbus__timestamp` BIGINT NULL COMMENT 'change unix time'\n" +
+		") ENGINE=OLAP\n" +
+		"DUPLICATE KEY(`at`)\n" +
+		"DISTRIBUTED BY HASH(`at`) BUCKETS AUTO"
+	assert.Equal(t, want, out)
+
+	// The partition column is the key, the auto partitions reject the NULL dates.
+	_, err = dorisDDL(ddl, dorisOptions{partition: "at", unit: "day"})
+	assert.NotNil(t, err)
+	out, err = dorisDDL(strings.Replace(ddl, "timestamp NULL DEFAULT NULL", "timestamp NOT NULL", 1), dorisOptions{partition: "at", unit: "day"})
+	assert.Nil(t, err)
+	assert.Contains(t, out, "  `at` DATETIME NOT NULL,\n")
+	assert.Contains(t, out, "AUTO PARTITION BY RANGE (date_trunc(`at`, 'day')) ()\n")
+
+	// No key column at all, the text primary key is a VARCHAR.
+	out, err = dorisDDL("CREATE TABLE `t` (\n  `v` blob\n) ENGINE=InnoDB", dorisOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, out, ") ENGINE=OLAP\nDISTRIBUTED BY RANDOM BUCKETS AUTO")
+	out, err = dorisDDL("CREATE TABLE `t` (\n  `k` text NOT NULL,\n  PRIMARY KEY (`k`(64))\n) ENGINE=InnoDB", dorisOptions{})
+	assert.Nil(t, err)
+	assert.Contains(t, out, "  `k` VARCHAR(65533) NOT NULL,\n")
+	assert.Contains(t, out, "UNIQUE KEY(`k`)\n")
+
+	_, err = dorisDDL("CREATE VIEW `v` AS SELECT 1", dorisOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestDorisSourceDDL(t *testing.T) {
+	ddl := "CREATE TABLE `t` (\n" +
+		"  `id` int(11) NOT NULL COMMENT \"\",\n" +
+		"  `v` varchar(255) REPLACE NULL COMMENT \"\"\n" +
+		") ENGINE=OLAP\n" +
+		"UNIQUE KEY(`id`)\n" +
+		"DISTRIBUTED BY HASH(`id`) BUCKETS 10"
+	want := "CREATE TABLE `t` (\n" +
+		"  `id` int(11) NOT NULL COMMENT \"\",\n" +
+		"  `v` varchar(255) NULL COMMENT \"\",\n" +
+		"  `dbus__action` varchar(8) NULL COMMENT 'change action',\n" +
+		"  `dbus__timestamp` bigint(20) NULL COMMENT 'change unix time'\n" +
+		") ENGINE=OLAP\n" +
+		"UNIQUE KEY(`id`)\n" +
+		"DISTRIBUTED BY HASH(`id`) BUCKETS 10"
+	assert.Equal(t, want, dorisSourceDDL(ddl))
+	// Carried already.
+	assert.Equal(t, want, dorisSourceDDL(want))
+
+	assert.True(t, hasDbusColumns([]string{"`id`", "`dbus__action`", "`dbus__timestamp`"}))
+	assert.False(t, hasDbusColumns([]string{"`dbus__timestamp`"}))
+	assert.False(t, hasDbusColumns([]string{"`id`", "`v`"}))
+}
+
+func TestParseDorisPartition(t *testing.T) {
+	column, unit, err := parseDorisPartition("created_at")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"created_at", "month"}, []string{column, unit})
+	column, unit, err = parseDorisPartition(" at  DAY ")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"at", "day"}, []string{column, unit})
+	for _, v := range []string{"", "at hour", "at day x"} {
+		_, _, err := parseDorisPartition(v)
+		assert.NotNil(t, err, v)
+	}
+}
@@ -10,6 +10,8 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -20,6 +22,7 @@ import (
 	"unicode/utf8"
 
 	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
 	"github.com/xelabs/go-mysqlstack/xlog"
 )
 
@@ -28,9 +31,30 @@ const (
 	DBUS_TS     = "dbus__timestamp"
 )
 
-func writeMetaData(args *Args) {
-	file := fmt.Sprintf("%s/metadata", args.Outdir)
-	WriteFile(file, "")
+// writeDumpFile writes the dump file and records it in the manifest, the checksums are of the stored bytes.
+func writeDumpFile(args *Args, file string, data string, database string, table string, rows uint64) error {
+	stored, err := encodeDumpData(args, data)
+	if err != nil {
+		return err
+	}
+	if err := writeStorageFile(file, stored); err != nil {
+		return err
+	}
+	if args.Manifest != nil {
+		args.Manifest.Add(file, stored, database, table, rows)
+	}
+	return nil
+}
+
+// writeChunkFile writes the table chunk file and accounts it in the metrics.
+func writeChunkFile(args *Args, file string, data string, database string, table string, rows uint64) error {
+	if err := writeDumpFile(args, file, data, database, table, rows); err != nil {
+		return err
+	}
+	metricDumpedBytes.Add(float64(len(data)), database, table)
+	metricDumpedRows.Add(float64(rows), database, table)
+	metricChunksWritten.Add(1, database, table)
+	return nil
 }
 
 func dumpDatabaseSchema(log *xlog.Log, conn *Connection, args *Args, database string) {
@@ -38,8 +62,8 @@ func dumpDatabaseSchema(log *xlog.Log, conn *Connection, args *Args, database st
 	AssertNil(err)
 
 	schema := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`;", database)
-	file := fmt.Sprintf("%s/%s-schema-create.sql", args.Outdir, database)
-	WriteFile(file, schema)
+	file := databaseSchemaFile(args.Outdir, database)
+	AssertNil(writeDumpFile(args, file, schema, database, "", 0))
 	log.Info("dumping.database[%s].schema...", database)
 }
 
@@ -48,20 +72,20 @@ func dumpTableSchema(log *xlog.Log, conn *Connection, args *Args, database strin
 	if err != nil {
 		return err
 	}
-	schema := qr.Rows[0][1].String() + ";\n"
+	schema := qr.Rows[0][1].String()
 
-	// doris模式下，需要特殊处理聚合模式的表
+	// doris模式下，MySQL 表翻译为 Doris 表，Doris 表去掉聚合模式的 REPLACE
 	if args.Mode == "doris" {
-		if strings.Index(schema, "UNIQUE KEY") != -1 {
-			schema = strings.ReplaceAll(schema, "REPLACE", "") // FIXME
-		}
-		if strings.Index(schema, "varchar(255)") != -1 {
-			schema = strings.ReplaceAll(schema, "varchar(255)", "varchar(512)") // 扩容
+		if strings.Contains(schema, "ENGINE=OLAP") {
+			schema = dorisSourceDDL(schema)
+		} else if schema, err = dorisDDL(schema, tableDorisOptions(args, table)); err != nil {
+			return fmt.Errorf("dumping.table[%s.%s].doris.schema.error[%v]", database, table, err)
 		}
 	}
+	schema += ";\n"
 
-	file := fmt.Sprintf("%s/%s.%s-schema.sql", args.Outdir, database, table)
-	if err := WriteFile(file, schema); err != nil {
+	file := tableSchemaFile(args.Outdir, database, table)
+	if err := writeDumpFile(args, file, schema, database, table, 0); err != nil {
 		return err
 	}
 	log.Info("dumping.table[%s.%s].schema...", database, table)
@@ -76,247 +100,438 @@ func fixDatabase(isFixed bool, biz, database string) string {
 	return database
 }
 
-// doris 表导出为csv格式
-func dumpDorisTable(log *xlog.Log, conn *Connection, args *Args, database string, table string) {
-	var allBytes uint64
-	var allRows uint64
-	var where string
-	var extFields []string
-	var isFixed bool
-
-	fields := make([]string, 0, 16)
-	{
-		cursor, err := conn.StreamFetch(fmt.Sprintf("SELECT * FROM `%s`.`%s` LIMIT 1", database, table))
-		AssertNil(err)
-
-		fs := cursor.Fields()
-		for _, f := range fs {
-			log.Debug("dump -- %#v, %s, %s", args.Filters, table, f.Name)
-			if _, ok := args.Filters[table][f.Name]; ok {
-				continue
-			}
+// tableFields returns the names of the dumped columns and their select expressions, the
+// [filter] columns are left out and the [select] ones replaced.
+func tableFields(log *xlog.Log, conn *Connection, args *Args, database string, table string) ([]string, []string, error) {
+	cursor, err := conn.StreamFetch(fmt.Sprintf("SELECT * FROM `%s`.`%s` LIMIT 1", database, table))
+	if err != nil {
+		return nil, nil, err
+	}
 
-			fields = append(fields, fmt.Sprintf("`%s`", f.Name))
-			replacement, ok := args.Selects[table][f.Name]
-			if ok {
-				extFields = append(extFields, fmt.Sprintf("%s AS `%s`", replacement, f.Name))
-			} else {
-				extFields = append(extFields, fmt.Sprintf("`%s`", f.Name))
-			}
+	var names, selects []string
+	for _, f := range cursor.Fields() {
+		log.Debug("dump -- %#v, %s, %s", args.Filters, table, f.Name)
+		if _, ok := args.Filters[table][f.Name]; ok {
+			continue
 		}
 
-		// source db 非 doris, add dbus flag field
-		if fields[len(fields)-1] != DBUS_TS && fields[len(fields)-2] != DBUS_ACTION {
-			isFixed = true
-			fields = append(fields, DBUS_ACTION, DBUS_TS)
+		names = append(names, f.Name)
+		if replacement, ok := args.Selects[table][f.Name]; ok {
+			selects = append(selects, fmt.Sprintf("%s AS `%s`", replacement, f.Name))
+		} else {
+			selects = append(selects, fmt.Sprintf("`%s`", f.Name))
 		}
-		err = cursor.Close()
-		AssertNil(err)
 	}
+	return names, selects, cursor.Close()
+}
 
-	if v, ok := args.Wheres[table]; ok {
-		where = fmt.Sprintf(" WHERE %v", v)
+// quoteFields returns the names quoted.
+func quoteFields(names []string) []string {
+	fields := make([]string, 0, len(names)+2)
+	for _, name := range names {
+		fields = append(fields, fmt.Sprintf("`%s`", name))
 	}
+	return fields
+}
 
-	cursor, err := conn.StreamFetch(fmt.Sprintf("SELECT %s FROM `%s`.`%s` %s", strings.Join(extFields, ", "), database, table, where))
-	AssertNil(err)
+// doris 表导出为csv格式
+// The scan resumes and stops as the one of dumpTable.
+func dumpDorisTable(ctx context.Context, log *xlog.Log, pool *Pool, conn *Connection, args *Args, database string, table string) error {
+	var isFixed bool
+
+	names, extFields, err := tableFields(log, conn, args, database, table)
+	if err != nil {
+		return err
+	}
+	fields := quoteFields(names)
+	where, mark := tableWhere(conn, args, database, table)
+	masks, err := newTableMasks(log, conn, args, database, table, fields, where)
+	if err != nil {
+		return err
+	}
+	s := newTableScan(log, conn, args, database, table, fields)
 
-	fileNo := 1
-	chunkbytes := 0
-	rows := make([]string, 0, 256)
-	inserts := make([]string, 0, 256)
+	// source db 非 doris, add dbus flag field
+	if !hasDbusColumns(fields) {
+		isFixed = true
+		fields = append(fields, DBUS_ACTION, DBUS_TS)
+	}
+	header := strings.Join(fields, ",") // 文件首行是csv头
+	sizes := tableChunking(args, table)
 
 	// fix to doris mode
-	database = fixDatabase(isFixed, args.Biz, database)
+	target := fixDatabase(isFixed, args.Biz, database)
 
-	for cursor.Next() {
-		row, err := cursor.RowValues()
-		AssertNil(err)
+	scan := func() (uint64, uint64, error) {
+		cursor, err := conn.StreamFetch(s.query(extFields, database, table, where))
+		if err != nil {
+			return 0, 0, err
+		}
 
-		values := make([]string, 0, 16)
-		for _, v := range row {
-			if v.Raw() == nil {
-				values = append(values, "\\N") // doris null值特殊处理
-			} else {
-				str := v.String()
-				switch {
-				case v.IsSigned(), v.IsUnsigned(), v.IsFloat(), v.IsIntegral(), v.Type() == querypb.Type_DECIMAL:
-					values = append(values, str)
-				case v.IsTemporal(): // 兼容doris模式下，日期/时间对象不编码为带引号的字符串
-					values = append(values, str)
-				default:
-					val := fmt.Sprintf("%s", EscapeBytes(v.Raw()))
-					val = strings.ReplaceAll(val, "\t", "")
-					val = strings.ReplaceAll(val, "\n", "")
-
-					if !utf8.ValidString(val) {
-						for {
-							if r, sz := utf8.DecodeLastRuneInString(val); r == utf8.RuneError && sz != 0 {
-								val = val[:len(val)-1] // 去掉字符串尾部无效utf8编码 fix for doris 0.11.24
-							} else {
-								break
+		throttleBytes := 0
+		chunkbytes := 0
+		chunkrows := uint64(0)
+		var rowKey []sqltypes.Value
+		rows := make([]string, 0, 256)
+		for cursor.Next() {
+			row, err := cursor.RowValues()
+			if err != nil {
+				return chunkrows, uint64(chunkbytes), err
+			}
+
+			values := make([]string, 0, 16)
+			for _, v := range masks.apply(row, s.allRows) {
+				if v.Raw() == nil {
+					values = append(values, "\\N") // doris null值特殊处理
+				} else {
+					str := v.String()
+					switch {
+					case v.IsSigned(), v.IsUnsigned(), v.IsFloat(), v.IsIntegral(), v.Type() == querypb.Type_DECIMAL:
+						values = append(values, str)
+					case v.IsTemporal(): // 兼容doris模式下，日期/时间对象不编码为带引号的字符串
+						values = append(values, str)
+					default:
+						val := fmt.Sprintf("%s", EscapeBytes(v.Raw()))
+						val = strings.ReplaceAll(val, "\t", "")
+						val = strings.ReplaceAll(val, "\n", "")
+
+						if !utf8.ValidString(val) {
+							for {
+								if r, sz := utf8.DecodeLastRuneInString(val); r == utf8.RuneError && sz != 0 {
+									val = val[:len(val)-1] // 去掉字符串尾部无效utf8编码 fix for doris 0.11.24
+								} else {
+									break
+								}
 							}
 						}
-					}
-					if len(val) <= 512 {
+						// 不截断，Doris 表的 VARCHAR 按源表的 UTF-8 字节长度建表
 						values = append(values, val)
-					} else {
-						rVal := []rune(val)
-						if len(rVal) > 512 {
-							rVal = rVal[:512] // 先按512个字符截取
-						}
-
-						for len(string(rVal)) > 512 {
-							rVal = rVal[:len(rVal)-1] // 按字符缩进
-						}
-						values = append(values, string(rVal))
 					}
 				}
 			}
+			// fix doris schema
+			if isFixed {
+				values = append(values, "R", strconv.Itoa(int(time.Now().Unix())))
+			}
+
+			r := strings.Join(values, "\t") // CSV 格式，\t分隔
+			rows = append(rows, r)
+			rowKey = s.rowKey(row)
+
+			s.allRows++
+			chunkrows++
+			chunkbytes += len(r)
+			s.allBytes += uint64(len(r))
+			atomic.AddUint64(&args.Allbytes, uint64(len(r)))
+			atomic.AddUint64(&args.Allrows, 1)
+
+			throttleBytes += len(r)
+			if s.allRows%throttleBatchRows == 0 {
+				args.Throttle.Limit(throttleBytes, throttleBatchRows)
+				status.progress(conn.ID, throttleBatchRows, throttleBytes)
+				throttleBytes = 0
+				if err := ctx.Err(); err != nil {
+					return chunkrows, uint64(chunkbytes), err
+				}
+			}
+
+			if sizes.chunkFull(chunkrows, chunkbytes) {
+				file := tableDataFile(args.Outdir, target, table, s.fileNo, csvSuffix)
+				if err := writeChunkFile(args, file, header+"\n"+strings.Join(rows, "\n"), target, table, chunkrows); err != nil {
+					return chunkrows, uint64(chunkbytes), err
+				}
+				log.Info("dumping.table[%s.%s].rows[%v].bytes[%vMB].part[%v].thread[%d]", target, table, s.allRows, (s.allBytes / 1024 / 1024), s.fileNo, conn.ID)
+				s.written(file, rowKey)
+				rows = rows[:0]
+				chunkbytes = 0
+				chunkrows = 0
+
+				// The server is overloaded, the scan stops to resume after the pause.
+				if s.paused(args) {
+					return 0, 0, errThrottlePaused
+				}
+			}
 		}
-		// fix doris schema
-		if isFixed {
-			values = append(values, "R", strconv.Itoa(int(time.Now().Unix())))
+		if err := cursor.LastError(); err != nil {
+			return chunkrows, uint64(chunkbytes), err
+		}
+		if len(rows) > 0 {
+			file := tableDataFile(args.Outdir, target, table, s.fileNo, csvSuffix)
+			if err := writeChunkFile(args, file, header+"\n"+strings.Join(rows, "\n"), target, table, chunkrows); err != nil {
+				return chunkrows, uint64(chunkbytes), err
+			}
+			s.written(file, rowKey)
 		}
+		return 0, 0, nil
+	}
+	if err := s.run(ctx, log, pool, conn, args, target, table, scan); err != nil {
+		return err
+	}
 
-		r := strings.Join(values, "\t") // CSV 格式，\t分隔
-		rows = append(rows, r)
+	if mark != nil {
+		args.Metadata.Add(mark)
+	}
 
-		allRows++
-		chunkbytes += len(r)
-		allBytes += uint64(len(r))
-		atomic.AddUint64(&args.Allbytes, uint64(len(r)))
-		atomic.AddUint64(&args.Allrows, 1)
+	log.Info("dumping.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", target, table, s.allRows, (s.allBytes / 1024 / 1024), conn.ID)
+	return nil
+}
 
-		if (chunkbytes / 1024 / 1024) >= args.ChunksizeInMB {
-			inserts = append(inserts, strings.Join(fields, ","), strings.Join(rows, "\n")) // 文件首行是csv头
-			query := strings.Join(inserts, "\n")                                           // 换行
+// parquet 模式，列式文件给数据湖用
+// The scan resumes and stops as the one of dumpTable.
+func dumpParquetTable(ctx context.Context, log *xlog.Log, pool *Pool, conn *Connection, args *Args, database string, table string) error {
+	columns, extFields, err := tableFields(log, conn, args, database, table)
+	if err != nil {
+		return err
+	}
+	where, mark := tableWhere(conn, args, database, table)
+	masks, err := newTableMasks(log, conn, args, database, table, columns, where)
+	if err != nil {
+		return err
+	}
+	s := newTableScan(log, conn, args, database, table, quoteFields(columns))
+	sizes := tableChunking(args, table)
+	rowGroupMB := parquetRowGroupMB
+	if chunkMB := sizes.chunkBytes / 1024 / 1024; chunkMB > 0 && chunkMB < rowGroupMB {
+		rowGroupMB = chunkMB
+	}
+
+	scan := func() (uint64, uint64, error) {
+		cursor, err := conn.StreamFetch(s.query(extFields, database, table, where))
+		if err != nil {
+			return 0, 0, err
+		}
 
-			file := fmt.Sprintf("%s/%s.%s.%05d.csv", args.Outdir, database, table, fileNo)
-			WriteFile(file, query)
+		// The types of the replaced columns come from the data query.
+		fields := cursor.Fields()
+		throttleBytes := 0
+		pendingBytes := uint64(0)
+		var rowKey []sqltypes.Value
+		writer := NewParquetWriter(fields, rowGroupMB*1024*1024)
+		for cursor.Next() {
+			row, err := cursor.RowValues()
+			if err != nil {
+				return uint64(writer.Rows()), pendingBytes, err
+			}
 
-			log.Info("dumping.table[%s.%s].rows[%v].bytes[%vMB].part[%v].thread[%d]", database, table, allRows, (allBytes / 1024 / 1024), fileNo, conn.ID)
-			rows = rows[:0]
-			inserts = inserts[:0] // clear
-			chunkbytes = 0
-			fileNo++
+			n, err := writer.Write(masks.apply(row, s.allRows))
+			if err != nil {
+				return uint64(writer.Rows()), pendingBytes, err
+			}
+			rowKey = s.rowKey(row)
+
+			s.allRows++
+			s.allBytes += uint64(n)
+			pendingBytes += uint64(n)
+			atomic.AddUint64(&args.Allbytes, uint64(n))
+			atomic.AddUint64(&args.Allrows, 1)
+
+			throttleBytes += n
+			if s.allRows%throttleBatchRows == 0 {
+				args.Throttle.Limit(throttleBytes, throttleBatchRows)
+				status.progress(conn.ID, throttleBatchRows, throttleBytes)
+				throttleBytes = 0
+				if err := ctx.Err(); err != nil {
+					return uint64(writer.Rows()), pendingBytes, err
+				}
+			}
+
+			if sizes.chunkFull(uint64(writer.Rows()), writer.Size()) {
+				chunkrows := uint64(writer.Rows())
+				file := tableDataFile(args.Outdir, database, table, s.fileNo, parquetSuffix)
+				if err := writeChunkFile(args, file, string(writer.Bytes()), database, table, chunkrows); err != nil {
+					return chunkrows, pendingBytes, err
+				}
+				log.Info("dumping.table[%s.%s].rows[%v].bytes[%vMB].part[%v].thread[%d]", database, table, s.allRows, (s.allBytes / 1024 / 1024), s.fileNo, conn.ID)
+				s.written(file, rowKey)
+				writer = NewParquetWriter(fields, rowGroupMB*1024*1024)
+				pendingBytes = 0
+
+				// The server is overloaded, the scan stops to resume after the pause.
+				if s.paused(args) {
+					return 0, 0, errThrottlePaused
+				}
+			}
 		}
-	}
-	if chunkbytes > 0 {
-		if len(rows) > 0 {
-			inserts = append(inserts, strings.Join(fields, ","), strings.Join(rows, "\n"))
+		if err := cursor.LastError(); err != nil {
+			return uint64(writer.Rows()), pendingBytes, err
+		}
+		if writer.Rows() > 0 {
+			chunkrows := uint64(writer.Rows())
+			file := tableDataFile(args.Outdir, database, table, s.fileNo, parquetSuffix)
+			if err := writeChunkFile(args, file, string(writer.Bytes()), database, table, chunkrows); err != nil {
+				return chunkrows, pendingBytes, err
+			}
+			s.written(file, rowKey)
 		}
-		query := strings.Join(inserts, "\n")
-		file := fmt.Sprintf("%s/%s.%s.%05d.csv", args.Outdir, database, table, fileNo)
-		WriteFile(file, query)
+		return 0, 0, nil
+	}
+	if err := s.run(ctx, log, pool, conn, args, database, table, scan); err != nil {
+		return err
 	}
-	AssertNil(cursor.Close())
 
-	log.Info("dumping.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", database, table, allRows, (allBytes / 1024 / 1024), conn.ID)
+	if mark != nil {
+		args.Metadata.Add(mark)
+	}
+
+	log.Info("dumping.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", database, table, s.allRows, (s.allBytes / 1024 / 1024), conn.ID)
+	return nil
 }
 
-func dumpTable(log *xlog.Log, conn *Connection, args *Args, database string, table string) {
-	var allBytes uint64
-	var allRows uint64
-	var where string
-	var extFields []string
+// dumpTable dumps the table with INSERT statements. On a transient error the connection is
+// renewed and the scan resumes after the primary key of the last written chunk, the chunks
+// go on with the next number. The tables without a usable key are dumped again from scratch.
+// Once the context is done the scan stops, the rows not written to a chunk are discarded.
+func dumpTable(ctx context.Context, log *xlog.Log, pool *Pool, conn *Connection, args *Args, database string, table string) error {
+	names, extFields, err := tableFields(log, conn, args, database, table)
+	if err != nil {
+		return err
+	}
+	fields := quoteFields(names)
+	where, mark := tableWhere(conn, args, database, table)
+	masks, err := newTableMasks(log, conn, args, database, table, fields, where)
+	if err != nil {
+		return err
+	}
 
-	fields := make([]string, 0, 16)
-	{
-		cursor, err := conn.StreamFetch(fmt.Sprintf("SELECT * FROM `%s`.`%s` LIMIT 1", database, table))
-		AssertNil(err)
+	// The scan is ordered by the key to resume from the last written one.
+	s := newTableScan(log, conn, args, database, table, fields)
+	sizes := tableChunking(args, table)
+	header := fmt.Sprintf("INSERT INTO `%s`(%s) VALUES\n", table, strings.Join(fields, ","))
+	oversized := false
+
+	// scan dumps the rows after the last key, the rows not written to a chunk yet are
+	// lost on error and returned to be taken off the counters.
+	scan := func() (uint64, uint64, error) {
+		cursor, err := conn.StreamFetch(s.query(extFields, database, table, where))
+		if err != nil {
+			return 0, 0, err
+		}
 
-		fs := cursor.Fields()
-		for _, f := range fs {
-			log.Debug("dump -- %#v, %s, %s", args.Filters, table, f.Name)
-			if _, ok := args.Filters[table][f.Name]; ok {
-				continue
+		throttleBytes := 0
+		stmtsize := 0
+		chunkbytes := 0
+		pendingBytes := uint64(0)
+		stmtrows := uint64(0)
+		chunkrows := uint64(0)
+		var rowKey, stmtKey []sqltypes.Value
+		rows := make([]string, 0, 256)
+		inserts := make([]string, 0, 256)
+
+		// flush ends the statement of the pending rows, it's written with the chunk.
+		flush := func() {
+			inserts = append(inserts, header+strings.Join(rows, ",\n"))
+			rows = rows[:0]
+			chunkrows += stmtrows
+			stmtrows = 0
+			stmtsize = 0
+			stmtKey = rowKey
+		}
+		for cursor.Next() {
+			row, err := cursor.RowValues()
+			if err != nil {
+				return stmtrows + chunkrows, pendingBytes, err
 			}
 
-			fields = append(fields, fmt.Sprintf("`%s`", f.Name))
-			replacement, ok := args.Selects[table][f.Name]
-			if ok {
-				extFields = append(extFields, fmt.Sprintf("%s AS `%s`", replacement, f.Name))
-			} else {
-				extFields = append(extFields, fmt.Sprintf("`%s`", f.Name))
+			values := make([]string, 0, 16)
+			for _, v := range masks.apply(row, s.allRows) {
+				if v.Raw() == nil {
+					values = append(values, "NULL")
+				} else {
+					str := v.String()
+					switch {
+					case v.IsSigned(), v.IsUnsigned(), v.IsFloat(), v.IsIntegral(), v.Type() == querypb.Type_DECIMAL:
+						values = append(values, str)
+					default:
+						values = append(values, fmt.Sprintf("\"%s\"", EscapeBytes(v.Raw())))
+					}
+				}
 			}
-		}
-		err = cursor.Close()
-		AssertNil(err)
-	}
+			r := "(" + strings.Join(values, ",") + ")"
 
-	if v, ok := args.Wheres[table]; ok {
-		where = fmt.Sprintf(" WHERE %v", v)
-	}
+			// The statement stays under the packet of the target, the row starts the next one.
+			if sizes.maxStmt > 0 {
+				if len(rows) > 0 && len(header)+stmtsize+2*len(rows)+len(r) > sizes.maxStmt {
+					flush()
+				}
+				if len(header)+len(r) > sizes.maxStmt && !oversized {
+					log.Warning("dumping.table[%s.%s].row.bytes[%d].over.max_allowed_packet[%d].the.restore.will.fail", database, table, len(r), args.MaxAllowedPacket)
+					oversized = true
+				}
+			}
+			rowKey = s.rowKey(row)
+			rows = append(rows, r)
+
+			s.allRows++
+			stmtrows++
+			stmtsize += len(r)
+			chunkbytes += len(r)
+			pendingBytes += uint64(len(r))
+			s.allBytes += uint64(len(r))
+			atomic.AddUint64(&args.Allbytes, uint64(len(r)))
+			atomic.AddUint64(&args.Allrows, 1)
+
+			throttleBytes += len(r)
+			if s.allRows%throttleBatchRows == 0 {
+				args.Throttle.Limit(throttleBytes, throttleBatchRows)
+				status.progress(conn.ID, throttleBatchRows, throttleBytes)
+				throttleBytes = 0
+				if err := ctx.Err(); err != nil {
+					return stmtrows + chunkrows, pendingBytes, err
+				}
+			}
 
-	cursor, err := conn.StreamFetch(fmt.Sprintf("SELECT %s FROM `%s`.`%s` %s", strings.Join(extFields, ", "), database, table, where))
-	AssertNil(err)
+			// A full chunk ends its statement, so no row is left over to the next chunk.
+			chunkFull := sizes.chunkFull(chunkrows+stmtrows, chunkbytes)
+			if stmtsize >= sizes.stmtSize || chunkFull {
+				flush()
+			}
+			if chunkFull {
+				query := strings.Join(inserts, ";\n") + ";\n"
+				file := tableDataFile(args.Outdir, database, table, s.fileNo, tableSuffix)
+				if err := writeChunkFile(args, file, query, database, table, chunkrows); err != nil {
+					return chunkrows, pendingBytes, err
+				}
 
-	fileNo := 1
-	stmtsize := 0
-	chunkbytes := 0
-	rows := make([]string, 0, 256)
-	inserts := make([]string, 0, 256)
-	for cursor.Next() {
-		row, err := cursor.RowValues()
-		AssertNil(err)
+				log.Info("dumping.table[%s.%s].rows[%v].bytes[%vMB].part[%v].thread[%d]", database, table, s.allRows, (s.allBytes / 1024 / 1024), s.fileNo, conn.ID)
+				s.written(file, stmtKey)
+				inserts = inserts[:0]
+				pendingBytes = 0
+				chunkbytes = 0
+				chunkrows = 0
 
-		values := make([]string, 0, 16)
-		for _, v := range row {
-			if v.Raw() == nil {
-				values = append(values, "NULL")
-			} else {
-				str := v.String()
-				switch {
-				case v.IsSigned(), v.IsUnsigned(), v.IsFloat(), v.IsIntegral(), v.Type() == querypb.Type_DECIMAL:
-					values = append(values, str)
-				default:
-					values = append(values, fmt.Sprintf("\"%s\"", EscapeBytes(v.Raw())))
+				// The server is overloaded, the scan stops to resume after the pause.
+				if s.paused(args) {
+					return 0, 0, errThrottlePaused
 				}
 			}
 		}
-		r := "(" + strings.Join(values, ",") + ")"
-		rows = append(rows, r)
-
-		allRows++
-		stmtsize += len(r)
-		chunkbytes += len(r)
-		allBytes += uint64(len(r))
-		atomic.AddUint64(&args.Allbytes, uint64(len(r)))
-		atomic.AddUint64(&args.Allrows, 1)
-
-		if stmtsize >= args.StmtSize {
-			insertone := fmt.Sprintf("INSERT INTO `%s`(%s) VALUES\n%s", table, strings.Join(fields, ","), strings.Join(rows, ",\n"))
-			inserts = append(inserts, insertone)
-			rows = rows[:0]
-			stmtsize = 0
+		if err := cursor.LastError(); err != nil {
+			return stmtrows + chunkrows, pendingBytes, err
 		}
+		if chunkbytes > 0 {
+			if len(rows) > 0 {
+				flush()
+			}
 
-		if (chunkbytes / 1024 / 1024) >= args.ChunksizeInMB {
 			query := strings.Join(inserts, ";\n") + ";\n"
-			file := fmt.Sprintf("%s/%s.%s.%05d.sql", args.Outdir, database, table, fileNo)
-			WriteFile(file, query)
-
-			log.Info("dumping.table[%s.%s].rows[%v].bytes[%vMB].part[%v].thread[%d]", database, table, allRows, (allBytes / 1024 / 1024), fileNo, conn.ID)
-			inserts = inserts[:0]
-			chunkbytes = 0
-			fileNo++
+			file := tableDataFile(args.Outdir, database, table, s.fileNo, tableSuffix)
+			if err := writeChunkFile(args, file, query, database, table, chunkrows); err != nil {
+				return chunkrows, pendingBytes, err
+			}
+			s.written(file, stmtKey)
 		}
+		return 0, 0, nil
+	}
+	if err := s.run(ctx, log, pool, conn, args, database, table, scan); err != nil {
+		return err
 	}
-	if chunkbytes > 0 {
-		if len(rows) > 0 {
-			insertone := fmt.Sprintf("INSERT INTO `%s`(%s) VALUES\n%s", table, strings.Join(fields, ","), strings.Join(rows, ",\n"))
-			inserts = append(inserts, insertone)
-		}
 
-		query := strings.Join(inserts, ";\n") + ";\n"
-		file := fmt.Sprintf("%s/%s.%s.%05d.sql", args.Outdir, database, table, fileNo)
-		WriteFile(file, query)
+	if mark != nil {
+		args.Metadata.Add(mark)
 	}
-	err = cursor.Close()
-	AssertNil(err)
 
-	log.Info("dumping.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", database, table, allRows, (allBytes / 1024 / 1024), conn.ID)
+	log.Info("dumping.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", database, table, s.allRows, (s.allBytes / 1024 / 1024), conn.ID)
+	return nil
 }
 
 func allTables(log *xlog.Log, conn *Connection, database string) []string {
@@ -367,47 +582,110 @@ func filterDorisTable(log *xlog.Log, conn *Connection, database string, tables [
 	return tbs
 }
 
+// dumpDatabases returns the databases to dump, by the regexp or the list of the args, or all.
+func dumpDatabases(log *xlog.Log, conn *Connection, args *Args) []string {
+	if args.DatabaseRegexp != "" {
+		r := regexp.MustCompile(args.DatabaseRegexp)
+		return filterDatabases(log, conn, r, args.DatabaseInvertRegexp)
+	}
+	if args.Database != "" {
+		return strings.Split(args.Database, ",")
+	}
+	return allDatabases(log, conn)
+}
+
+// dumpTables returns the tables of the database to dump, by the list of the args or all.
+func dumpTables(log *xlog.Log, conn *Connection, args *Args, database string) []string {
+	var tables []string
+	if args.Table != "" {
+		tables = strings.Split(args.Table, ",")
+	} else {
+		tables = allTables(log, conn, database)
+	}
+
+	// doris 模式下，需要过滤掉特殊表，只dump doris 引擎的表
+	if args.Mode == "doris" {
+		tables = filterDorisTable(log, conn, database, tables)
+	}
+	return tables
+}
+
 // Dumper used to start the dumper worker.
-func Dumper(log *xlog.Log, args *Args) {
-	pool, err := NewPool(log, args.Threads, args.Address, args.User, args.Password, args.SessionVars)
+// Once the context is done no new table is started and the scans stop at the next rows batch,
+// the manifest lists the chunks written whole and the metadata the tables not dumped whole.
+// It returns the context error if interrupted.
+func Dumper(ctx context.Context, log *xlog.Log, args *Args) error {
+	// The files would be written to the root.
+	if args.Outdir == "" {
+		return errors.New("dumping.outdir.is.empty")
+	}
+
+	// One spare connection to poll the source load.
+	spare := 0
+	if adaptiveThrottle(args) {
+		spare = 1
+	}
+	pool, err := NewPool(log, args.Threads+spare, args.Address, args.User, args.Password, args.SessionVars, args.TLS)
 	AssertNil(err)
 	defer pool.Close()
 
+	args.Throttle = NewThrottle(log, args)
+	args.Throttle.Start(pool)
+	defer args.Throttle.Stop()
+
 	// Meta data.
-	writeMetaData(args)
+	args.Metadata = NewMetadata()
+	if args.Cipher == nil {
+		args.Cipher, err = LoadCipher(args.EncryptionKeyFile)
+		AssertNil(err)
+	}
+	if args.Cipher != nil {
+		args.Metadata.Encryption = encryptionName
+		args.Metadata.KeyID = args.Cipher.ID()
+	}
+	if args.Compress {
+		args.Metadata.Compression = "gzip"
+	}
+	if len(args.Incrementals) > 0 {
+		AssertNil(prepareIncremental(args))
+		log.Info("dumping.incremental.to[%s].previous[%s]...", args.Outdir, args.Metadata.Previous)
+	}
+	AssertNil(args.Metadata.Write(args.Outdir))
+	args.Manifest = NewManifest()
 
 	// database.
 	var wg sync.WaitGroup
-	conn := pool.Get()
-	var databases []string
+	conn, err := pool.Get()
+	AssertNil(err)
 	t := time.Now()
-
-	if args.DatabaseRegexp != "" {
-		r := regexp.MustCompile(args.DatabaseRegexp)
-		databases = filterDatabases(log, conn, r, args.DatabaseInvertRegexp)
-	} else {
-		if args.Database != "" {
-			databases = strings.Split(args.Database, ",")
-		} else {
-			databases = allDatabases(log, conn)
+	databases := dumpDatabases(log, conn, args)
+	AssertNil(checkTableOptions(log, conn, args, databases))
+	AssertNil(prepareSamples(log, conn, args, databases))
+	if args.Mode != "doris" && args.Mode != "parquet" {
+		if args.MaxAllowedPacket == 0 {
+			args.MaxAllowedPacket = sourcePacket(log, conn)
 		}
+		args.Metadata.MaxAllowedPacket = args.MaxAllowedPacket
 	}
+
+	SetPhase("dumping.schema")
 	for _, database := range databases {
 		dumpDatabaseSchema(log, conn, args, database)
 	}
 
 	// tables.
-	tables := make([][]string, len(databases))
-	for i, database := range databases {
-		if args.Table != "" {
-			tables[i] = strings.Split(args.Table, ",")
-		} else {
-			tables[i] = allTables(log, conn, database)
+	var tasks []*task
+	for _, database := range databases {
+		sizes, err := tableEstimates(conn, database)
+		if err != nil {
+			log.Warning("dumping.database[%s].table.sizes.error[%v].in.listed.order", database, err)
 		}
-
-		// doris 模式下，需要过滤掉特殊表，只dump doris 引擎的表
-		if args.Mode == "doris" {
-			tables[i] = filterDorisTable(log, conn, database, tables[i])
+		for _, table := range dumpTables(log, conn, args, database) {
+			t := &task{database: database, table: table}
+			if size, ok := sizes[table]; ok {
+				t.size = size.Bytes
+			}
+			tasks = append(tasks, t)
 		}
 	}
 	pool.Put(conn)
@@ -424,38 +702,91 @@ func Dumper(log *xlog.Log, args *Args) {
 		}
 	}()
 
-	for i, database := range databases {
-		for _, table := range tables[i] {
-			conn := pool.Get()
-			wg.Add(1)
-
-			go func(conn *Connection, database string, table string) {
-				defer func() {
-					if err := recover(); err != nil {
-						// 线程奔溃，先记录到错误日志，再手动分析
-						log.Error("dumping.table[%s.%s] error:%v", database, table, err)
-					}
-					wg.Done()
-					pool.Put(conn)
-				}()
-
-				if err := dumpTableSchema(log, conn, args, database, table); err != nil {
-					log.Error("dumping.table.schema[%s.%s] error:%v", database, table, err)
-					return
+	// The largest tables first, one thread per table.
+	SetPhase("dumping.data")
+	sched := newScheduler(tasks, 0, args.MaxThreadsPerDatabase)
+	for {
+		t := sched.next(ctx)
+		if t == nil {
+			break
+		}
+		conn := getConn(ctx, pool)
+		if conn == nil {
+			args.Metadata.AddUnfinished(t.database, t.table)
+			break
+		}
+		wg.Add(1)
+
+		go func(conn *Connection, t *task) {
+			database, table := t.database, t.table
+			status.begin(conn.ID, fmt.Sprintf("dumping.table[%s.%s]", database, table))
+			defer func() {
+				if err := recover(); err != nil {
+					// 线程奔溃，先记录到错误日志，再手动分析
+					log.Error("dumping.table[%s.%s] error:%v", database, table, err)
+					args.Metadata.AddUnfinished(database, table)
 				}
+				status.end(conn.ID)
+				sched.done(t)
+				wg.Done()
+				pool.Put(conn)
+			}()
+
+			if err := dumpTableSchema(log, conn, args, database, table); err != nil {
+				log.Error("dumping.table.schema[%s.%s] error:%v", database, table, err)
+				args.Metadata.AddUnfinished(database, table)
+				return
+			}
 
-				log.Info("dumping.table[%s.%s].datas.thread[%d]...", database, table, conn.ID)
-				if args.Mode == "doris" {
-					dumpDorisTable(log, conn, args, database, table)
-				} else {
-					dumpTable(log, conn, args, database, table)
+			log.Info("dumping.table[%s.%s].datas.thread[%d]...", database, table, conn.ID)
+			dump := dumpTable
+			switch args.Mode {
+			case "doris":
+				dump = dumpDorisTable
+			case "parquet":
+				dump = dumpParquetTable
+			}
+			if err := dump(ctx, log, pool, conn, args, database, table); err != nil {
+				if ctx.Err() == nil {
+					log.Error("dumping.table[%s.%s].error[%v]", database, table, err)
 				}
-				log.Info("dumping.table[%s.%s].datas.thread[%d].done...", database, table, conn.ID)
-			}(conn, database, table)
-		}
+				args.Metadata.AddUnfinished(database, table)
+				return
+			}
+			log.Info("dumping.table[%s.%s].datas.thread[%d].done...", database, table, conn.ID)
+		}(conn, t)
+	}
+	for _, t := range sched.remaining() {
+		args.Metadata.AddUnfinished(t.database, t.table)
 	}
 
 	wg.Wait()
+	if err := args.Manifest.Write(args.Outdir); err != nil {
+		log.Error("dumping.manifest.error:%v", err)
+	}
+	carryHighWaterMarks(args)
+	switch {
+	case ctx.Err() != nil:
+		// Not finished, the next incremental run doesn't start from it.
+		args.Metadata.Interrupted = true
+	case len(args.Metadata.Unfinished) == 0:
+		args.Metadata.Finished = time.Now().Format("2006-01-02 15:04:05")
+	}
+	if err := args.Metadata.Write(args.Outdir); err != nil {
+		log.Error("dumping.metadata.error:%v", err)
+	}
 	elapsed := time.Since(t).Seconds()
+	if ctx.Err() != nil {
+		SetPhase("dumping.interrupted")
+		log.Warning("dumping.interrupted.cost[%.2fsec].allrows[%v].allbytes[%v].unfinished.tables%v", elapsed, args.Allrows, args.Allbytes, args.Metadata.Unfinished)
+		return ctx.Err()
+	}
+	if len(args.Metadata.Unfinished) > 0 {
+		SetPhase("dumping.failed")
+		log.Error("dumping.failed.cost[%.2fsec].allrows[%v].allbytes[%v].unfinished.tables%v", elapsed, args.Allrows, args.Allbytes, args.Metadata.Unfinished)
+		return fmt.Errorf("dumping.unfinished.tables%v", args.Metadata.Unfinished)
+	}
+	SetPhase("dumping.done")
 	log.Info("dumping.all.done.cost[%.2fsec].allrows[%v].allbytes[%v].rate[%.2fMB/s]", elapsed, args.Allrows, args.Allbytes, (float64(args.Allbytes/1024/1024) / elapsed))
+	return nil
 }
@@ -10,13 +10,22 @@
 package common
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/xelabs/go-mysqlstack/driver"
+	"github.com/xelabs/go-mysqlstack/sqldb"
 	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
 	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
 	"github.com/xelabs/go-mysqlstack/xlog"
@@ -135,7 +144,8 @@ func TestDumper(t *testing.T) {
 
 	// Dumper.
 	{
-		Dumper(log, args)
+		assert.NotNil(t, Dumper(context.Background(), log, &Args{Address: address, User: "mock", Password: "mock"}))
+		assert.Nil(t, Dumper(context.Background(), log, args))
 	}
 	dat, err := ioutil.ReadFile(args.Outdir + "/test.t1-05-11.00001.sql")
 	assert.Nil(t, err)
@@ -289,7 +299,7 @@ func TestDumperAll(t *testing.T) {
 
 	// Dumper.
 	{
-		Dumper(log, args)
+		assert.Nil(t, Dumper(context.Background(), log, args))
 	}
 	dat_test1, err_test1 := ioutil.ReadFile(args.Outdir + "/test1.t1-05-11.00001.sql")
 	assert.Nil(t, err_test1)
@@ -448,7 +458,7 @@ func TestDumperMultiple(t *testing.T) {
 
 	// Dumper.
 	{
-		Dumper(log, args)
+		assert.Nil(t, Dumper(context.Background(), log, args))
 	}
 	dat_test1, err_test1 := ioutil.ReadFile(args.Outdir + "/test1.t1-05-11.00001.sql")
 	assert.Nil(t, err_test1)
@@ -616,7 +626,7 @@ func TestDumperSimpleRegexp(t *testing.T) {
 
 	// Dumper.
 	{
-		Dumper(log, args)
+		assert.Nil(t, Dumper(context.Background(), log, args))
 	}
 	dat_test1, err_test1 := ioutil.ReadFile(args.Outdir + "/test1.t1-05-11.00001.sql")
 	assert.Nil(t, err_test1)
@@ -784,7 +794,7 @@ func TestDumperComplexRegexp(t *testing.T) {
 
 	// Dumper.
 	{
-		Dumper(log, args)
+		assert.Nil(t, Dumper(context.Background(), log, args))
 	}
 	dat_test1, err_test1 := ioutil.ReadFile(args.Outdir + "/test1.t1-05-11.00001.sql")
 	assert.Nil(t, err_test1)
@@ -956,7 +966,7 @@ func TestDumperInvertMatch(t *testing.T) {
 
 	// Dumper.
 	{
-		Dumper(log, args)
+		assert.Nil(t, Dumper(context.Background(), log, args))
 	}
 	dat_test1, err_test1 := ioutil.ReadFile(args.Outdir + "/test1.t1-05-11.00001.sql")
 	assert.Nil(t, err_test1)
@@ -967,3 +977,574 @@ func TestDumperInvertMatch(t *testing.T) {
 	want_test2 := strings.Contains(string(dat_test2), `(1337)`)
 	assert.True(t, want_test2)
 }
+
+func TestDumperIncremental(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "id",
+				Type: querypb.Type_INT32,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_INT32, []byte("7")),
+			},
+		}}
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`id` int(11) NOT NULL) ENGINE=InnoDB")),
+			},
+		}}
+	maxResult := func(v string) *sqltypes.Result {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{
+				{
+					Name: "MAX(`id`)",
+					Type: querypb.Type_INT32,
+				},
+			},
+			Rows: [][]sqltypes.Value{
+				{
+					sqltypes.MakeTrusted(querypb.Type_INT32, []byte(v)),
+				},
+			}}
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQuery("SELECT MAX(`id`) FROM `test`.`t1`", maxResult("100"))
+		fakedbs.AddQueryPattern("show tables from .*", columnResult("Tables_in_test", "t1"))
+		fakedbs.AddQueryPattern("show columns from .*", columnResult("Field", "id"))
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	base := "/tmp/dumpertest-incremental"
+	os.RemoveAll(base)
+	defer os.RemoveAll(base)
+	newArgs := func() *Args {
+		return &Args{
+			Database:      "test",
+			Table:         "t1",
+			Outdir:        base,
+			User:          "mock",
+			Password:      "mock",
+			Address:       address,
+			ChunksizeInMB: 1,
+			Threads:       2,
+			StmtSize:      10000,
+			IntervalMs:    500,
+			Wheres:        map[string]string{"t1": "id > 0"},
+			Incrementals:  map[string]string{"t1": "id"},
+		}
+	}
+
+	// First run dumps up to the current max.
+	first := newArgs()
+	assert.Nil(t, Dumper(context.Background(), log, first))
+	assert.NotEqual(t, base, first.Outdir)
+	meta, err := ReadMetadata(first.Outdir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", meta.Finished)
+	assert.Equal(t, []*HighWaterMark{{Database: "test", Table: "t1", Column: "id", To: "100"}}, meta.HighWaterMarks)
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("SELECT MAX(`id`) FROM `test`.`t1`"))
+
+	// Second run only dumps the newer rows, into a new directory.
+	fakedbs.AddQuery("SELECT MAX(`id`) FROM `test`.`t1`", maxResult("250"))
+	next := "SELECT `id` FROM `test`.`t1`  WHERE (id > 0) AND `id` > \"100\" AND `id` <= \"250\""
+	fakedbs.AddQuery(next, selectResult)
+	second := newArgs()
+	assert.Nil(t, Dumper(context.Background(), log, second))
+	assert.NotEqual(t, first.Outdir, second.Outdir)
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum(next))
+	meta, err = ReadMetadata(second.Outdir)
+	assert.Nil(t, err)
+	assert.Equal(t, first.Outdir, meta.Previous)
+	assert.Equal(t, []*HighWaterMark{{Database: "test", Table: "t1", Column: "id", From: "100", To: "250"}}, meta.HighWaterMarks)
+}
+
+// resumeTest dumps the table t1 in the mode through the proxy cutting the connections mid-scan,
+// it returns the ids of the chunk files in order.
+func resumeTest(t *testing.T, outdir string, mode string, withKey bool) (*driver.TestHandler, *Args, []int) {
+	defer fastPool(3)()
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	proxy := newTestProxy(t, server.Addr())
+	defer proxy.Close()
+
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+	}
+	selectResult := &sqltypes.Result{Fields: fields}
+	for i := 1; i <= 60000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(strings.Repeat("x", 60))),
+		})
+	}
+	// The mock can't run the keyset query, the resumed rows are the markers.
+	resumeResult := &sqltypes.Result{Fields: fields}
+	for i := 100001; i <= 100010; i++ {
+		resumeResult.Rows = append(resumeResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("resumed")),
+		})
+	}
+	keysResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Column_name", Type: querypb.Type_VARCHAR}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("id"))}},
+	}
+
+	// fakedbs.
+	{
+		if withKey {
+			fakedbs.AddQueryPattern("show keys from .*", keysResult)
+		}
+		fakedbs.AddQueryPattern("select \\* from .* limit 1", &sqltypes.Result{Fields: fields})
+		fakedbs.AddQueryPattern("select .* where .*`id` > .*", resumeResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	args := &Args{
+		Outdir:        outdir,
+		ChunksizeInMB: 1,
+		StmtSize:      10000,
+		Manifest:      NewManifest(),
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+
+	pool, err := NewPool(log, 1, proxy.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	defer pool.Put(conn)
+
+	dump, database, suffix := dumpTable, "test", tableSuffix
+	switch mode {
+	case "doris":
+		dump, database, suffix = dumpDorisTable, fixDatabase(true, "", "test"), csvSuffix
+	case "parquet":
+		dump, suffix = dumpParquetTable, parquetSuffix
+	}
+	proxy.cutAfter(2 * 1024 * 1024)
+	assert.Nil(t, dump(context.Background(), log, pool, conn, args, "test", "t1"))
+	assert.Equal(t, 2, proxy.getAccepted())
+
+	var ids []int
+	re := regexp.MustCompile(`\((\d+),`)
+	for part := 1; ; part++ {
+		dat, err := ioutil.ReadFile(tableDataFile(args.Outdir, database, "t1", part, suffix))
+		if os.IsNotExist(err) {
+			break
+		}
+		assert.Nil(t, err)
+		switch mode {
+		case "doris":
+			for _, line := range strings.Split(string(dat), "\n")[1:] {
+				id, _ := strconv.Atoi(strings.Split(line, "\t")[0])
+				ids = append(ids, id)
+			}
+		case "parquet":
+			for _, v := range readParquetColumn(t, dat, readParquetFooter(t, dat), 0) {
+				ids = append(ids, int(binary.LittleEndian.Uint32(v)))
+			}
+		default:
+			for _, m := range re.FindAllStringSubmatch(string(dat), -1) {
+				id, _ := strconv.Atoi(m[1])
+				ids = append(ids, id)
+			}
+		}
+	}
+	return fakedbs, args, ids
+}
+
+func TestDumperResume(t *testing.T) {
+	for _, mode := range []string{"", "doris", "parquet"} {
+		fakedbs, args, ids := resumeTest(t, "/tmp/dumpertest.resume", mode, true)
+
+		// The written rows, then the resumed ones after the last of them.
+		last := 0
+		for last < len(ids) && ids[last] == last+1 {
+			last++
+		}
+		assert.True(t, last > 0 && last < 60000, mode)
+		assert.Equal(t, 10, len(ids)-last, mode)
+		for i, id := range ids[last:] {
+			assert.Equal(t, 100001+i, id, mode)
+		}
+		query := fmt.Sprintf("SELECT `id`, `name` FROM `test`.`t1`  WHERE (`id` > %d) ORDER BY `id`", last)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum(query), mode)
+
+		var rows uint64
+		for _, e := range args.Manifest.Files {
+			rows += e.Rows
+		}
+		assert.Equal(t, uint64(len(ids)), rows, mode)
+		assert.Equal(t, uint64(len(ids)), args.Allrows, mode)
+	}
+}
+
+func TestDumperRetryNoKey(t *testing.T) {
+	for _, mode := range []string{"", "doris", "parquet"} {
+		_, args, ids := resumeTest(t, "/tmp/dumpertest.retry", mode, false)
+
+		// Dumped again from scratch.
+		assert.Equal(t, 60000, len(ids), mode)
+		for i, id := range ids {
+			if id != i+1 {
+				assert.Equal(t, i+1, id, mode)
+				break
+			}
+		}
+		var rows uint64
+		for _, e := range args.Manifest.Files {
+			rows += e.Rows
+		}
+		assert.Equal(t, uint64(60000), rows, mode)
+		assert.Equal(t, uint64(60000), args.Allrows, mode)
+	}
+}
+
+func TestDumperThrottlePause(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+	}
+	selectResult := &sqltypes.Result{Fields: fields}
+	for i := 1; i <= 60000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(strings.Repeat("x", 60))),
+		})
+	}
+	// The mock can't run the keyset query, the resumed rows are the markers.
+	resumeResult := &sqltypes.Result{Fields: fields}
+	for i := 100001; i <= 100010; i++ {
+		resumeResult.Rows = append(resumeResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("resumed")),
+		})
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("show keys from .*", columnResult("Column_name", "id"))
+		fakedbs.AddQueryPattern("select \\* from .* limit 1", &sqltypes.Result{Fields: fields})
+		fakedbs.AddQueryPattern("select .* where .*`id` > .*", resumeResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	// About 1MB a second, the first chunk at once.
+	throttle := &Throttle{log: log, bytes: NewRateLimiter(1024 * 1024), done: make(chan struct{})}
+	throttle.cond = sync.NewCond(&throttle.mu)
+	args := &Args{
+		Outdir:        "/tmp/dumpertest.throttle",
+		ChunksizeInMB: 1,
+		StmtSize:      10000,
+		Manifest:      NewManifest(),
+		Throttle:      throttle,
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	defer pool.Put(conn)
+
+	// Overloaded once the first chunk is written, past the end of the next one.
+	go func() {
+		for {
+			if _, err := os.Stat(tableDataFile(args.Outdir, "test", "t1", 1, tableSuffix)); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		throttle.setPaused(true)
+		time.Sleep(1500 * time.Millisecond)
+		throttle.setPaused(false)
+	}()
+	assert.Nil(t, dumpTable(context.Background(), log, pool, conn, args, "test", "t1"))
+
+	// The scan stopped at a chunk end and resumed after its last key.
+	var ids []int
+	re := regexp.MustCompile(`\((\d+),`)
+	for part := 1; ; part++ {
+		dat, err := ioutil.ReadFile(tableDataFile(args.Outdir, "test", "t1", part, tableSuffix))
+		if os.IsNotExist(err) {
+			break
+		}
+		assert.Nil(t, err)
+		for _, m := range re.FindAllStringSubmatch(string(dat), -1) {
+			id, _ := strconv.Atoi(m[1])
+			ids = append(ids, id)
+		}
+	}
+	last := 0
+	for last < len(ids) && ids[last] == last+1 {
+		last++
+	}
+	assert.True(t, last > 0 && last < 60000)
+	assert.Equal(t, 10, len(ids)-last)
+	query := fmt.Sprintf("SELECT `id`, `name` FROM `test`.`t1`  WHERE (`id` > %d) ORDER BY `id`", last)
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum(query))
+	assert.Equal(t, uint64(len(ids)), args.Allrows)
+}
+
+// countdownContext is canceled once its Err is called n times.
+type countdownContext struct {
+	context.Context
+	n int32
+}
+
+func (c *countdownContext) Err() error {
+	if atomic.AddInt32(&c.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDumperInterrupt(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+	}
+	selectResult := &sqltypes.Result{Fields: fields}
+	for i := 1; i <= 60000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(strings.Repeat("x", 60))),
+		})
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("select \\* from .* limit 1", &sqltypes.Result{Fields: fields})
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	args := &Args{
+		Database:      "test",
+		Table:         "t1,t2",
+		Outdir:        "/tmp/dumpertest.interrupt",
+		User:          "mock",
+		Password:      "mock",
+		Address:       server.Addr(),
+		ChunksizeInMB: 1,
+		Threads:       2,
+		StmtSize:      10000,
+		IntervalMs:    500,
+		Manifest:      NewManifest(),
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+
+	// Canceled mid-scan: the whole chunks are kept, the rest is discarded.
+	{
+		pool, err := NewPool(log, 1, args.Address, "mock", "mock", "", nil)
+		assert.Nil(t, err)
+		conn, err := pool.Get()
+		assert.Nil(t, err)
+		ctx := &countdownContext{Context: context.Background(), n: 100}
+		assert.Equal(t, context.Canceled, dumpTable(ctx, log, pool, conn, args, "test", "t1"))
+		pool.Put(conn)
+		pool.Close()
+
+		_, err = os.Stat(tableDataFile(args.Outdir, "test", "t1", 1, tableSuffix))
+		assert.Nil(t, err)
+		_, err = os.Stat(tableDataFile(args.Outdir, "test", "t1", 2, tableSuffix))
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, 1, len(args.Manifest.Files))
+		assert.Equal(t, args.Manifest.Files[0].Rows, args.Allrows)
+	}
+
+	// Canceled before the tables: none is dumped, the metadata records them.
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		os.RemoveAll(args.Outdir)
+		AssertNil(os.MkdirAll(args.Outdir, 0777))
+		assert.Equal(t, context.Canceled, Dumper(ctx, log, args))
+
+		m, err := ReadMetadata(args.Outdir)
+		assert.Nil(t, err)
+		assert.True(t, m.Interrupted)
+		assert.Equal(t, "", m.Finished)
+		assert.Equal(t, []string{"test.t1", "test.t2"}, m.Unfinished)
+
+		loadArgs := &Args{Outdir: args.Outdir}
+		assert.Panics(t, func() { checkDumpFinished(log, loadArgs) })
+		loadArgs.AllowUnfinished = true
+		checkDumpFinished(log, loadArgs)
+	}
+}
+
+func TestDumperTableError(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+	}
+	selectResult := &sqltypes.Result{
+		Fields: fields,
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1"))}},
+	}
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Table", Type: querypb.Type_VARCHAR},
+			{Name: "Create Table", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t` (`id` int(11)) ENGINE=InnoDB")),
+		}},
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("select \\* from .* limit 1", &sqltypes.Result{Fields: fields})
+		// Not transient, no retry.
+		fakedbs.AddQueryErrorPattern("select .* from `test`.`t2`.*", sqldb.NewSQLError(sqldb.ER_NO_SUCH_TABLE, "t2"))
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	args := &Args{
+		Database:      "test",
+		Table:         "t1,t2",
+		Outdir:        "/tmp/dumpertest.error",
+		User:          "mock",
+		Password:      "mock",
+		Address:       server.Addr(),
+		ChunksizeInMB: 1,
+		Threads:       2,
+		StmtSize:      10000,
+		IntervalMs:    500,
+		Manifest:      NewManifest(),
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+
+	assert.NotNil(t, Dumper(context.Background(), log, args))
+	m, err := ReadMetadata(args.Outdir)
+	assert.Nil(t, err)
+	assert.False(t, m.Interrupted)
+	assert.Equal(t, "", m.Finished)
+	assert.Equal(t, []string{"test.t2"}, m.Unfinished)
+	_, err = os.Stat(tableDataFile(args.Outdir, "test", "t1", 1, tableSuffix))
+	assert.Nil(t, err)
+
+	loadArgs := &Args{Outdir: args.Outdir}
+	assert.Panics(t, func() { checkDumpFinished(log, loadArgs) })
+	loadArgs.AllowUnfinished = true
+	checkDumpFinished(log, loadArgs)
+}
+
+func TestDumperTableSizes(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+	}
+	selectResult := &sqltypes.Result{Fields: fields}
+	for i := 1; i <= 1000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(strings.Repeat("x", 60))),
+		})
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("select \\* from .* limit 1", &sqltypes.Result{Fields: fields})
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	rows := 100
+	args := &Args{
+		Outdir:           "/tmp/dumpertest.sizes",
+		ChunksizeInMB:    1,
+		StmtSize:         10000,
+		MaxAllowedPacket: 2048 + packetMargin,
+		TableSizes:       map[string]*TableSizes{"t1": {ChunkRows: &rows, StmtSize: 1 << 20}},
+		Manifest:         NewManifest(),
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+	defer os.RemoveAll(args.Outdir)
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	defer pool.Put(conn)
+	assert.Nil(t, dumpTable(context.Background(), log, pool, conn, args, "test", "t1"))
+
+	// 100 rows per chunk, the statements under the packet whatever the table stmtsize.
+	assert.Equal(t, 10, len(args.Manifest.Files))
+	for part := 1; part <= 10; part++ {
+		dat, err := ioutil.ReadFile(tableDataFile(args.Outdir, "test", "t1", part, tableSuffix))
+		assert.Nil(t, err)
+		assert.Equal(t, 100, strings.Count(string(dat), "x\")"))
+		assert.True(t, strings.HasSuffix(string(dat), ");\n"))
+		stmts := strings.Split(strings.TrimSuffix(string(dat), ";\n"), ";\n")
+		assert.True(t, len(stmts) > 1)
+		for _, stmt := range stmts {
+			assert.True(t, strings.HasPrefix(stmt, "INSERT INTO `t1`(`id`,`name`) VALUES\n"))
+			assert.True(t, len(stmt) <= 2048, "statement of %d bytes", len(stmt))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// Interrupt cancels the run on SIGINT or SIGTERM: no new table or chunk is started, the ones
+// in flight are finished or discarded whole. A second signal exits at once.
+// SIGUSR1 logs the status report of the worker threads.
+type Interrupt struct {
+	log    *xlog.Log
+	cancel context.CancelFunc
+	sigs   chan os.Signal
+	done   chan struct{}
+
+	mu  sync.Mutex
+	sig os.Signal
+}
+
+// NotifyInterrupt returns the context canceled by the first SIGINT or SIGTERM.
+func NotifyInterrupt(log *xlog.Log) (context.Context, *Interrupt) {
+	ctx, cancel := context.WithCancel(context.Background())
+	i := &Interrupt{
+		log:    log,
+		cancel: cancel,
+		sigs:   make(chan os.Signal, 2),
+		done:   make(chan struct{}),
+	}
+	signal.Notify(i.sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	go i.loop()
+	return ctx, i
+}
+
+func (i *Interrupt) loop() {
+	for {
+		var sig os.Signal
+		select {
+		case <-i.done:
+			return
+		case sig = <-i.sigs:
+		}
+
+		if sig == syscall.SIGUSR1 {
+			ReportStatus(i.log)
+			continue
+		}
+		i.mu.Lock()
+		first := i.sig == nil
+		if first {
+			i.sig = sig
+		}
+		i.mu.Unlock()
+		if !first {
+			i.log.Error("interrupted.again.by[%v].exit.now", sig)
+			os.Exit(exitCode(sig))
+		}
+		i.log.Warning("interrupted.by[%v].finishing.the.work.in.flight(again.to.exit.now)...", sig)
+		i.cancel()
+	}
+}
+
+// Stop stops the signal handling.
+func (i *Interrupt) Stop() {
+	signal.Stop(i.sigs)
+	close(i.done)
+	i.cancel()
+}
+
+// ExitCode returns the exit status of the interrupted run, 128 plus the signal number
+// as the shells do, or 1 if no signal was received.
+func (i *Interrupt) ExitCode() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return exitCode(i.sig)
+}
+
+func exitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// getConn takes the connection of the next task from the pool, nil once the context is done.
+func getConn(ctx context.Context, pool *Pool) *Connection {
+	if ctx.Err() != nil {
+		return nil
+	}
+	conn, err := pool.GetContext(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+	AssertNil(err)
+	return conn
+}
@@ -0,0 +1,38 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestInterrupt(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	ctx, interrupt := NotifyInterrupt(log)
+	defer interrupt.Stop()
+
+	status.begin(1001, "dumping.table[test.t1]")
+	status.progress(1001, 256, 1024)
+	defer status.end(1001)
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGINT))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not.interrupted")
+	}
+	assert.Equal(t, 130, interrupt.ExitCode())
+}
@@ -10,10 +10,10 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -33,6 +33,8 @@ type Files struct {
 	databases []string
 	schemas   []string
 	tables    []string
+	// others are the dump files not loaded but verified, the parquet chunks.
+	others []string
 }
 
 var (
@@ -44,38 +46,67 @@ var (
 
 func loadFiles(log *xlog.Log, dir string) *Files {
 	files := &Files{}
-	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Panicf("loader.file.walk.error:%+v", err)
-		}
-
-		if !info.IsDir() {
-			switch {
-			case strings.HasSuffix(path, dbSuffix):
-				files.databases = append(files.databases, path)
-			case strings.HasSuffix(path, schemaSuffix):
-				files.schemas = append(files.schemas, path)
-			default:
-				if strings.HasSuffix(path, tableSuffix) || strings.HasSuffix(path, csvSuffix) {
-					files.tables = append(files.tables, path)
-				}
-			}
-		}
-		return nil
-	}); err != nil {
+	paths, err := listStorageFiles(dir)
+	if err != nil {
 		log.Panicf("loader.file.walk.error:%+v", err)
 	}
+	for _, path := range paths {
+		switch {
+		case isTempFile(path):
+			// A write in progress, or torn by a crash.
+			continue
+		case strings.HasSuffix(path, dbSuffix):
+			files.databases = append(files.databases, path)
+		case strings.HasSuffix(path, schemaSuffix):
+			files.schemas = append(files.schemas, path)
+		case strings.HasSuffix(path, tableSuffix), strings.HasSuffix(path, csvSuffix):
+			files.tables = append(files.tables, path)
+		case strings.HasSuffix(path, parquetSuffix):
+			files.others = append(files.others, path)
+		}
+	}
 	return files
 }
 
-func restoreDatabaseSchema(log *xlog.Log, dbs []string, conn *Connection) {
+func (f *Files) all() []string {
+	all := make([]string, 0, len(f.databases)+len(f.schemas)+len(f.tables)+len(f.others))
+	all = append(all, f.databases...)
+	all = append(all, f.schemas...)
+	all = append(all, f.tables...)
+	return append(all, f.others...)
+}
+
+// verifyLoadFiles checks all the files against the manifest before loading anything.
+func verifyLoadFiles(log *xlog.Log, args *Args, files *Files) {
+	if args.Manifest == nil {
+		log.Warning("loader.manifest.not.found.skip.verify...")
+		return
+	}
+	AssertNil(verifyManifest(log, args.Manifest, files.all(), args.Threads))
+	log.Info("loader.verify.files[%d].done...", len(args.Manifest.Files))
+}
+
+// loadDatabase returns the database the dumped one is loaded into: args.ToDatabase if set, as
+// the checker repairs into its -to-db, else the same one.
+func loadDatabase(args *Args, database string) string {
+	if args.ToDatabase != "" {
+		return args.ToDatabase
+	}
+	return database
+}
+
+func restoreDatabaseSchema(log *xlog.Log, args *Args, dbs []string, conn *Connection) {
 	for _, db := range dbs {
-		base := filepath.Base(db)
-		name := strings.TrimSuffix(base, dbSuffix)
+		name, err := parseDatabaseFile(db)
+		AssertNil(err)
 
-		data, err := ReadFile(db)
+		data, err := readDumpFile(args, db)
 		AssertNil(err)
 		sql := common.BytesToString(data)
+		if name != loadDatabase(args, name) {
+			name = loadDatabase(args, name)
+			sql = "CREATE DATABASE IF NOT EXISTS " + quoteIdent(name)
+		}
 
 		err = conn.Execute(sql)
 		AssertNil(err)
@@ -83,41 +114,39 @@ func restoreDatabaseSchema(log *xlog.Log, dbs []string, conn *Connection) {
 	}
 }
 
-func restoreTableSchema(log *xlog.Log, overwrite bool, tables []string, conn *Connection) {
-	if !overwrite {
+func restoreTableSchema(log *xlog.Log, args *Args, tables []string, conn *Connection) {
+	if !args.OverwriteTables {
 		return
 	}
 	for _, table := range tables {
 		// use
-		base := filepath.Base(table)
-		name := strings.TrimSuffix(base, schemaSuffix)
-		db := strings.Split(name, ".")[0]
-		tbl := strings.Split(name, ".")[1]
-		name = fmt.Sprintf("`%v`.`%v`", db, tbl)
+		db, tbl, _, err := parseTableFile(table, schemaSuffix)
+		AssertNil(err)
+		db = loadDatabase(args, db)
+		name := quoteIdent(db) + "." + quoteIdent(tbl)
 
 		log.Info("working.table[%s.%s]", db, tbl)
 
-		err := conn.Execute(fmt.Sprintf("USE `%s`", db))
+		err = conn.Execute("USE " + quoteIdent(db))
 		AssertNil(err)
 
 		// doris 不支持
 		// err = conn.Execute("SET FOREIGN_KEY_CHECKS=0")
 		// AssertNil(err)
 
-		data, err := ReadFile(table)
+		data, err := readDumpFile(args, table)
+		AssertNil(err)
+		querys, err := SplitStatements(common.BytesToString(data))
 		AssertNil(err)
-		query1 := common.BytesToString(data)
-		querys := strings.Split(query1, ";\n")
+
+		log.Info("drop(overwrite.is.true).table[%s.%s]", db, tbl)
+		dropQuery := fmt.Sprintf("DROP TABLE IF EXISTS %s", name)
+		err = conn.Execute(dropQuery)
+		AssertNil(err)
+
 		for _, query := range querys {
-			if !strings.HasPrefix(query, "/*") && query != "" {
-				log.Info("drop(overwrite.is.true).table[%s.%s]", db, tbl)
-				dropQuery := fmt.Sprintf("DROP TABLE IF EXISTS %s", name)
-				err = conn.Execute(dropQuery)
-				AssertNil(err)
-
-				err = conn.Execute(query)
-				AssertNil(err)
-			}
+			err = conn.Execute(query)
+			AssertNil(err)
 		}
 		log.Info("restoring.schema[%s.%s]", db, tbl)
 	}
@@ -138,7 +167,15 @@ func _newDorisLoadRequest(url, header, body, username, password string) (req *ht
 }
 
 func submitDorisTask(log *xlog.Log, url string, client *http.Client, header string, body string, args *Args) (err error) {
-	req, err := _newDorisLoadRequest(url, header, body, args.User, args.Password)
+	user, password := args.User, args.Password
+	if args.DorisUser != "" {
+		user = args.DorisUser
+	}
+	// Without a Doris password, the MySQL one.
+	if args.DorisPassword != "" {
+		password = args.DorisPassword
+	}
+	req, err := _newDorisLoadRequest(url, header, body, user, password)
 	if err != nil {
 		return err
 	}
@@ -179,22 +216,16 @@ func submitDorisTask(log *xlog.Log, url string, client *http.Client, header stri
 
 func restoreDorisTable(log *xlog.Log, table string, addr string, conn *Connection, args *Args) int {
 	bytes := 0
-	part := "0"
-	base := filepath.Base(table)
-	name := strings.TrimSuffix(base, tableSuffix)
-	splits := strings.Split(name, ".")
-	db := splits[0]
-	tbl := splits[1]
-	if len(splits) > 2 {
-		part = splits[2]
-	}
+	db, tbl, part, err := parseTableFile(table, csvSuffix)
+	AssertNil(err)
+	db = loadDatabase(args, db)
 
 	log.Info("restoring.tables[%s.%s].parts[%s].thread[%d]", db, tbl, part, conn.ID)
 
 	//err = conn.Execute("SET FOREIGN_KEY_CHECKS=0")
 	//AssertNil(err)
 
-	data, err := ReadFile(table)
+	data, err := readDumpFile(args, table)
 	AssertNil(err)
 	query1 := common.BytesToString(data)
 	pos := strings.Index(query1, "\n") // 找到第一个换行符
@@ -220,9 +251,14 @@ func restoreDorisTable(log *xlog.Log, table string, addr string, conn *Connectio
 		Timeout: 600 * time.Second,
 	}
 	_url := fmt.Sprintf("http://%s/api/%s/%s/_stream_load", addr, db, tbl)
+	args.Throttle.Wait(len(body), 0)
 
 	for {
-		if err := submitDorisTask(log, _url, cli, header, body, args); err != nil {
+		start := time.Now()
+		err := submitDorisTask(log, _url, cli, header, body, args)
+		metricDorisLoad.Observe(time.Since(start).Seconds())
+		if err != nil {
+			metricDorisFailed.Add(1)
 			log.Error("submit doris load task error[%s.%s].parts[%s].thread[%d]: %v, retry...", db, tbl, part, conn.ID, err)
 			time.Sleep(3 * time.Second)
 			continue
@@ -234,66 +270,127 @@ func restoreDorisTable(log *xlog.Log, table string, addr string, conn *Connectio
 	return bytes
 }
 
-func restoreTable(log *xlog.Log, table string, conn *Connection) int {
+func restoreTable(log *xlog.Log, table string, conn *Connection, args *Args) int {
 	bytes := 0
-	part := "0"
-	base := filepath.Base(table)
-	name := strings.TrimSuffix(base, tableSuffix)
-	splits := strings.Split(name, ".")
-	db := splits[0]
-	tbl := splits[1]
-	if len(splits) > 2 {
-		part = splits[2]
-	}
+	db, tbl, part, err := parseTableFile(table, tableSuffix)
+	AssertNil(err)
+	db = loadDatabase(args, db)
 
 	log.Info("restoring.tables[%s.%s].parts[%s].thread[%d]", db, tbl, part, conn.ID)
-	err := conn.Execute(fmt.Sprintf("USE `%s`", db))
+	err = conn.Execute("USE " + quoteIdent(db))
 	AssertNil(err)
 
 	//err = conn.Execute("SET FOREIGN_KEY_CHECKS=0")
 	//AssertNil(err)
 
-	data, err := ReadFile(table)
+	r, closer, err := openDumpFile(args, table)
 	AssertNil(err)
-	query1 := common.BytesToString(data)
-	querys := strings.Split(query1, ";\n")
-	bytes = len(query1)
-	for _, query := range querys {
-		if !strings.HasPrefix(query, "/*") && query != "" {
-			err = conn.Execute(query)
-			AssertNil(err)
-		}
+	defer closer.Close()
+	counter := &countingReader{r: r}
+
+	scanner := NewSQLScanner(counter)
+	for scanner.Scan() {
+		query := scanner.Statement()
+		args.Throttle.Wait(len(query), 0)
+		err = conn.Execute(query)
+		AssertNil(err)
 	}
+	AssertNil(scanner.Err())
+	bytes = counter.n
 	log.Info("restoring.tables[%s.%s].parts[%s].thread[%d].done...", db, tbl, part, conn.ID)
 	return bytes
 }
 
+// loadedMetrics accounts the loaded chunk file in the metrics.
+func loadedMetrics(args *Args, table string, bytes int) {
+	db, tbl, _, err := parseTableFile(table, filepath.Ext(table))
+	if err != nil {
+		return
+	}
+	metricLoadedBytes.Add(float64(bytes), db, tbl)
+	metricChunksLoaded.Add(1, db, tbl)
+	if args.Manifest != nil {
+		if entry := args.Manifest.Lookup(table); entry != nil {
+			metricLoadedRows.Add(float64(entry.Rows), db, tbl)
+		}
+	}
+}
+
+// restoreChunk restores the chunk file by the mode, returns the bytes restored.
+func restoreChunk(log *xlog.Log, args *Args, table string, addr string, conn *Connection) int {
+	if args.Manifest != nil {
+		if entry := args.Manifest.Lookup(table); entry != nil {
+			args.Throttle.Wait(0, int(entry.Rows))
+		}
+	}
+
+	var r int
+	if args.Mode == "doris" {
+		r = restoreDorisTable(log, table, addr, conn, args)
+	} else {
+		r = restoreTable(log, table, conn, args)
+	}
+	loadedMetrics(args, table, r)
+	return r
+}
+
 // Loader used to start the loader worker.
-func Loader(log *xlog.Log, args *Args) {
-	pool, err := NewPool(log, args.Threads, args.Address, args.User, args.Password, args.SessionVars)
+// Once the context is done no new chunk is started, the ones in flight are loaded whole.
+// It returns the context error if interrupted.
+func Loader(ctx context.Context, log *xlog.Log, args *Args) error {
+	// One spare connection to poll the target load.
+	spare := 0
+	if adaptiveThrottle(args) {
+		spare = 1
+	}
+	pool, err := NewPool(log, args.Threads+spare, args.Address, args.User, args.Password, args.SessionVars, args.TLS)
 	AssertNil(err)
 	defer pool.Close()
 
+	args.Throttle = NewThrottle(log, args)
+	args.Throttle.Start(pool)
+	defer args.Throttle.Stop()
+
+	if args.Cipher == nil {
+		args.Cipher, err = LoadCipher(args.EncryptionKeyFile)
+		AssertNil(err)
+	}
+	checkDumpKey(log, args)
+	checkDumpFinished(log, args)
+
 	files := loadFiles(log, args.Outdir)
+	if m, err := ReadManifest(args.Outdir); err == nil {
+		args.Manifest = m
+	} else if !os.IsNotExist(err) && !args.SkipVerify {
+		AssertNil(err)
+	}
+	if !args.SkipVerify {
+		SetPhase("restoring.verify")
+		verifyLoadFiles(log, args, files)
+	}
 
 	// database.
-	conn := pool.Get()
-	restoreDatabaseSchema(log, files.databases, conn)
+	SetPhase("restoring.schema")
+	conn, err := pool.Get()
+	AssertNil(err)
+	restoreDatabaseSchema(log, args, files.databases, conn)
+	if args.Mode != "doris" {
+		checkTargetPacket(log, conn, args)
+	}
 	pool.Put(conn)
 
 	// tables.
-	conn = pool.Get()
-	restoreTableSchema(log, args.OverwriteTables, files.schemas, conn)
+	conn, err = pool.Get()
+	AssertNil(err)
+	restoreTableSchema(log, args, files.schemas, conn)
 	pool.Put(conn)
 
-	// Shuffle the tables
-	for i := range files.tables {
-		j := rand.Intn(i + 1)
-		files.tables[i], files.tables[j] = files.tables[j], files.tables[i]
-	}
+	tasks, err := loadTasks(args, files.tables)
+	AssertNil(err)
 
 	var wg sync.WaitGroup
 	var bytes uint64
+	var loaded int64
 	t := time.Now()
 	idx := 0
 
@@ -308,29 +405,64 @@ func Loader(log *xlog.Log, args *Args) {
 		}
 	}()
 
-	for _, table := range files.tables {
-		conn := pool.Get()
+	// The largest chunks first, within the limits per table and database.
+	SetPhase("restoring.data")
+	sched := newScheduler(tasks, args.MaxThreadsPerTable, args.MaxThreadsPerDatabase)
+	for {
+		t := sched.next(ctx)
+		if t == nil {
+			break
+		}
+		conn := getConn(ctx, pool)
+		if conn == nil {
+			break
+		}
 		wg.Add(1)
 
-		dorisAddr := args.DorisHttpLoadAddress[idx%len(args.DorisHttpLoadAddress)]
-		idx++
+		var dorisAddr string
+		if len(args.DorisHttpLoadAddress) > 0 {
+			dorisAddr = args.DorisHttpLoadAddress[idx%len(args.DorisHttpLoadAddress)]
+			idx++
+		}
 
-		go func(conn *Connection, addr string, table string) {
+		go func(conn *Connection, addr string, t *task) {
+			status.begin(conn.ID, fmt.Sprintf("restoring.file[%s]", filepath.Base(t.file)))
 			defer func() {
+				status.end(conn.ID)
+				sched.done(t)
 				wg.Done()
 				pool.Put(conn)
 			}()
-			var r int
-			if args.Mode == "doris" {
-				r = restoreDorisTable(log, table, addr, conn, args)
-			} else {
-				r = restoreTable(log, table, conn)
-			}
+			r := restoreChunk(log, args, t.file, addr, conn)
 			atomic.AddUint64(&bytes, uint64(r))
-		}(conn, dorisAddr, table)
+			atomic.AddInt64(&loaded, 1)
+		}(conn, dorisAddr, t)
 	}
 
 	wg.Wait()
 	elapsed := time.Since(t).Seconds()
+	if ctx.Err() != nil {
+		SetPhase("restoring.interrupted")
+		log.Warning("restoring.interrupted.cost[%.2fsec].chunks.loaded[%d/%d].allbytes[%.2fMB]", elapsed, loaded, len(files.tables), float64(bytes/1024/1024))
+		return ctx.Err()
+	}
+	SetPhase("restoring.done")
 	log.Info("restoring.all.done.cost[%.2fsec].allbytes[%.2fMB].rate[%.2fMB/s]", elapsed, float64(bytes/1024/1024), (float64(bytes/1024/1024) / elapsed))
+	return nil
+}
+
+// checkDumpFinished refuses the dump interrupted before its end or with tables failed, they aren't whole.
+func checkDumpFinished(log *xlog.Log, args *Args) {
+	m, err := ReadMetadata(args.Outdir)
+	if err != nil || (!m.Interrupted && len(m.Unfinished) == 0) {
+		return
+	}
+	state := "failed"
+	if m.Interrupted {
+		state = "interrupted"
+	}
+	if !args.AllowUnfinished {
+		log.Panicf("loader.dump.%s.unfinished.tables%v.dump.again.or.allow.unfinished", state, m.Unfinished)
+	}
+	log.Warning("loader.dump.%s.unfinished.tables%v.loading.anyway...", state, m.Unfinished)
 }
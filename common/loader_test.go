@@ -10,6 +10,10 @@
 package common
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -47,6 +51,27 @@ func TestLoader(t *testing.T) {
 	}
 	// Loader.
 	{
-		Loader(log, args)
+		assert.Nil(t, Loader(context.Background(), log, args))
 	}
 }
+
+func TestDorisCredentials(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		got = append(got, user+":"+password)
+		fmt.Fprint(w, `{"Status":"Success"}`)
+	}))
+	defer server.Close()
+
+	for _, args := range []*Args{
+		{User: "mysql", Password: "pwd"},
+		{User: "mysql", Password: "pwd", DorisUser: "doris"},
+		{User: "mysql", Password: "pwd", DorisUser: "doris", DorisPassword: "dpwd"},
+	} {
+		assert.Nil(t, submitDorisTask(log, server.URL, server.Client(), "`a`", "1", args))
+	}
+	// Without a Doris password, the MySQL one.
+	assert.Equal(t, []string{"mysql:pwd", "doris:pwd", "doris:dpwd"}, got)
+}
@@ -0,0 +1,210 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/common"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+const manifestFile = "manifest.json"
+
+// ManifestEntry describes one file of the dump.
+type ManifestEntry struct {
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	Rows     uint64 `json:"rows"`
+	Database string `json:"database"`
+	Table    string `json:"table,omitempty"`
+}
+
+// Manifest lists every schema and chunk file of the dump.
+type Manifest struct {
+	mu    sync.Mutex
+	Files []*ManifestEntry `json:"files"`
+	index map[string]*ManifestEntry
+}
+
+// NewManifest creates the new manifest.
+func NewManifest() *Manifest {
+	return &Manifest{index: make(map[string]*ManifestEntry)}
+}
+
+// Add used to record the file with its datas.
+func (m *Manifest) Add(file string, data string, database string, table string, rows uint64) {
+	sum := sha256.Sum256(common.StringToBytes(data))
+	entry := &ManifestEntry{
+		File:     filepath.Base(file),
+		Size:     int64(len(data)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Rows:     rows,
+		Database: database,
+		Table:    table,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.index[entry.File]; ok {
+		*old = *entry
+		return
+	}
+	m.index[entry.File] = entry
+	m.Files = append(m.Files, entry)
+}
+
+// Remove used to drop the entry of the removed file.
+func (m *Manifest) Remove(file string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := filepath.Base(file)
+	if _, ok := m.index[name]; !ok {
+		return
+	}
+	delete(m.index, name)
+	for i, entry := range m.Files {
+		if entry.File == name {
+			m.Files = append(m.Files[:i], m.Files[i+1:]...)
+			break
+		}
+	}
+}
+
+// Lookup returns the entry of the file, nil if the file isn't in the manifest.
+func (m *Manifest) Lookup(file string) *ManifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.index[filepath.Base(file)]
+}
+
+// Write used to write the manifest to the dump directory.
+func (m *Manifest) Write(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].File < m.Files[j].File })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStorageFile(joinLocation(dir, manifestFile), string(data)+"\n")
+}
+
+// ReadManifest reads the manifest from the dump directory.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := readStorageFile(joinLocation(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := NewManifest()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest[%s].invalid:%v", dir, err)
+	}
+	for _, entry := range m.Files {
+		m.index[entry.File] = entry
+	}
+	return m, nil
+}
+
+// VerifyFile checks the size and checksum of the file against the manifest.
+func (m *Manifest) VerifyFile(file string) error {
+	entry := m.Lookup(file)
+	if entry == nil {
+		return fmt.Errorf("file[%s].not.in.manifest", file)
+	}
+
+	f, err := openStorageFile(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != entry.Size {
+		return fmt.Errorf("file[%s].size.mismatch.want[%d].got[%d]", file, entry.Size, n)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != entry.SHA256 {
+		return fmt.Errorf("file[%s].sha256.mismatch.want[%s].got[%s]", file, entry.SHA256, sum)
+	}
+	return nil
+}
+
+// verifyFiles checks the files against the manifest with the threads.
+func verifyFiles(log *xlog.Log, m *Manifest, files []string, threads int) error {
+	if threads < 1 {
+		threads = 1
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	ch := make(chan string)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range ch {
+				if err := m.VerifyFile(file); err != nil {
+					log.Error("verify.file[%s].error:%v", file, err)
+					once.Do(func() { first = err })
+				}
+			}
+		}()
+	}
+	for _, file := range files {
+		ch <- file
+	}
+	close(ch)
+	wg.Wait()
+	return first
+}
+
+// verifyManifest checks the dump files against the manifest,
+// every file listed in the manifest must be found in the files.
+func verifyManifest(log *xlog.Log, m *Manifest, files []string, threads int) error {
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		seen[filepath.Base(file)] = true
+	}
+	for _, entry := range m.Files {
+		if !seen[entry.File] {
+			log.Error("verify.file[%s].missing", entry.File)
+			return fmt.Errorf("file[%s].missing", entry.File)
+		}
+	}
+	return verifyFiles(log, m, files, threads)
+}
+
+// VerifyDump checks the files of the dump directory against its manifest.
+func VerifyDump(log *xlog.Log, dir string, threads int) error {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	files := loadFiles(log, dir).all()
+	if err := verifyManifest(log, m, files, threads); err != nil {
+		return err
+	}
+	log.Info("verify.dump[%s].files[%d].ok", dir, len(files))
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestManifest(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	dir := "/tmp/manifesttest"
+	os.RemoveAll(dir)
+	AssertNil(os.MkdirAll(dir, 0777))
+	defer os.RemoveAll(dir)
+
+	args := &Args{Manifest: NewManifest()}
+	files := map[string]string{
+		databaseSchemaFile(dir, "test"):                  "CREATE DATABASE IF NOT EXISTS `test`;",
+		tableSchemaFile(dir, "test", "t1"):               "CREATE TABLE `t1` (`a` int);\n",
+		tableDataFile(dir, "test", "t1", 1, tableSuffix): "INSERT INTO `t1`(`a`) VALUES\n(1),\n(2);\n",
+	}
+	for file, data := range files {
+		err := writeDumpFile(args, file, data, "test", "t1", 2)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, args.Manifest.Write(dir))
+
+	m, err := ReadManifest(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(m.Files))
+	entry := m.Lookup(tableDataFile(dir, "test", "t1", 1, tableSuffix))
+	assert.NotNil(t, entry)
+	assert.Equal(t, int64(len(files[tableDataFile(dir, "test", "t1", 1, tableSuffix)])), entry.Size)
+	assert.Equal(t, uint64(2), entry.Rows)
+	assert.Equal(t, "t1", entry.Table)
+
+	// Ok.
+	{
+		err := VerifyDump(log, dir, 2)
+		assert.Nil(t, err)
+	}
+
+	// Truncated chunk.
+	{
+		file := tableDataFile(dir, "test", "t1", 1, tableSuffix)
+		err := WriteFile(file, "INSERT INTO `t1`(`a`) VALUES\n(1)")
+		assert.Nil(t, err)
+		err = VerifyDump(log, dir, 2)
+		assert.NotNil(t, err)
+
+		// Same size, different content.
+		err = WriteFile(file, "INSERT INTO `t1`(`a`) VALUES\n(1),\n(3);\n")
+		assert.Nil(t, err)
+		err = VerifyDump(log, dir, 2)
+		assert.NotNil(t, err)
+		AssertNil(WriteFile(file, files[file]))
+	}
+
+	// Unknown file.
+	{
+		file := tableDataFile(dir, "test", "t1", 2, tableSuffix)
+		AssertNil(WriteFile(file, "INSERT INTO `t1`(`a`) VALUES\n(3);\n"))
+		err := VerifyDump(log, dir, 2)
+		assert.NotNil(t, err)
+		os.Remove(file)
+	}
+
+	// Missing file.
+	{
+		os.Remove(tableSchemaFile(dir, "test", "t1"))
+		err := VerifyDump(log, dir, 2)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// shuffleLimit is how many values of a column are loaded to be shuffled among the rows,
+// the shuffle is refused on the larger tables.
+const shuffleLimit = 100000
+
+// emailWidth is the length of the masked emails.
+const emailWidth = len("user_123456789012@example.com")
+
+// numericTypes are the information_schema data types of the numeric columns.
+var numericTypes = map[string]bool{
+	"tinyint":   true,
+	"smallint":  true,
+	"mediumint": true,
+	"int":       true,
+	"integer":   true,
+	"bigint":    true,
+	"decimal":   true,
+	"numeric":   true,
+	"float":     true,
+	"double":    true,
+}
+
+// maskSpecRegexp matches the masker specs: a name with an optional integer argument.
+var maskSpecRegexp = regexp.MustCompile(`^([a-z]+)(?:\((\d+)\))?$`)
+
+// maskDefaults are the maskers with the default of their argument, -1 if they take none.
+var maskDefaults = map[string]int{
+	"hash":    0,
+	"email":   -1,
+	"phone":   -1,
+	"redact":  4,
+	"nullify": -1,
+	"shuffle": -1,
+	"jitter":  30,
+}
+
+// maskSpec is a parsed masker spec, such as redact(4).
+type maskSpec struct {
+	name string
+	arg  int
+}
+
+// parseMaskSpec parses the masker spec of a [mask] rule.
+func parseMaskSpec(v string) (maskSpec, error) {
+	m := maskSpecRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(v)))
+	if m == nil {
+		return maskSpec{}, fmt.Errorf("masker[%s].invalid", v)
+	}
+	def, ok := maskDefaults[m[1]]
+	if !ok {
+		return maskSpec{}, fmt.Errorf("masker[%s].unknown", m[1])
+	}
+	spec := maskSpec{name: m[1], arg: def}
+	if m[2] != "" {
+		if def < 0 {
+			return maskSpec{}, fmt.Errorf("masker[%s].takes.no.argument", m[1])
+		}
+		spec.arg, _ = strconv.Atoi(m[2])
+	}
+	return spec, nil
+}
+
+// checkMaskRule checks the pattern and the spec of a [mask] rule.
+func checkMaskRule(pattern string, spec string) error {
+	for _, p := range strings.SplitN(pattern, ".", 2) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("pattern[%s].invalid", pattern)
+		}
+	}
+	_, err := parseMaskSpec(spec)
+	return err
+}
+
+// maskRule returns the spec of the rule matching the column, false if none. The table.column
+// patterns win over the column ones, then the longest pattern wins.
+func maskRule(masks map[string]string, table string, column string) (string, bool) {
+	table, column = strings.ToLower(table), strings.ToLower(column)
+	best := ""
+	for _, pattern := range sortedKeys(masks) {
+		var ok bool
+		if split := strings.SplitN(pattern, ".", 2); len(split) == 2 {
+			t, _ := path.Match(split[0], table)
+			c, _ := path.Match(split[1], column)
+			ok = t && c
+		} else {
+			ok, _ = path.Match(pattern, column)
+		}
+		if !ok {
+			continue
+		}
+		if best == "" || moreSpecific(pattern, best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return masks[best], true
+}
+
+func moreSpecific(a string, b string) bool {
+	at, bt := strings.Contains(a, "."), strings.Contains(b, ".")
+	if at != bt {
+		return at
+	}
+	return len(a) > len(b)
+}
+
+// masker masks one column. The values are masked by an HMAC of the salt, the same value gives
+// the same mask in every table and run of the same salt, so the joins still match.
+type masker struct {
+	spec maskSpec
+	salt []byte
+	// width is the length of the string column, the hashes are cut to it, 0 if unknown.
+	width int
+	// values are shuffled among the rows by shuffle.
+	values []sqltypes.Value
+}
+
+func (m *masker) sum(raw []byte) []byte {
+	mac := hmac.New(sha256.New, m.salt)
+	mac.Write(raw)
+	return mac.Sum(nil)
+}
+
+// mask returns the masked value of the n-th row.
+func (m *masker) mask(v sqltypes.Value, n uint64) sqltypes.Value {
+	if m.spec.name == "shuffle" {
+		if len(m.values) == 0 {
+			return v
+		}
+		return m.values[n%uint64(len(m.values))]
+	}
+	if v.IsNull() || m.spec.name == "nullify" {
+		return sqltypes.NULL
+	}
+	raw := v.Raw()
+	numeric := v.IsIntegral() || v.IsFloat() || v.Type() == querypb.Type_DECIMAL
+	switch m.spec.name {
+	case "hash":
+		sum := m.sum(raw)
+		if numeric {
+			// The digits, to fit the column.
+			return sqltypes.MakeTrusted(v.Type(), replaceDigits(raw, sum))
+		}
+		h := hex.EncodeToString(sum)
+		if m.spec.arg > 0 && m.spec.arg < len(h) {
+			h = h[:m.spec.arg]
+		}
+		if m.width > 0 && m.width < len(h) {
+			h = h[:m.width]
+		}
+		return sqltypes.MakeTrusted(v.Type(), []byte(h))
+	case "email":
+		return sqltypes.MakeTrusted(v.Type(), []byte("user_"+hex.EncodeToString(m.sum(raw))[:12]+"@example.com"))
+	case "phone":
+		return sqltypes.MakeTrusted(v.Type(), replaceDigits(raw, m.sum(raw)))
+	case "redact":
+		// The values no longer than the kept end are redacted whole.
+		runes := []rune(string(raw))
+		redacted := len(runes) - m.spec.arg
+		if redacted <= 0 {
+			redacted = len(runes)
+		}
+		for i := 0; i < redacted; i++ {
+			switch {
+			case !numeric:
+				runes[i] = '*'
+			case runes[i] >= '0' && runes[i] <= '9':
+				runes[i] = '0'
+			}
+		}
+		return sqltypes.MakeTrusted(v.Type(), []byte(string(runes)))
+	case "jitter":
+		return jitterDate(v, m.sum(raw), m.spec.arg)
+	}
+	return v
+}
+
+// replaceDigits replaces the digits by the ones of the sum, the format is kept.
+func replaceDigits(raw []byte, sum []byte) []byte {
+	out := append([]byte(nil), raw...)
+	for i, c := range out {
+		if c >= '0' && c <= '9' {
+			out[i] = '0' + sum[i%len(sum)]%10
+		}
+	}
+	return out
+}
+
+// jitterDate shifts the date or datetime by up to days either way, the rest of the datetime
+// is kept. The values which are not dates, or zero, are returned as is.
+func jitterDate(v sqltypes.Value, sum []byte, days int) sqltypes.Value {
+	s := v.String()
+	layout := "2006-01-02"
+	if len(s) >= len("2006-01-02 15:04:05") {
+		layout = "2006-01-02 15:04:05"
+	}
+	if len(s) < len(layout) || days <= 0 {
+		return v
+	}
+	t, err := time.Parse(layout, s[:len(layout)])
+	if err != nil {
+		return v
+	}
+	shift := int(binary.BigEndian.Uint64(sum)%uint64(2*days+1)) - days
+	out := t.AddDate(0, 0, shift).Format(layout) + s[len(layout):]
+	return sqltypes.MakeTrusted(v.Type(), []byte(out))
+}
+
+// maskColumn is the column of information_schema a masker applies to.
+type maskColumn struct {
+	numeric bool
+	// width is the character length of the string columns.
+	width int
+}
+
+// maskColumns returns the columns of the table by their lower case name.
+func maskColumns(conn *Connection, database string, table string) (map[string]maskColumn, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT COLUMN_NAME, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s'", database, table))
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]maskColumn, len(qr.Rows))
+	for _, row := range qr.Rows {
+		if len(row) < 3 {
+			return nil, fmt.Errorf("information_schema.columns.unexpected.columns[%d]", len(row))
+		}
+		width, _ := strconv.Atoi(row[2].String())
+		columns[strings.ToLower(row[0].String())] = maskColumn{numeric: numericTypes[strings.ToLower(row[1].String())], width: width}
+	}
+	return columns, nil
+}
+
+// checkMaskColumn refuses the maskers whose values don't fit the column: the emails on the
+// numeric or narrower columns.
+func checkMaskColumn(spec maskSpec, c maskColumn) error {
+	if spec.name != "email" {
+		return nil
+	}
+	if c.numeric {
+		return fmt.Errorf("masker[email].on.numeric.column")
+	}
+	if c.width > 0 && c.width < emailWidth {
+		return fmt.Errorf("masker[email].needs.%d.characters.column.has[%d]", emailWidth, c.width)
+	}
+	return nil
+}
+
+// shuffleValues returns the values of the column ordered by the primary key, or by the values
+// without one, so the same rows get the same values again. It refuses the larger tables.
+func shuffleValues(conn *Connection, database string, table string, column string, where string) ([]sqltypes.Value, error) {
+	order := fmt.Sprintf("`%s`", column)
+	key, err := primaryKey(conn, database, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		order = strings.Join(key, ",")
+	}
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT `%s` FROM `%s`.`%s` %s ORDER BY %s LIMIT %d", column, database, table, where, order, shuffleLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Rows) > shuffleLimit {
+		return nil, fmt.Errorf("masker[shuffle].column[%s].over.%d.rows", column, shuffleLimit)
+	}
+	values := make([]sqltypes.Value, 0, len(qr.Rows))
+	for _, row := range qr.Rows {
+		values = append(values, row[0])
+	}
+	return values, nil
+}
+
+// tableMasks are the maskers of the dumped columns, nil for the unmasked ones.
+type tableMasks []*masker
+
+// newTableMasks returns the maskers of the table columns, nil if none is masked.
+// The values of the shuffled columns are loaded by the where of the dump.
+// The maskers are checked against the columns of information_schema.
+func newTableMasks(log *xlog.Log, conn *Connection, args *Args, database string, table string, columns []string, where string) (tableMasks, error) {
+	var masks tableMasks
+	var types map[string]maskColumn
+	for i, column := range columns {
+		column = strings.Trim(column, "`")
+		v, ok := maskRule(args.Masks, table, column)
+		if !ok {
+			continue
+		}
+		spec, err := parseMaskSpec(v)
+		if err != nil {
+			return nil, err
+		}
+		if masks == nil {
+			masks = make(tableMasks, len(columns))
+			if types, err = maskColumns(conn, database, table); err != nil {
+				return nil, err
+			}
+		}
+		c := types[strings.ToLower(column)]
+		if err := checkMaskColumn(spec, c); err != nil {
+			return nil, fmt.Errorf("dumping.table[%s.%s].column[%s].%v", database, table, column, err)
+		}
+		m := &masker{spec: spec, salt: []byte(args.MaskSalt), width: c.width}
+		if spec.name == "shuffle" {
+			if m.values, err = shuffleValues(conn, database, table, column, where); err != nil {
+				return nil, err
+			}
+			// Seeded by the salt, the same rows get the same values again.
+			seed := binary.BigEndian.Uint64(m.sum([]byte(database + "." + table + "." + column)))
+			r := rand.New(rand.NewSource(int64(seed >> 1)))
+			r.Shuffle(len(m.values), func(i, j int) { m.values[i], m.values[j] = m.values[j], m.values[i] })
+		}
+		masks[i] = m
+		log.Info("dumping.table[%s.%s].column[%s].mask[%s]", database, table, column, v)
+	}
+	return masks, nil
+}
+
+// apply returns the masked values of the n-th row, the row itself if nothing is masked.
+// The row is not changed, the cursor reuses it.
+func (masks tableMasks) apply(row []sqltypes.Value, n uint64) []sqltypes.Value {
+	if masks == nil {
+		return row
+	}
+	out := make([]sqltypes.Value, len(row))
+	for i, v := range row {
+		if i < len(masks) && masks[i] != nil {
+			v = masks[i].mask(v, n)
+		}
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,223 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestParseMaskSpec(t *testing.T) {
+	spec, err := parseMaskSpec("Redact(2)")
+	assert.Nil(t, err)
+	assert.Equal(t, maskSpec{name: "redact", arg: 2}, spec)
+	spec, err = parseMaskSpec("jitter")
+	assert.Nil(t, err)
+	assert.Equal(t, maskSpec{name: "jitter", arg: 30}, spec)
+
+	for _, v := range []string{"scramble", "email(3)", "hash(x)", ""} {
+		_, err := parseMaskSpec(v)
+		assert.NotNil(t, err, v)
+	}
+	assert.NotNil(t, checkMaskRule("[email", "hash"))
+	assert.Nil(t, checkMaskRule("users.*mail*", "email"))
+}
+
+func TestMaskRule(t *testing.T) {
+	masks := map[string]string{
+		"*email*":      "email",
+		"*":            "hash",
+		"users.*":      "nullify",
+		"users.email*": "redact",
+	}
+	for _, c := range []struct{ table, column, want string }{
+		{"orders", "Billing_Email", "email"},
+		{"orders", "id", "hash"},
+		{"users", "id", "nullify"},
+		{"users", "email", "redact"},
+	} {
+		spec, ok := maskRule(masks, c.table, c.column)
+		assert.True(t, ok)
+		assert.Equal(t, c.want, spec, c.table+"."+c.column)
+	}
+	_, ok := maskRule(map[string]string{"*email*": "email"}, "users", "id")
+	assert.False(t, ok)
+}
+
+func TestMaskers(t *testing.T) {
+	mask := func(spec string, salt string, v sqltypes.Value) string {
+		s, err := parseMaskSpec(spec)
+		assert.Nil(t, err)
+		m := &masker{spec: s, salt: []byte(salt)}
+		return m.mask(v, 0).String()
+	}
+	text := func(s string) sqltypes.Value { return sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(s)) }
+
+	// Deterministic by the salt.
+	email := mask("email", "s1", text("alice@corp.com"))
+	assert.Regexp(t, regexp.MustCompile(`^user_[0-9a-f]{12}@example\.com$`), email)
+	assert.Equal(t, email, mask("email", "s1", text("alice@corp.com")))
+	assert.NotEqual(t, email, mask("email", "s2", text("alice@corp.com")))
+	assert.NotEqual(t, email, mask("email", "s1", text("bob@corp.com")))
+
+	assert.Equal(t, 64, len(mask("hash", "s1", text("x"))))
+	assert.Equal(t, 16, len(mask("hash(16)", "s1", text("x"))))
+	narrow := &masker{spec: maskSpec{name: "hash"}, salt: []byte("s1"), width: 10}
+	assert.Equal(t, 10, len(narrow.mask(text("x"), 0).String()))
+	id := mask("hash", "s1", sqltypes.MakeTrusted(querypb.Type_INT64, []byte("-12345")))
+	assert.Regexp(t, regexp.MustCompile(`^-\d{5}$`), id)
+
+	phone := mask("phone", "s1", text("+1 (555) 010-9999"))
+	assert.Regexp(t, regexp.MustCompile(`^\+\d \(\d{3}\) \d{3}-\d{4}$`), phone)
+	assert.NotEqual(t, "+1 (555) 010-9999", phone)
+
+	assert.Equal(t, "************1234", mask("redact", "s1", text("4111111111111234")))
+	assert.Equal(t, "***é", mask("redact(1)", "s1", text("abcé")))
+	assert.Equal(t, "**", mask("redact", "s1", text("ab")))
+	assert.Equal(t, "000789", mask("redact(3)", "s1", sqltypes.MakeTrusted(querypb.Type_INT32, []byte("123789"))))
+
+	assert.True(t, (&masker{spec: maskSpec{name: "nullify"}}).mask(text("x"), 0).IsNull())
+	assert.True(t, (&masker{spec: maskSpec{name: "email"}}).mask(sqltypes.NULL, 0).IsNull())
+
+	// The dates move by up to the days, the time is kept.
+	for _, v := range []string{"2020-02-28", "2020-02-28 13:14:15.123456"} {
+		out := mask("jitter(10)", "s1", sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte(v)))
+		assert.Equal(t, len(v), len(out))
+		assert.Equal(t, v[10:], out[10:])
+		d, err := time.Parse("2006-01-02", out[:10])
+		assert.Nil(t, err)
+		diff := d.Sub(time.Date(2020, 2, 28, 0, 0, 0, 0, time.UTC))
+		assert.True(t, diff >= -10*24*time.Hour && diff <= 10*24*time.Hour, out)
+	}
+	assert.Equal(t, "0000-00-00", mask("jitter", "s1", sqltypes.MakeTrusted(querypb.Type_DATE, []byte("0000-00-00"))))
+}
+
+func TestCheckMaskColumn(t *testing.T) {
+	email := maskSpec{name: "email"}
+	assert.Nil(t, checkMaskColumn(email, maskColumn{width: 255}))
+	assert.Nil(t, checkMaskColumn(email, maskColumn{}))
+	assert.NotNil(t, checkMaskColumn(email, maskColumn{numeric: true}))
+	assert.NotNil(t, checkMaskColumn(email, maskColumn{width: 20}))
+	assert.Nil(t, checkMaskColumn(maskSpec{name: "hash"}, maskColumn{numeric: true}))
+	assert.Nil(t, checkMaskColumn(maskSpec{name: "phone"}, maskColumn{numeric: true}))
+}
+
+func TestDumperMask(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "email", Type: querypb.Type_VARCHAR},
+		{Name: "city", Type: querypb.Type_VARCHAR},
+	}
+	selectResult := &sqltypes.Result{Fields: fields}
+	cities := &sqltypes.Result{Fields: fields[2:]}
+	for _, row := range [][]string{{"1", "a@x.com", "paris"}, {"2", "b@x.com", "rome"}, {"3", "a@x.com", "oslo"}} {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(row[0])),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(row[1])),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(row[2])),
+		})
+		cities.Rows = append(cities.Rows, []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(row[2]))})
+	}
+
+	keysResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Column_name", Type: querypb.Type_VARCHAR}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("id"))}},
+	}
+	columnsResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "COLUMN_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "DATA_TYPE", Type: querypb.Type_VARCHAR},
+			{Name: "CHARACTER_MAXIMUM_LENGTH", Type: querypb.Type_INT64},
+		},
+	}
+	for _, c := range [][]string{{"id", "int", ""}, {"email", "varchar", "255"}, {"city", "varchar", "20"}} {
+		columnsResult.Rows = append(columnsResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(c[0])),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(c[1])),
+			sqltypes.MakeTrusted(querypb.Type_INT64, []byte(c[2])),
+		})
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("select \\* from .* limit 1", &sqltypes.Result{Fields: fields})
+		fakedbs.AddQueryPattern("show keys from .*", keysResult)
+		fakedbs.AddQueryPattern("select column_name, data_type, character_maximum_length from information_schema.columns .*", columnsResult)
+		fakedbs.AddQueryPattern("select `city` from `test`.`t1`  order by `id` limit 100001", cities)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	args := &Args{
+		Outdir:        "/tmp/dumpertest.mask",
+		ChunksizeInMB: 1,
+		StmtSize:      10000,
+		Masks:         map[string]string{"*email*": "email", "t1.city": "shuffle"},
+		MaskSalt:      "salt",
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+	defer os.RemoveAll(args.Outdir)
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	defer pool.Put(conn)
+	assert.Nil(t, dumpTable(context.Background(), log, pool, conn, args, "test", "t1"))
+
+	dat, err := ioutil.ReadFile(tableDataFile(args.Outdir, "test", "t1", 1, tableSuffix))
+	assert.Nil(t, err)
+	rows := regexp.MustCompile(`\((\d),"([^"]*)","([^"]*)"\)`).FindAllStringSubmatch(string(dat), -1)
+	assert.Equal(t, 3, len(rows))
+	assert.NotContains(t, string(dat), "@x.com")
+
+	// The same email gets the same mask, the cities are the same ones shuffled.
+	assert.Equal(t, rows[0][2], rows[2][2])
+	assert.NotEqual(t, rows[0][2], rows[1][2])
+	var got []string
+	for _, row := range rows {
+		got = append(got, row[3])
+	}
+	assert.ElementsMatch(t, []string{"paris", "rome", "oslo"}, got)
+	assert.True(t, strings.HasPrefix(string(dat), "INSERT INTO `t1`(`id`,`email`,`city`) VALUES\n"))
+
+	// The emails don't fit the numeric or narrow columns.
+	for _, rule := range []string{"t1.id", "t1.city"} {
+		args.Masks = map[string]string{rule: "email"}
+		assert.NotNil(t, dumpTable(context.Background(), log, pool, conn, args, "test", "t1"), rule)
+	}
+
+	// The shuffle is refused above its limit.
+	many := &sqltypes.Result{Fields: fields[2:]}
+	for i := 0; i <= shuffleLimit; i++ {
+		many.Rows = append(many.Rows, cities.Rows[0])
+	}
+	fakedbs.AddQuery("select `city` from `test`.`t2`  order by `id` limit 100001", many)
+	_, err = shuffleValues(conn, "test", "t2", "city", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,261 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataFile = "metadata"
+
+	// incrementalDirFormat names the dump directories of the incremental runs,
+	// they sort by time.
+	incrementalDirFormat = "20060102150405"
+)
+
+// HighWaterMark is the range of the incremental column dumped for one table.
+// From is empty on the first run.
+type HighWaterMark struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Column   string `json:"column"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to"`
+}
+
+// Metadata is written to the metadata file of the dump directory.
+type Metadata struct {
+	mu             sync.Mutex
+	Started        string           `json:"started"`
+	Finished       string           `json:"finished,omitempty"`
+	Previous       string           `json:"previous,omitempty"`
+	Compression    string           `json:"compression,omitempty"`
+	Encryption     string           `json:"encryption,omitempty"`
+	KeyID          string           `json:"key_id,omitempty"`
+	HighWaterMarks []*HighWaterMark `json:"high_water_marks,omitempty"`
+
+	// MaxAllowedPacket is the packet the INSERT statements were kept under.
+	MaxAllowedPacket int `json:"max_allowed_packet,omitempty"`
+
+	// Interrupted is set by a canceled dump, Unfinished are its tables not dumped whole.
+	Interrupted bool     `json:"interrupted,omitempty"`
+	Unfinished  []string `json:"unfinished,omitempty"`
+}
+
+// NewMetadata creates the metadata of the dump started now.
+func NewMetadata() *Metadata {
+	return &Metadata{Started: time.Now().Format("2006-01-02 15:04:05")}
+}
+
+// Add records the high-water mark, replacing the one of the same table.
+func (m *Metadata) Add(mark *HighWaterMark) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, old := range m.HighWaterMarks {
+		if old.Database == mark.Database && old.Table == mark.Table {
+			m.HighWaterMarks[i] = mark
+			return
+		}
+	}
+	m.HighWaterMarks = append(m.HighWaterMarks, mark)
+}
+
+// AddUnfinished records the table not dumped whole.
+func (m *Metadata) AddUnfinished(database string, table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Unfinished = append(m.Unfinished, fmt.Sprintf("%s.%s", database, table))
+}
+
+// Lookup returns the high-water mark of the table, nil if not found.
+func (m *Metadata) Lookup(database string, table string) *HighWaterMark {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mark := range m.HighWaterMarks {
+		if mark.Database == database && mark.Table == table {
+			return mark
+		}
+	}
+	return nil
+}
+
+// Write writes the metadata file to the dump directory.
+func (m *Metadata) Write(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.Slice(m.HighWaterMarks, func(i, j int) bool {
+		a, b := m.HighWaterMarks[i], m.HighWaterMarks[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Table < b.Table
+	})
+	sort.Strings(m.Unfinished)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStorageFile(joinLocation(dir, metadataFile), string(data)+"\n")
+}
+
+// ReadMetadata reads the metadata file of the dump directory.
+func ReadMetadata(dir string) (*Metadata, error) {
+	data, err := readStorageFile(joinLocation(dir, metadataFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if len(data) == 0 {
+		return m, nil
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("metadata[%s].invalid:%v", dir, err)
+	}
+	return m, nil
+}
+
+// latestIncrementalDump returns the newest finished incremental dump under the base location,
+// empty if there is none.
+func latestIncrementalDump(base string) (string, *Metadata, error) {
+	files, err := listStorageFiles(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, nil
+		}
+		return "", nil, err
+	}
+
+	// The run dirs holding a metadata file.
+	var dirs []string
+	prefix := strings.TrimSuffix(base, "/") + "/"
+	for _, file := range files {
+		name := strings.TrimPrefix(file, prefix)
+		if path.Base(name) != metadataFile || path.Dir(name) == "." {
+			continue
+		}
+		dir := path.Dir(name)
+		if _, err := time.Parse(incrementalDirFormat, dir); err != nil {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := joinLocation(base, dirs[i])
+		m, err := ReadMetadata(dir)
+		if err != nil || m.Finished == "" {
+			// Unfinished run, its marks can't be trusted.
+			continue
+		}
+		return dir, m, nil
+	}
+	return "", nil, nil
+}
+
+// prepareIncremental moves the output to a new location under the base one
+// and loads the high-water marks of the previous run.
+func prepareIncremental(args *Args) error {
+	base := args.Outdir
+	prevDir, prev, err := latestIncrementalDump(base)
+	if err != nil {
+		return err
+	}
+
+	// The runs of the same second get the next free one.
+	now := time.Now()
+	dir := joinLocation(base, now.Format(incrementalDirFormat))
+	for prevDir != "" && dir <= prevDir {
+		now = now.Add(time.Second)
+		dir = joinLocation(base, now.Format(incrementalDirFormat))
+	}
+
+	args.Outdir = dir
+	args.Previous = prev
+	args.Metadata.Previous = prevDir
+	return nil
+}
+
+// incrementalWhere returns the condition of the rows newer than the previous run,
+// and the high-water mark reached by this one. The mark is nil if the table isn't incremental.
+func incrementalWhere(conn *Connection, args *Args, database string, table string) (string, *HighWaterMark, error) {
+	column, ok := args.Incrementals[table]
+	if !ok {
+		return "", nil, nil
+	}
+
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT MAX(`%s`) FROM `%s`.`%s`", column, database, table))
+	if err != nil {
+		return "", nil, err
+	}
+
+	mark := &HighWaterMark{Database: database, Table: table, Column: column}
+	if prev := args.Previous.Lookup(database, table); prev != nil && prev.Column == column {
+		mark.From = prev.To
+	}
+	if len(qr.Rows) == 0 || qr.Rows[0][0].IsNull() {
+		// Empty table, nothing new.
+		mark.To = mark.From
+		return "1 = 0", mark, nil
+	}
+	mark.To = qr.Rows[0][0].String()
+
+	where := fmt.Sprintf("`%s` <= \"%s\"", column, EscapeBytes([]byte(mark.To)))
+	if mark.From != "" {
+		where = fmt.Sprintf("`%s` > \"%s\" AND %s", column, EscapeBytes([]byte(mark.From)), where)
+	}
+	return where, mark, nil
+}
+
+// tableWhere returns the WHERE clause of the table dump, the [where] condition and the incremental range.
+func tableWhere(conn *Connection, args *Args, database string, table string) (string, *HighWaterMark) {
+	where := ""
+	v, ok := args.Wheres[table]
+	if sampled, found := args.Sampled[database+"."+table]; found {
+		v, ok = sampled.Where, sampled.Where != ""
+	}
+	if ok {
+		where = fmt.Sprintf(" WHERE %v", v)
+	}
+	incr, mark, err := incrementalWhere(conn, args, database, table)
+	AssertNil(err)
+	switch {
+	case incr == "":
+	case where == "":
+		where = " WHERE " + incr
+	default:
+		where = fmt.Sprintf(" WHERE (%v) AND %s", v, incr)
+	}
+	return where, mark
+}
+
+// carryHighWaterMarks keeps the previous marks of the tables which failed or weren't dumped by this run,
+// so the next run starts from them instead of dumping the whole table.
+func carryHighWaterMarks(args *Args) {
+	if args.Previous == nil {
+		return
+	}
+	for _, prev := range args.Previous.HighWaterMarks {
+		if args.Metadata.Lookup(prev.Database, prev.Table) == nil {
+			args.Metadata.Add(prev)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+	metricSummary = "summary"
+)
+
+// Metric is one metric family exposed with the Prometheus text format.
+type Metric struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	count       uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []*Metric
+)
+
+var (
+	// Dumper.
+	metricDumpedBytes   = newMetric("mydumper_dumped_bytes_total", "Bytes written to the dump files.", metricCounter, "database", "table")
+	metricDumpedRows    = newMetric("mydumper_dumped_rows_total", "Rows written to the dump files.", metricCounter, "database", "table")
+	metricChunksWritten = newMetric("mydumper_chunk_files_written_total", "Chunk files written.", metricCounter, "database", "table")
+
+	// Loader.
+	metricLoadedBytes  = newMetric("mydumper_loaded_bytes_total", "Bytes of the dump files loaded.", metricCounter, "database", "table")
+	metricLoadedRows   = newMetric("mydumper_loaded_rows_total", "Rows loaded, known from the manifest.", metricCounter, "database", "table")
+	metricChunksLoaded = newMetric("mydumper_chunk_files_loaded_total", "Chunk files loaded.", metricCounter, "database", "table")
+	metricDorisLoad    = newMetric("mydumper_doris_stream_load_seconds", "Latency of the Doris stream load requests.", metricSummary)
+	metricDorisFailed  = newMetric("mydumper_doris_stream_load_failures_total", "Failed Doris stream load requests.", metricCounter)
+
+	// Both.
+	metricConnBusy       = newMetric("mydumper_connection_busy_seconds_total", "Time the pool connection was taken by a worker.", metricCounter, "conn")
+	metricConnReconnects = newMetric("mydumper_connection_reconnects_total", "Pool connections reopened after being lost.", metricCounter)
+	metricPhase          = newMetric("mydumper_phase", "Current phase, 1 for the running one.", metricGauge, "phase")
+)
+
+func newMetric(name string, help string, kind string, labels ...string) *Metric {
+	m := &Metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+	metricsMu.Lock()
+	registry = append(registry, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func (m *Metric) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string{}, labelValues...)}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add used to add the value to the counter.
+func (m *Metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+// Set used to set the value of the gauge.
+func (m *Metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+// Observe used to record one observation of the summary.
+func (m *Metric) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	s.value += v
+	s.count++
+}
+
+// labelEscaper escapes the label values as the Prometheus text format, the UTF-8 is kept.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metric) labelString(s *metricSeries) string {
+	if len(m.labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(m.labels))
+	for i, l := range m.labels {
+		v := ""
+		if i < len(s.labelValues) {
+			v = s.labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, labelEscaper.Replace(v)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		labels := m.labelString(s)
+		value := strconv.FormatFloat(s.value, 'g', -1, 64)
+		if m.kind == metricSummary {
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, value)
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", m.name, labels, value)
+	}
+}
+
+// WriteMetrics writes all the metrics with the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+// SetPhase marks the phase as the running one.
+func SetPhase(phase string) {
+	metricPhase.mu.Lock()
+	for _, s := range metricPhase.series {
+		s.value = 0
+	}
+	metricPhase.get([]string{phase}).value = 1
+	metricPhase.mu.Unlock()
+}
+
+// currentPhase returns the running phase, empty before the first one.
+func currentPhase() string {
+	metricPhase.mu.Lock()
+	defer metricPhase.mu.Unlock()
+	for _, s := range metricPhase.series {
+		if s.value == 1 {
+			return s.labelValues[0]
+		}
+	}
+	return ""
+}
+
+// ServeMetrics starts the HTTP listener exposing the metrics at /metrics.
+func ServeMetrics(log *xlog.Log, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Error("metrics.serve.error:%v", err)
+		}
+	}()
+	log.Info("metrics.listening.on[%s]...", l.Addr())
+	return nil
+}
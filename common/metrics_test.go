@@ -0,0 +1,69 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetric("mydumper_test_total", "Test counter.", metricCounter, "database", "table")
+	m.Add(1, "db", "t1")
+	m.Add(2, "db", "t1")
+	m.Add(5, "db", `t"2`)
+	m.Add(1, "数据", "t\\3\n")
+
+	s := newMetric("mydumper_test_seconds", "Test summary.", metricSummary)
+	s.Observe(0.5)
+	s.Observe(1)
+
+	SetPhase("dumping.schema")
+	SetPhase("dumping.data")
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	got := buf.String()
+	assert.True(t, strings.Contains(got, "# TYPE mydumper_test_total counter\n"))
+	assert.True(t, strings.Contains(got, `mydumper_test_total{database="db",table="t1"} 3`+"\n"))
+	assert.True(t, strings.Contains(got, `mydumper_test_total{database="db",table="t\"2"} 5`+"\n"))
+	assert.True(t, strings.Contains(got, `mydumper_test_total{database="数据",table="t\\3\n"} 1`+"\n"))
+	assert.True(t, strings.Contains(got, "mydumper_test_seconds_sum 1.5\n"))
+	assert.True(t, strings.Contains(got, "mydumper_test_seconds_count 2\n"))
+	assert.True(t, strings.Contains(got, `mydumper_phase{phase="dumping.schema"} 0`+"\n"))
+	assert.True(t, strings.Contains(got, `mydumper_phase{phase="dumping.data"} 1`+"\n"))
+}
+
+func TestServeMetrics(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	err = ServeMetrics(log, addr)
+	assert.Nil(t, err)
+	metricChunksWritten.Add(1, "db", "served")
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(body), `mydumper_chunk_files_written_total{database="db",table="served"} 1`))
+}
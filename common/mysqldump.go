@@ -0,0 +1,329 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+const (
+	// defaultUnitSizeInMB is the size of one work unit when the chunk size is not set.
+	defaultUnitSizeInMB = 32
+)
+
+type stmtKind int
+
+const (
+	stmtOther stmtKind = iota
+	stmtInsert
+	stmtUse
+	stmtSession
+	stmtSchema
+	stmtSkip
+)
+
+// dumpUnit is a batch of INSERT statements of one table, loaded by one connection.
+type dumpUnit struct {
+	database string
+	table    string
+	part     int
+	querys   []string
+	bytes    int
+}
+
+// stripConditional unwraps the `/*!40101 ... */` conditional comments of the statement.
+func stripConditional(query string) string {
+	for {
+		start := strings.Index(query, "/*!")
+		if start == -1 {
+			return strings.TrimSpace(query)
+		}
+		end := strings.Index(query[start:], "*/")
+		if end == -1 {
+			return strings.TrimSpace(query)
+		}
+		end += start
+		body := strings.TrimLeft(query[start+3:end], "0123456789")
+		query = query[:start] + body + query[end+2:]
+	}
+}
+
+// quoteIdent quotes the identifier, the backquotes in it doubled.
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// parseIdent parses one identifier, quoted or not, and returns the rest of the text.
+func parseIdent(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t\r\n")
+	if strings.HasPrefix(s, "`") {
+		var name strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] == '`' {
+				if i+1 < len(s) && s[i+1] == '`' {
+					name.WriteByte('`')
+					i++
+					continue
+				}
+				return name.String(), s[i+1:]
+			}
+			name.WriteByte(s[i])
+		}
+		return name.String(), ""
+	}
+	end := strings.IndexAny(s, " \t\r\n(.;,")
+	if end == -1 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// parseTableName parses the `db`.`table` or `table` at the head of s.
+func parseTableName(s string) (string, string) {
+	first, rest := parseIdent(s)
+	if strings.HasPrefix(rest, ".") {
+		second, _ := parseIdent(rest[1:])
+		return first, second
+	}
+	return "", first
+}
+
+// trimKeywords removes the leading keywords (case-insensitive) from s.
+func trimKeywords(s string, keywords ...string) (string, bool) {
+	for _, kw := range keywords {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if len(s) < len(kw) || !strings.EqualFold(s[:len(kw)], kw) {
+			return s, false
+		}
+		s = s[len(kw):]
+	}
+	return s, true
+}
+
+// classifyStatement returns the kind of the statement and the database/table it refers to.
+func classifyStatement(query string) (stmtKind, string, string) {
+	query = stripConditional(query)
+	upper := strings.ToUpper(query)
+	switch {
+	case strings.HasPrefix(upper, "INSERT"), strings.HasPrefix(upper, "REPLACE"):
+		rest := query[strings.IndexAny(upper, " \t\r\n")+1:]
+		rest, _ = trimKeywords(rest, "LOW_PRIORITY")
+		rest, _ = trimKeywords(rest, "DELAYED")
+		rest, _ = trimKeywords(rest, "IGNORE")
+		rest, _ = trimKeywords(rest, "INTO")
+		db, table := parseTableName(rest)
+		return stmtInsert, db, table
+	case strings.HasPrefix(upper, "USE "), strings.HasPrefix(upper, "USE`"):
+		db, _ := parseIdent(query[3:])
+		return stmtUse, db, ""
+	case strings.HasPrefix(upper, "SET "):
+		return stmtSession, "", ""
+	case strings.HasPrefix(upper, "LOCK TABLES"), strings.HasPrefix(upper, "UNLOCK TABLES"):
+		return stmtSkip, "", ""
+	case strings.HasPrefix(upper, "ALTER TABLE") && (strings.HasSuffix(upper, "DISABLE KEYS") || strings.HasSuffix(upper, "ENABLE KEYS")):
+		return stmtSkip, "", ""
+	case strings.HasPrefix(upper, "CREATE DATABASE"), strings.HasPrefix(upper, "CREATE SCHEMA"):
+		rest, ok := trimKeywords(query, "CREATE", "DATABASE")
+		if !ok {
+			rest, _ = trimKeywords(query, "CREATE", "SCHEMA")
+		}
+		if r, ok := trimKeywords(rest, "IF", "NOT", "EXISTS"); ok {
+			rest = r
+		}
+		db, _ := parseIdent(rest)
+		return stmtSchema, db, ""
+	case strings.HasPrefix(upper, "CREATE TABLE"), strings.HasPrefix(upper, "DROP TABLE"):
+		rest := query[len("CREATE TABLE"):]
+		if strings.HasPrefix(upper, "DROP") {
+			rest = query[len("DROP TABLE"):]
+			if r, ok := trimKeywords(rest, "IF", "EXISTS"); ok {
+				rest = r
+			}
+		} else if r, ok := trimKeywords(rest, "IF", "NOT", "EXISTS"); ok {
+			rest = r
+		}
+		db, table := parseTableName(rest)
+		return stmtSchema, db, table
+	}
+	return stmtOther, "", ""
+}
+
+func restoreUnit(log *xlog.Log, unit *dumpUnit, sessions []string, conn *Connection, args *Args) int {
+	log.Info("restoring.tables[%s.%s].parts[%d].thread[%d]", unit.database, unit.table, unit.part, conn.ID)
+	if unit.database != "" {
+		err := conn.Execute("USE " + quoteIdent(unit.database))
+		AssertNil(err)
+	}
+	for _, session := range sessions {
+		err := conn.Execute(session)
+		AssertNil(err)
+	}
+	for _, query := range unit.querys {
+		args.Throttle.Wait(len(query), 0)
+		err := conn.Execute(query)
+		AssertNil(err)
+	}
+	log.Info("restoring.tables[%s.%s].parts[%d].thread[%d].done...", unit.database, unit.table, unit.part, conn.ID)
+	return unit.bytes
+}
+
+// LoadMysqldump used to load a single-file mysqldump output.
+// The file is split on the fly into per-table work units which are loaded in parallel,
+// schema statements are executed in order on a dedicated connection.
+// Once the context is done the file is read no further, the units in flight are loaded whole.
+func LoadMysqldump(ctx context.Context, log *xlog.Log, args *Args) error {
+	// One more connection for the schema statements, and one to poll the target load.
+	spare := 1
+	if adaptiveThrottle(args) {
+		spare = 2
+	}
+	pool, err := NewPool(log, args.Threads+spare, args.Address, args.User, args.Password, args.SessionVars, args.TLS)
+	AssertNil(err)
+	defer pool.Close()
+
+	args.Throttle = NewThrottle(log, args)
+	args.Throttle.Start(pool)
+	defer args.Throttle.Stop()
+
+	if args.Cipher == nil {
+		args.Cipher, err = LoadCipher(args.EncryptionKeyFile)
+		AssertNil(err)
+	}
+	r, closer, err := openDumpFile(args, args.DumpFile)
+	AssertNil(err)
+	defer closer.Close()
+
+	unitSize := args.ChunksizeInMB
+	if unitSize <= 0 {
+		unitSize = defaultUnitSizeInMB
+	}
+	unitSize = unitSize * 1024 * 1024
+
+	var wg sync.WaitGroup
+	var bytes uint64
+	var sessions []string
+	var unit *dumpUnit
+	parts := make(map[string]int)
+	database := args.Database
+	inHeader := true
+	t := time.Now()
+
+	tick := time.NewTicker(time.Millisecond * time.Duration(args.IntervalMs))
+	defer tick.Stop()
+	go func() {
+		for range tick.C {
+			diff := time.Since(t).Seconds()
+			bytes := float64(atomic.LoadUint64(&bytes) / 1024 / 1024)
+			rates := bytes / diff
+			log.Info("restoring.allbytes[%vMB].time[%.2fsec].rates[%.2fMB/sec]...", bytes, diff, rates)
+		}
+	}()
+
+	dispatch := func() {
+		if unit == nil {
+			return
+		}
+		conn := getConn(ctx, pool)
+		if conn == nil {
+			unit = nil
+			return
+		}
+		wg.Add(1)
+		go func(conn *Connection, unit *dumpUnit, sessions []string) {
+			status.begin(conn.ID, fmt.Sprintf("restoring.table[%s.%s].part[%d]", unit.database, unit.table, unit.part))
+			defer func() {
+				status.end(conn.ID)
+				wg.Done()
+				pool.Put(conn)
+			}()
+			r := restoreUnit(log, unit, sessions, conn, args)
+			atomic.AddUint64(&bytes, uint64(r))
+			metricLoadedBytes.Add(float64(r), unit.database, unit.table)
+			metricChunksLoaded.Add(1, unit.database, unit.table)
+		}(conn, unit, sessions)
+		unit = nil
+	}
+
+	ddl, err := pool.Get()
+	AssertNil(err)
+	defer pool.Put(ddl)
+	if database != "" {
+		err := ddl.Execute("USE " + quoteIdent(database))
+		AssertNil(err)
+	}
+
+	SetPhase("restoring.data")
+	scanner := NewSQLScanner(r)
+	for ctx.Err() == nil && scanner.Scan() {
+		query := scanner.Statement()
+		kind, db, table := classifyStatement(query)
+		if kind != stmtInsert {
+			dispatch()
+		}
+
+		switch kind {
+		case stmtInsert:
+			inHeader = false
+			if db == "" {
+				db = database
+			}
+			if unit != nil && (unit.database != db || unit.table != table || unit.bytes >= unitSize) {
+				dispatch()
+			}
+			if unit == nil {
+				key := db + "." + table
+				parts[key]++
+				unit = &dumpUnit{database: db, table: table, part: parts[key]}
+			}
+			unit.querys = append(unit.querys, query)
+			unit.bytes += len(query)
+			continue
+		case stmtSkip:
+			continue
+		case stmtUse:
+			database = db
+		case stmtSession:
+			if inHeader {
+				sessions = append(sessions, query)
+			}
+		case stmtSchema:
+			if table != "" {
+				inHeader = false
+				log.Info("restoring.schema[%s.%s]", database, table)
+			}
+		default:
+			// Triggers, views and routines must see all the rows loaded before them.
+			wg.Wait()
+		}
+		err := ddl.Execute(query)
+		AssertNil(err)
+		atomic.AddUint64(&bytes, uint64(len(query)))
+	}
+	AssertNil(scanner.Err())
+	dispatch()
+
+	wg.Wait()
+	elapsed := time.Since(t).Seconds()
+	if ctx.Err() != nil {
+		SetPhase("restoring.interrupted")
+		log.Warning("restoring.interrupted.cost[%.2fsec].allbytes[%.2fMB]", elapsed, float64(bytes/1024/1024))
+		return ctx.Err()
+	}
+	SetPhase("restoring.done")
+	log.Info("restoring.all.done.cost[%.2fsec].allbytes[%.2fMB].rate[%.2fMB/s]", elapsed, float64(bytes/1024/1024), (float64(bytes/1024/1024) / elapsed))
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+const mysqldumpSample = `-- MySQL dump 10.13  Distrib 5.7.30, for Linux (x86_64)
+--
+-- Host: localhost    Database: test
+-- ------------------------------------------------------
+
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET NAMES utf8 */;
+/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;
+
+CREATE DATABASE /*!32312 IF NOT EXISTS*/ ` + "`test`" + ` /*!40100 DEFAULT CHARACTER SET utf8 */;
+
+USE ` + "`test`" + `;
+
+--
+-- Table structure for table ` + "`t1`" + `
+--
+
+DROP TABLE IF EXISTS ` + "`t1`" + `;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+CREATE TABLE ` + "`t1`" + ` (
+  ` + "`a`" + ` int(11) DEFAULT NULL,
+  ` + "`b`" + ` varchar(100) DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+LOCK TABLES ` + "`t1`" + ` WRITE;
+/*!40000 ALTER TABLE ` + "`t1`" + ` DISABLE KEYS */;
+INSERT INTO ` + "`t1`" + ` VALUES (1,'a;b'),(2,'c\'d');
+INSERT INTO ` + "`t1`" + ` VALUES (3,'e');
+/*!40000 ALTER TABLE ` + "`t1`" + ` ENABLE KEYS */;
+UNLOCK TABLES;
+
+DELIMITER ;;
+/*!50003 CREATE*/ /*!50003 TRIGGER tr1 BEFORE INSERT ON t1 FOR EACH ROW BEGIN
+  SET NEW.a = NEW.a + 1;
+END */;;
+DELIMITER ;
+
+/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;
+-- Dump completed on 2020-06-01 10:00:00
+`
+
+func TestClassifyStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		kind  stmtKind
+		db    string
+		table string
+	}{
+		{"INSERT INTO `t1` VALUES (1)", stmtInsert, "", "t1"},
+		{"INSERT IGNORE INTO `db`.`t``1` VALUES (1)", stmtInsert, "db", "t`1"},
+		{"REPLACE INTO t2(a) VALUES (1)", stmtInsert, "", "t2"},
+		{"USE `test`", stmtUse, "test", ""},
+		{"/*!40101 SET NAMES utf8 */", stmtSession, "", ""},
+		{"LOCK TABLES `t1` WRITE", stmtSkip, "", ""},
+		{"/*!40000 ALTER TABLE `t1` DISABLE KEYS */", stmtSkip, "", ""},
+		{"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `test`", stmtSchema, "test", ""},
+		{"CREATE DATABASE IF NOT EXISTS `test`", stmtSchema, "test", ""},
+		{"DROP TABLE IF EXISTS `t1`", stmtSchema, "", "t1"},
+		{"CREATE TABLE `t1` (`a` int)", stmtSchema, "", "t1"},
+		{"/*!50003 CREATE*/ /*!50003 TRIGGER tr1 */", stmtOther, "", ""},
+	}
+	for _, tt := range tests {
+		kind, db, table := classifyStatement(tt.query)
+		assert.Equal(t, tt.kind, kind, tt.query)
+		assert.Equal(t, tt.db, db, tt.query)
+		assert.Equal(t, tt.table, table, tt.query)
+	}
+
+	// The quoted names parse back.
+	_, db, _ := classifyStatement("USE " + quoteIdent("te`st"))
+	assert.Equal(t, "te`st", db)
+}
+
+func TestLoadMysqldump(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("create database .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create table .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("drop table .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern(`/\*!.*`, &sqltypes.Result{})
+	}
+
+	// Plain and gzipped.
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(mysqldumpSample))
+	w.Close()
+	files := map[string][]byte{
+		"/tmp/mysqldumptest.sql":    []byte(mysqldumpSample),
+		"/tmp/mysqldumptest.sql.gz": gz.Bytes(),
+	}
+	for file, data := range files {
+		err := ioutil.WriteFile(file, data, 0644)
+		assert.Nil(t, err)
+		defer os.Remove(file)
+
+		args := &Args{
+			DumpFile:   file,
+			User:       "mock",
+			Password:   "mock",
+			Threads:    4,
+			Address:    address,
+			IntervalMs: 500,
+		}
+		assert.Nil(t, LoadMysqldump(context.Background(), log, args))
+	}
+	assert.Equal(t, 2, fakedbs.GetQueryCalledNum("insert into `t1` values (1,'a;b'),(2,'c\\'d')"))
+	assert.Equal(t, 2, fakedbs.GetQueryCalledNum("insert into `t1` values (3,'e')"))
+	assert.Equal(t, 0, fakedbs.GetQueryCalledNum("lock tables `t1` write"))
+}
@@ -0,0 +1,119 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// EscapeName encodes a database or table name so it is safe to use in a dump file name.
+// ASCII letters, digits, '_', '$' and '-' are kept, every other character
+// (including '.', '/' and non-ASCII) is written as '@' and four lowercase hex
+// digits of its UTF-16 code units. It only looks like MySQL's file name encoding,
+// which maps the characters by its own table, so the files of the escaped names
+// differ from MySQL's. Ordinary names keep the file names upstream mydumper uses.
+func EscapeName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if isPortable(r) {
+			b.WriteRune(r)
+			continue
+		}
+		for _, u := range utf16.Encode([]rune{r}) {
+			fmt.Fprintf(&b, "@%04x", u)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeName decodes the name encoded by EscapeName.
+func UnescapeName(s string) (string, error) {
+	if !strings.Contains(s, "@") {
+		return s, nil
+	}
+	units := make([]uint16, 0, len(s))
+	for i := 0; i < len(s); {
+		if s[i] != '@' {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			units = append(units, utf16.Encode([]rune{r})...)
+			i += size
+			continue
+		}
+		if i+5 > len(s) {
+			return "", fmt.Errorf("invalid escaped name:%s", s)
+		}
+		u, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+		if err != nil {
+			return "", fmt.Errorf("invalid escaped name:%s", s)
+		}
+		units = append(units, uint16(u))
+		i += 5
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+func isPortable(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r == '_', r == '$', r == '-':
+		return true
+	}
+	return false
+}
+
+// databaseSchemaFile returns the file name of the database create statement.
+func databaseSchemaFile(outdir string, database string) string {
+	return fmt.Sprintf("%s/%s%s", outdir, EscapeName(database), dbSuffix)
+}
+
+// tableSchemaFile returns the file name of the table create statement.
+func tableSchemaFile(outdir string, database string, table string) string {
+	return fmt.Sprintf("%s/%s.%s%s", outdir, EscapeName(database), EscapeName(table), schemaSuffix)
+}
+
+// tableDataFile returns the file name of the table chunk.
+func tableDataFile(outdir string, database string, table string, part int, suffix string) string {
+	return fmt.Sprintf("%s/%s.%s.%05d%s", outdir, EscapeName(database), EscapeName(table), part, suffix)
+}
+
+// parseDatabaseFile returns the database name of the database schema file.
+func parseDatabaseFile(file string) (string, error) {
+	return UnescapeName(strings.TrimSuffix(filepath.Base(file), dbSuffix))
+}
+
+// parseTableFile returns the database, table and part of the table schema or chunk file.
+// The part is "0" if the file name has none.
+func parseTableFile(file string, suffix string) (string, string, string, error) {
+	name := strings.TrimSuffix(filepath.Base(file), suffix)
+	splits := strings.Split(name, ".")
+	if len(splits) < 2 || len(splits) > 3 {
+		return "", "", "", fmt.Errorf("unexpected dump file name:%s", file)
+	}
+
+	db, err := UnescapeName(splits[0])
+	if err != nil {
+		return "", "", "", err
+	}
+	tbl, err := UnescapeName(splits[1])
+	if err != nil {
+		return "", "", "", err
+	}
+	part := "0"
+	if len(splits) == 3 {
+		part = splits[2]
+	}
+	return db, tbl, part, nil
+}
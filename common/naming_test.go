@@ -0,0 +1,81 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		escaped string
+	}{
+		{"t1-05-11", "t1-05-11"},
+		{"sbtest_$1", "sbtest_$1"},
+		{"v1.2_events", "v1@002e2_events"},
+		{"a/b", "a@002fb"},
+		{"a@b", "a@0040b"},
+		{"表", "@8868"},
+		{"😀", "@d83d@de00"},
+	}
+	for _, tt := range tests {
+		got := EscapeName(tt.name)
+		assert.Equal(t, tt.escaped, got)
+
+		name, err := UnescapeName(got)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.name, name)
+	}
+
+	{
+		_, err := UnescapeName("a@00")
+		assert.NotNil(t, err)
+		_, err = UnescapeName("a@zzzz")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestParseTableFile(t *testing.T) {
+	{
+		file := tableDataFile("/tmp", "my.db", "v1.2_events", 3, tableSuffix)
+		assert.Equal(t, "/tmp/my@002edb.v1@002e2_events.00003.sql", file)
+
+		db, tbl, part, err := parseTableFile(file, tableSuffix)
+		assert.Nil(t, err)
+		assert.Equal(t, "my.db", db)
+		assert.Equal(t, "v1.2_events", tbl)
+		assert.Equal(t, "00003", part)
+	}
+
+	{
+		file := tableSchemaFile("/tmp", "test", "t1-05-11")
+		assert.Equal(t, "/tmp/test.t1-05-11-schema.sql", file)
+
+		db, tbl, part, err := parseTableFile(file, schemaSuffix)
+		assert.Nil(t, err)
+		assert.Equal(t, "test", db)
+		assert.Equal(t, "t1-05-11", tbl)
+		assert.Equal(t, "0", part)
+	}
+
+	{
+		db, err := parseDatabaseFile(databaseSchemaFile("/tmp", "a/b"))
+		assert.Nil(t, err)
+		assert.Equal(t, "a/b", db)
+	}
+
+	{
+		_, _, _, err := parseTableFile("/tmp/a.b.c.d.sql", tableSuffix)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,612 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+// A minimal Parquet writer: flat schema, optional columns, one PLAIN encoded
+// uncompressed data page per column chunk.
+// See https://github.com/apache/parquet-format for the format.
+
+const (
+	parquetSuffix = ".parquet"
+	parquetMagic  = "PAR1"
+
+	// parquetRowGroupMB bounds the row groups when the chunk is larger.
+	parquetRowGroupMB = 64
+
+	parquetCreatedBy = "go-mydumper"
+)
+
+// Parquet physical types.
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Parquet converted types, -1 for none.
+const (
+	parquetNoConverted = -1
+	parquetUTF8        = 0
+	parquetDecimal     = 5
+	parquetDate        = 6
+	parquetUint8       = 11
+	parquetUint16      = 12
+	parquetUint32      = 13
+	parquetUint64      = 14
+	parquetInt8        = 15
+	parquetInt16       = 16
+	parquetInt32Conv   = 17
+	parquetInt64Conv   = 18
+	parquetJSON        = 19
+)
+
+// Parquet encodings.
+const (
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// Thrift compact protocol types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the Parquet metadata with the thrift compact protocol.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func (w *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf.Write(b[:n])
+}
+
+func (w *thriftWriter) zigzag(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	last := w.last[len(w.last)-1]
+	if delta := id - last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.zigzag(int64(id))
+	}
+	w.last[len(w.last)-1] = id
+}
+
+func (w *thriftWriter) structBegin() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) structEnd() {
+	w.buf.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *thriftWriter) structField(id int16) {
+	w.field(id, thriftStruct)
+	w.structBegin()
+}
+
+// emptyStruct writes the struct field without members, used by the unions.
+func (w *thriftWriter) emptyStruct(id int16) {
+	w.structField(id)
+	w.structEnd()
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.zigzag(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.zigzag(v)
+}
+
+func (w *thriftWriter) byte(id int16, v int8) {
+	w.field(id, thriftByte)
+	w.buf.WriteByte(byte(v))
+}
+
+func (w *thriftWriter) bool(id int16, v bool) {
+	if v {
+		w.field(id, thriftTrue)
+	} else {
+		w.field(id, thriftFalse)
+	}
+}
+
+func (w *thriftWriter) str(id int16, v string) {
+	w.field(id, thriftBinary)
+	w.varint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *thriftWriter) list(id int16, elem byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		w.buf.WriteByte(0xf0 | elem)
+		w.varint(uint64(n))
+	}
+}
+
+// parquetColumn is the schema of one column and the values buffered for the current row group.
+type parquetColumn struct {
+	name      string
+	mysqlType querypb.Type
+	physical  int32
+	converted int32
+	scale     int32
+	precision int32
+	// logical writes the LogicalType union of the schema element, nil if none.
+	logical func(w *thriftWriter)
+
+	levels []byte
+	values bytes.Buffer
+}
+
+func parquetIntType(bits int8, signed bool) func(w *thriftWriter) {
+	return func(w *thriftWriter) {
+		w.structField(10)
+		w.byte(1, bits)
+		w.bool(2, signed)
+		w.structEnd()
+	}
+}
+
+// newParquetColumn maps the MySQL column type to the Parquet physical and logical types.
+func newParquetColumn(f *querypb.Field) *parquetColumn {
+	c := &parquetColumn{name: f.Name, mysqlType: f.Type, physical: parquetByteArray, converted: parquetNoConverted}
+	switch f.Type {
+	case querypb.Type_INT8:
+		c.physical, c.converted, c.logical = parquetInt32, parquetInt8, parquetIntType(8, true)
+	case querypb.Type_UINT8:
+		c.physical, c.converted, c.logical = parquetInt32, parquetUint8, parquetIntType(8, false)
+	case querypb.Type_INT16:
+		c.physical, c.converted, c.logical = parquetInt32, parquetInt16, parquetIntType(16, true)
+	case querypb.Type_UINT16, querypb.Type_YEAR:
+		c.physical, c.converted, c.logical = parquetInt32, parquetUint16, parquetIntType(16, false)
+	case querypb.Type_INT24, querypb.Type_INT32:
+		c.physical, c.converted, c.logical = parquetInt32, parquetInt32Conv, parquetIntType(32, true)
+	case querypb.Type_UINT24, querypb.Type_UINT32:
+		c.physical, c.converted, c.logical = parquetInt32, parquetUint32, parquetIntType(32, false)
+	case querypb.Type_INT64:
+		c.physical, c.converted, c.logical = parquetInt64, parquetInt64Conv, parquetIntType(64, true)
+	case querypb.Type_UINT64:
+		c.physical, c.converted, c.logical = parquetInt64, parquetUint64, parquetIntType(64, false)
+	case querypb.Type_FLOAT32:
+		c.physical = parquetFloat
+	case querypb.Type_FLOAT64:
+		c.physical = parquetDouble
+	case querypb.Type_DECIMAL:
+		// The column length counts the sign and the point.
+		c.scale = int32(f.Decimals)
+		c.precision = int32(f.ColumnLength)
+		if f.Flags&uint32(querypb.MySqlFlag_UNSIGNED_FLAG) == 0 {
+			c.precision--
+		}
+		if c.scale > 0 {
+			c.precision--
+		}
+		if c.precision < c.scale || c.precision <= 0 {
+			c.precision = 65
+		}
+		c.converted = parquetDecimal
+		c.logical = func(w *thriftWriter) {
+			w.structField(10)
+			w.structField(5)
+			w.i32(1, c.scale)
+			w.i32(2, c.precision)
+			w.structEnd()
+			w.structEnd()
+		}
+	case querypb.Type_DATE:
+		c.physical, c.converted = parquetInt32, parquetDate
+		c.logical = func(w *thriftWriter) {
+			w.structField(10)
+			w.emptyStruct(6)
+			w.structEnd()
+		}
+	case querypb.Type_DATETIME, querypb.Type_TIMESTAMP:
+		// Wall clock micros, not adjusted to UTC, as MySQL returns them.
+		c.physical = parquetInt64
+		c.logical = func(w *thriftWriter) {
+			w.structField(10)
+			w.structField(8)
+			w.bool(1, false)
+			w.structField(2)
+			w.emptyStruct(2)
+			w.structEnd()
+			w.structEnd()
+			w.structEnd()
+		}
+	case querypb.Type_JSON:
+		c.converted = parquetJSON
+		c.logical = func(w *thriftWriter) {
+			w.structField(10)
+			w.emptyStruct(12)
+			w.structEnd()
+		}
+	case querypb.Type_VARCHAR, querypb.Type_CHAR, querypb.Type_TEXT, querypb.Type_ENUM, querypb.Type_SET, querypb.Type_TIME:
+		// TIME goes beyond the time of day, keep it as the MySQL string.
+		c.converted = parquetUTF8
+		c.logical = func(w *thriftWriter) {
+			w.structField(10)
+			w.emptyStruct(1)
+			w.structEnd()
+		}
+	}
+	return c
+}
+
+// parseDecimal returns the unscaled value of the decimal string.
+func parseDecimal(s string, scale int32) (*big.Int, error) {
+	digits := s
+	neg := strings.HasPrefix(digits, "-")
+	digits = strings.TrimLeft(digits, "+-")
+	frac := ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		digits, frac = digits[:i], digits[i+1:]
+	}
+	if len(frac) > int(scale) {
+		return nil, fmt.Errorf("parquet.decimal[%s].exceeds.scale[%d]", s, scale)
+	}
+	frac += strings.Repeat("0", int(scale)-len(frac))
+	n, ok := new(big.Int).SetString(digits+frac, 10)
+	if !ok {
+		return nil, fmt.Errorf("parquet.decimal[%s].invalid", s)
+	}
+	if neg {
+		n.Neg(n)
+	}
+	return n, nil
+}
+
+// decimalBytes returns the minimal big-endian two's complement of n.
+func decimalBytes(n *big.Int) []byte {
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	for k := len(n.Bytes()); ; k++ {
+		m := new(big.Int).Lsh(big.NewInt(1), uint(8*k))
+		m.Add(m, n)
+		b := m.Bytes()
+		if len(b) == k && b[0]&0x80 != 0 {
+			return b
+		}
+	}
+}
+
+const (
+	mysqlDateLayout     = "2006-01-02"
+	mysqlDatetimeLayout = "2006-01-02 15:04:05.999999"
+)
+
+// encode appends the PLAIN encoded value. It returns false for the zero dates,
+// which Parquet can't represent, to write them as NULL.
+func (c *parquetColumn) encode(v sqltypes.Value) (bool, error) {
+	s := v.ToString()
+	var b [8]byte
+	switch c.physical {
+	case parquetInt32:
+		var n int64
+		var err error
+		switch c.converted {
+		case parquetDate:
+			if strings.HasPrefix(s, "0000-00-00") {
+				return false, nil
+			}
+			t, err := time.ParseInLocation(mysqlDateLayout, s, time.UTC)
+			if err != nil {
+				return false, err
+			}
+			n = t.Unix() / 86400
+			if t.Unix()%86400 < 0 {
+				n--
+			}
+		case parquetUint8, parquetUint16, parquetUint32:
+			var u uint64
+			u, err = strconv.ParseUint(s, 10, 32)
+			n = int64(int32(uint32(u)))
+		default:
+			n, err = strconv.ParseInt(s, 10, 32)
+		}
+		if err != nil {
+			return false, err
+		}
+		binary.LittleEndian.PutUint32(b[:4], uint32(int32(n)))
+		c.values.Write(b[:4])
+	case parquetInt64:
+		var n int64
+		var err error
+		switch {
+		case c.mysqlType == querypb.Type_DATETIME || c.mysqlType == querypb.Type_TIMESTAMP:
+			if strings.HasPrefix(s, "0000-00-00") {
+				return false, nil
+			}
+			t, err := time.ParseInLocation(mysqlDatetimeLayout, s, time.UTC)
+			if err != nil {
+				return false, err
+			}
+			n = t.Unix()*1000000 + int64(t.Nanosecond()/1000)
+		case c.converted == parquetUint64:
+			var u uint64
+			u, err = strconv.ParseUint(s, 10, 64)
+			n = int64(u)
+		default:
+			n, err = strconv.ParseInt(s, 10, 64)
+		}
+		if err != nil {
+			return false, err
+		}
+		binary.LittleEndian.PutUint64(b[:], uint64(n))
+		c.values.Write(b[:])
+	case parquetFloat:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return false, err
+		}
+		binary.LittleEndian.PutUint32(b[:4], math.Float32bits(float32(f)))
+		c.values.Write(b[:4])
+	case parquetDouble:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false, err
+		}
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+		c.values.Write(b[:])
+	default:
+		raw := v.Raw()
+		if c.converted == parquetDecimal {
+			n, err := parseDecimal(s, c.scale)
+			if err != nil {
+				return false, err
+			}
+			raw = decimalBytes(n)
+		}
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(raw)))
+		c.values.Write(b[:4])
+		c.values.Write(raw)
+	}
+	return true, nil
+}
+
+// encodeLevels encodes the definition levels with the RLE hybrid encoding, prefixed by the length.
+func (c *parquetColumn) encodeLevels() []byte {
+	var w thriftWriter
+	for i := 0; i < len(c.levels); {
+		j := i
+		for j < len(c.levels) && c.levels[j] == c.levels[i] {
+			j++
+		}
+		w.varint(uint64(j-i) << 1)
+		w.buf.WriteByte(c.levels[i])
+		i = j
+	}
+	out := make([]byte, 4, 4+w.buf.Len())
+	binary.LittleEndian.PutUint32(out, uint32(w.buf.Len()))
+	return append(out, w.buf.Bytes()...)
+}
+
+type parquetChunkMeta struct {
+	offset int64
+	size   int64
+}
+
+type parquetRowGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetChunkMeta
+}
+
+// ParquetWriter builds one Parquet file in memory.
+type ParquetWriter struct {
+	buf           bytes.Buffer
+	columns       []*parquetColumn
+	rowGroups     []parquetRowGroup
+	rowGroupBytes int
+	rows          int64
+	pendingRows   int64
+	pendingBytes  int
+}
+
+// NewParquetWriter creates the writer of the fields, flushing the row groups every rowGroupBytes.
+func NewParquetWriter(fields []*querypb.Field, rowGroupBytes int) *ParquetWriter {
+	w := &ParquetWriter{rowGroupBytes: rowGroupBytes}
+	for _, f := range fields {
+		w.columns = append(w.columns, newParquetColumn(f))
+	}
+	w.buf.WriteString(parquetMagic)
+	return w
+}
+
+// Write buffers the row and returns the encoded size.
+func (w *ParquetWriter) Write(row []sqltypes.Value) (int, error) {
+	if len(row) != len(w.columns) {
+		return 0, fmt.Errorf("parquet.row.columns[%d].mismatch.schema[%d]", len(row), len(w.columns))
+	}
+	size := 0
+	for i, v := range row {
+		c := w.columns[i]
+		before := c.values.Len()
+		defined := false
+		if v.Raw() != nil {
+			var err error
+			if defined, err = c.encode(v); err != nil {
+				return 0, fmt.Errorf("parquet.column[%s].value[%s]:%v", c.name, v.ToString(), err)
+			}
+		}
+		if defined {
+			c.levels = append(c.levels, 1)
+		} else {
+			c.levels = append(c.levels, 0)
+		}
+		size += c.values.Len() - before + 1
+	}
+	w.pendingRows++
+	w.pendingBytes += size
+	if w.pendingBytes >= w.rowGroupBytes {
+		w.flushRowGroup()
+	}
+	return size, nil
+}
+
+// Size returns the bytes of the file so far, including the buffered rows.
+func (w *ParquetWriter) Size() int {
+	return w.buf.Len() + w.pendingBytes
+}
+
+// Rows returns the rows written.
+func (w *ParquetWriter) Rows() int64 {
+	return w.rows + w.pendingRows
+}
+
+func (w *ParquetWriter) flushRowGroup() {
+	if w.pendingRows == 0 {
+		return
+	}
+	rg := parquetRowGroup{rows: w.pendingRows}
+	for _, c := range w.columns {
+		levels := c.encodeLevels()
+		pageSize := len(levels) + c.values.Len()
+
+		var h thriftWriter
+		h.structBegin()
+		h.i32(1, 0) // DATA_PAGE
+		h.i32(2, int32(pageSize))
+		h.i32(3, int32(pageSize))
+		h.structField(5)
+		h.i32(1, int32(w.pendingRows))
+		h.i32(2, parquetPlain)
+		h.i32(3, parquetRLE)
+		h.i32(4, parquetRLE)
+		h.structEnd()
+		h.structEnd()
+
+		meta := parquetChunkMeta{offset: int64(w.buf.Len()), size: int64(h.buf.Len() + pageSize)}
+		w.buf.Write(h.buf.Bytes())
+		w.buf.Write(levels)
+		w.buf.Write(c.values.Bytes())
+		rg.columns = append(rg.columns, meta)
+		rg.size += meta.size
+
+		c.levels = c.levels[:0]
+		c.values.Reset()
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+	w.rows += w.pendingRows
+	w.pendingRows = 0
+	w.pendingBytes = 0
+}
+
+// Bytes flushes the buffered rows, writes the footer and returns the file.
+// The writer can't be used after.
+func (w *ParquetWriter) Bytes() []byte {
+	w.flushRowGroup()
+
+	var m thriftWriter
+	m.structBegin()
+	m.i32(1, 1)
+	m.list(2, thriftStruct, len(w.columns)+1)
+	// Root.
+	m.structBegin()
+	m.str(4, "schema")
+	m.i32(5, int32(len(w.columns)))
+	m.structEnd()
+	for _, c := range w.columns {
+		m.structBegin()
+		m.i32(1, c.physical)
+		m.i32(3, 1) // OPTIONAL
+		m.str(4, c.name)
+		if c.converted != parquetNoConverted {
+			m.i32(6, c.converted)
+		}
+		if c.converted == parquetDecimal {
+			m.i32(7, c.scale)
+			m.i32(8, c.precision)
+		}
+		if c.logical != nil {
+			c.logical(&m)
+		}
+		m.structEnd()
+	}
+	m.i64(3, w.rows)
+	m.list(4, thriftStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		m.structBegin()
+		m.list(1, thriftStruct, len(rg.columns))
+		for i, cm := range rg.columns {
+			c := w.columns[i]
+			m.structBegin()
+			m.i64(2, cm.offset)
+			m.structField(3)
+			m.i32(1, c.physical)
+			m.list(2, thriftI32, 2)
+			m.zigzag(parquetPlain)
+			m.zigzag(parquetRLE)
+			m.list(3, thriftBinary, 1)
+			m.varint(uint64(len(c.name)))
+			m.buf.WriteString(c.name)
+			m.i32(4, 0) // UNCOMPRESSED
+			m.i64(5, rg.rows)
+			m.i64(6, cm.size)
+			m.i64(7, cm.size)
+			m.i64(9, cm.offset)
+			m.structEnd()
+			m.structEnd()
+		}
+		m.i64(2, rg.size)
+		m.i64(3, rg.rows)
+		m.structEnd()
+	}
+	m.str(6, parquetCreatedBy)
+	m.structEnd()
+
+	w.buf.Write(m.buf.Bytes())
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(m.buf.Len()))
+	w.buf.Write(n[:])
+	w.buf.WriteString(parquetMagic)
+	return w.buf.Bytes()
+}
@@ -0,0 +1,319 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// thriftReader decodes the thrift compact structs into maps keyed by the field id.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	u := r.varint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftTrue:
+		return true
+	case thriftFalse:
+		return false
+	case thriftByte:
+		r.pos++
+		return int64(int8(r.b[r.pos-1]))
+	case 4, thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.varint())
+		r.pos += n
+		return string(r.b[r.pos-n : r.pos])
+	case thriftList:
+		h := r.b[r.pos]
+		r.pos++
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.varint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	panic("thrift.type.unsupported")
+}
+
+func (r *thriftReader) structure() map[int]interface{} {
+	m := make(map[int]interface{})
+	last := 0
+	for {
+		h := r.b[r.pos]
+		r.pos++
+		if h == 0 {
+			return m
+		}
+		id := last + int(h>>4)
+		if h>>4 == 0 {
+			id = int(r.zigzag())
+		}
+		last = id
+		m[id] = r.value(h & 0x0f)
+	}
+}
+
+type thriftStructs = map[int]interface{}
+
+// readParquetColumn returns the values of the column in all the row groups, nil for NULL.
+func readParquetColumn(t *testing.T, data []byte, meta thriftStructs, col int) [][]byte {
+	var out [][]byte
+	for _, rg := range meta[4].([]interface{}) {
+		chunk := rg.(thriftStructs)[1].([]interface{})[col].(thriftStructs)[3].(thriftStructs)
+		physical := chunk[1].(int64)
+		r := &thriftReader{b: data, pos: int(chunk[9].(int64))}
+		header := r.structure()
+		page := data[r.pos : r.pos+int(header[3].(int64))]
+		num := int(header[5].(thriftStructs)[1].(int64))
+
+		// Definition levels.
+		n := int(binary.LittleEndian.Uint32(page))
+		lr := &thriftReader{b: page[4 : 4+n]}
+		var levels []byte
+		for lr.pos < n {
+			run := int(lr.varint() >> 1)
+			for i := 0; i < run; i++ {
+				levels = append(levels, lr.b[lr.pos])
+			}
+			lr.pos++
+		}
+		assert.Equal(t, num, len(levels))
+
+		values := page[4+n:]
+		for _, l := range levels {
+			if l == 0 {
+				out = append(out, nil)
+				continue
+			}
+			size := 0
+			switch physical {
+			case parquetInt32, parquetFloat:
+				size = 4
+			case parquetInt64, parquetDouble:
+				size = 8
+			default:
+				size = int(binary.LittleEndian.Uint32(values))
+				values = values[4:]
+			}
+			out = append(out, values[:size])
+			values = values[size:]
+		}
+		assert.Equal(t, 0, len(values))
+	}
+	return out
+}
+
+func readParquetFooter(t *testing.T, data []byte) thriftStructs {
+	assert.Equal(t, parquetMagic, string(data[:4]))
+	assert.Equal(t, parquetMagic, string(data[len(data)-4:]))
+	n := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	r := &thriftReader{b: data[len(data)-8-n : len(data)-8]}
+	return r.structure()
+}
+
+func TestParquetWriter(t *testing.T) {
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "big", Type: querypb.Type_UINT64},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+		{Name: "amount", Type: querypb.Type_DECIMAL, ColumnLength: 12, Decimals: 2},
+		{Name: "created", Type: querypb.Type_DATETIME},
+		{Name: "day", Type: querypb.Type_DATE},
+		{Name: "ratio", Type: querypb.Type_FLOAT64},
+	}
+	rows := [][]sqltypes.Value{
+		{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+			sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("18446744073709551615")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("a\"b")),
+			sqltypes.MakeTrusted(querypb.Type_DECIMAL, []byte("-12.5")),
+			sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte("1970-01-01 00:00:01.000002")),
+			sqltypes.MakeTrusted(querypb.Type_DATE, []byte("1969-12-31")),
+			sqltypes.MakeTrusted(querypb.Type_FLOAT64, []byte("0.5")),
+		},
+		{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("-2")),
+			sqltypes.NULL,
+			sqltypes.NULL,
+			sqltypes.MakeTrusted(querypb.Type_DECIMAL, []byte("1234.56")),
+			sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte("0000-00-00 00:00:00")),
+			sqltypes.NULL,
+			sqltypes.NULL,
+		},
+	}
+
+	// A tiny row group to get one per row.
+	w := NewParquetWriter(fields, 1)
+	for _, row := range rows {
+		_, err := w.Write(row)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int64(2), w.Rows())
+	data := w.Bytes()
+
+	meta := readParquetFooter(t, data)
+	assert.Equal(t, int64(2), meta[3])
+	assert.Equal(t, 2, len(meta[4].([]interface{})))
+	schema := meta[2].([]interface{})
+	assert.Equal(t, len(fields)+1, len(schema))
+
+	amount := schema[4].(thriftStructs)
+	assert.Equal(t, "amount", amount[4])
+	assert.Equal(t, int64(parquetByteArray), amount[1])
+	assert.Equal(t, int64(parquetDecimal), amount[6])
+	assert.Equal(t, int64(2), amount[7])
+	assert.Equal(t, int64(10), amount[8])
+
+	// TIMESTAMP(isAdjustedToUTC=false, MICROS).
+	created := schema[5].(thriftStructs)
+	ts := created[10].(thriftStructs)[8].(thriftStructs)
+	assert.Equal(t, false, ts[1])
+	assert.NotNil(t, ts[2].(thriftStructs)[2])
+
+	ids := readParquetColumn(t, data, meta, 0)
+	assert.Equal(t, int32(1), int32(binary.LittleEndian.Uint32(ids[0])))
+	assert.Equal(t, int32(-2), int32(binary.LittleEndian.Uint32(ids[1])))
+
+	bigs := readParquetColumn(t, data, meta, 1)
+	assert.Equal(t, uint64(math.MaxUint64), binary.LittleEndian.Uint64(bigs[0]))
+	assert.Nil(t, bigs[1])
+
+	names := readParquetColumn(t, data, meta, 2)
+	assert.Equal(t, []byte("a\"b"), names[0])
+	assert.Nil(t, names[1])
+
+	// -1250 and 123456, big-endian two's complement.
+	amounts := readParquetColumn(t, data, meta, 3)
+	assert.Equal(t, []byte{0xfb, 0x1e}, amounts[0])
+	assert.Equal(t, []byte{0x01, 0xe2, 0x40}, amounts[1])
+
+	// The zero date has no Parquet value.
+	times := readParquetColumn(t, data, meta, 4)
+	assert.Equal(t, int64(1000002), int64(binary.LittleEndian.Uint64(times[0])))
+	assert.Nil(t, times[1])
+
+	days := readParquetColumn(t, data, meta, 5)
+	assert.Equal(t, int32(-1), int32(binary.LittleEndian.Uint32(days[0])))
+
+	ratios := readParquetColumn(t, data, meta, 6)
+	assert.Equal(t, 0.5, math.Float64frombits(binary.LittleEndian.Uint64(ratios[0])))
+
+	// The decimal must fit the scale.
+	w = NewParquetWriter(fields[3:4], 1024)
+	_, err := w.Write([]sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_DECIMAL, []byte("1.234"))})
+	assert.NotNil(t, err)
+}
+
+func TestDumperParquet(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "id", Type: querypb.Type_INT32},
+			{Name: "name", Type: querypb.Type_VARCHAR},
+		},
+	}
+	for i := 0; i < 1000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("11")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("xx")),
+		})
+	}
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Table", Type: querypb.Type_VARCHAR},
+			{Name: "Create Table", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`id` int(11) NOT NULL,`name` varchar(10)) ENGINE=InnoDB")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	args := &Args{
+		Mode:          "parquet",
+		Database:      "test",
+		Table:         "t1",
+		Outdir:        "/tmp/dumpertest-parquet",
+		User:          "mock",
+		Password:      "mock",
+		Address:       address,
+		ChunksizeInMB: 1,
+		Threads:       2,
+		StmtSize:      10000,
+		IntervalMs:    500,
+	}
+	os.RemoveAll(args.Outdir)
+	defer os.RemoveAll(args.Outdir)
+	assert.Nil(t, os.MkdirAll(args.Outdir, 0777))
+
+	assert.Nil(t, Dumper(context.Background(), log, args))
+
+	data, err := ioutil.ReadFile(args.Outdir + "/test.t1.00001.parquet")
+	assert.Nil(t, err)
+	meta := readParquetFooter(t, data)
+	assert.Equal(t, int64(1000), meta[3])
+	names := readParquetColumn(t, data, meta, 1)
+	assert.Equal(t, []byte("xx"), names[999])
+
+	manifest, err := ReadManifest(args.Outdir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), manifest.Lookup(args.Outdir+"/test.t1.00001.parquet").Rows)
+
+	// The parquet chunks are verified, though not loadable.
+	assert.Nil(t, VerifyDump(log, args.Outdir, 2))
+	assert.Nil(t, ioutil.WriteFile(args.Outdir+"/test.t1.00001.parquet", data[1:], 0644))
+	assert.NotNil(t, VerifyDump(log, args.Outdir, 2))
+}
@@ -0,0 +1,308 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// TablePlan is the dry-run plan of one table.
+// The rows and bytes are the estimates of information_schema, or the manifest for the loader.
+type TablePlan struct {
+	Database string
+	Table    string
+	Engine   string
+	Rows     uint64
+	Bytes    uint64
+	Chunks   int
+	Rules    []string
+}
+
+// DumpPlan is what Dumper would do with the args, without writing anything.
+type DumpPlan struct {
+	Outdir        string
+	Mode          string
+	Threads       int
+	ChunksizeInMB int
+	Compress      bool
+	Tables        []*TablePlan
+}
+
+// LoadPlan is what Loader would do with the dump directory, without loading anything.
+type LoadPlan struct {
+	Outdir      string
+	Mode        string
+	Threads     int
+	Overwrite   bool
+	Verify      bool
+	Manifest    bool
+	Interrupted bool
+	Databases   []string
+	Tables      []*TablePlan
+}
+
+// tableRules returns the where/select/filter/incremental rules and the size overrides of the table.
+func tableRules(args *Args, table string) []string {
+	var rules []string
+	if where, ok := args.Wheres[table]; ok {
+		rules = append(rules, fmt.Sprintf("where[%s]", where))
+	}
+	for _, column := range sortedKeys(args.Selects[table]) {
+		rules = append(rules, fmt.Sprintf("select[%s=%s]", column, args.Selects[table][column]))
+	}
+	if filters := sortedKeys(args.Filters[table]); len(filters) > 0 {
+		rules = append(rules, fmt.Sprintf("filter[%s]", strings.Join(filters, ",")))
+	}
+	if column, ok := args.Incrementals[table]; ok {
+		rules = append(rules, fmt.Sprintf("incremental[%s]", column))
+	}
+	if sizes, ok := args.TableSizes[table]; ok {
+		if sizes.ChunksizeInMB > 0 {
+			rules = append(rules, fmt.Sprintf("chunksize[%dMB]", sizes.ChunksizeInMB))
+		}
+		if sizes.ChunkRows != nil {
+			rules = append(rules, fmt.Sprintf("chunkrows[%d]", *sizes.ChunkRows))
+		}
+		if sizes.StmtSize > 0 {
+			rules = append(rules, fmt.Sprintf("stmtsize[%d]", sizes.StmtSize))
+		}
+	}
+	return rules
+}
+
+// tableEstimates returns the engine, rows and data length of the tables of the database,
+// by information_schema.
+func tableEstimates(conn *Connection, database string) (map[string]*TablePlan, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT TABLE_NAME, ENGINE, TABLE_ROWS, DATA_LENGTH FROM information_schema.TABLES WHERE TABLE_SCHEMA = '%s'", database))
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Fields) != 4 {
+		return nil, fmt.Errorf("information_schema.tables.unexpected.columns[%d]", len(qr.Fields))
+	}
+	estimates := make(map[string]*TablePlan, len(qr.Rows))
+	for _, row := range qr.Rows {
+		t := &TablePlan{Database: database, Table: row[0].String(), Engine: row[1].String()}
+		// NULL for the views.
+		t.Rows, _ = strconv.ParseUint(row[2].String(), 10, 64)
+		t.Bytes, _ = strconv.ParseUint(row[3].String(), 10, 64)
+		estimates[t.Table] = t
+	}
+	return estimates, nil
+}
+
+// PlanDump resolves the databases and tables as Dumper does and estimates their chunks
+// and disk usage by information_schema, nothing is written.
+func PlanDump(log *xlog.Log, args *Args) (*DumpPlan, error) {
+	pool, err := NewPool(log, 1, args.Address, args.User, args.Password, args.SessionVars, args.TLS)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Put(conn)
+
+	databases := dumpDatabases(log, conn, args)
+	if err := checkTableOptions(log, conn, args, databases); err != nil {
+		return nil, err
+	}
+	if err := prepareSamples(log, conn, args, databases); err != nil {
+		return nil, err
+	}
+
+	plan := &DumpPlan{
+		Outdir:        args.Outdir,
+		Mode:          args.Mode,
+		Threads:       args.Threads,
+		ChunksizeInMB: args.ChunksizeInMB,
+		Compress:      args.Compress,
+	}
+	for _, database := range databases {
+		estimates, err := tableEstimates(conn, database)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range dumpTables(log, conn, args, database) {
+			t, ok := estimates[table]
+			if !ok {
+				t = &TablePlan{Database: database, Table: table}
+			}
+			t.Chunks = planChunks(tableChunking(args, table), t)
+			t.Rules = tableRules(args, table)
+			if sampled, ok := args.Sampled[database+"."+table]; ok {
+				t.Rules = append(t.Rules, fmt.Sprintf("sample[%s]", sampled.Via))
+			}
+			plan.Tables = append(plan.Tables, t)
+		}
+	}
+	return plan, nil
+}
+
+// planChunks returns the chunks of the estimated table, by its rows or bytes.
+func planChunks(sizes chunking, t *TablePlan) int {
+	switch {
+	case t.Bytes == 0:
+		return 0
+	case sizes.chunkRows > 0 && t.Rows == 0:
+		return 1
+	case sizes.chunkRows > 0:
+		return int((t.Rows + uint64(sizes.chunkRows) - 1) / uint64(sizes.chunkRows))
+	case sizes.chunkBytes > 0:
+		return int((t.Bytes + uint64(sizes.chunkBytes) - 1) / uint64(sizes.chunkBytes))
+	}
+	return 1
+}
+
+// Write prints the plan.
+func (p *DumpPlan) Write(w io.Writer) error {
+	var rows, bytes uint64
+	var chunks int
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tTABLE\tENGINE\tROWS\tSIZE\tCHUNKS\tRULES")
+	for _, t := range p.Tables {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\t%s\n", t.Database, t.Table, t.Engine, t.Rows, planSize(t.Bytes), t.Chunks, strings.Join(t.Rules, " "))
+		rows += t.Rows
+		bytes += t.Bytes
+		chunks += t.Chunks
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	mode := p.Mode
+	if mode == "" {
+		mode = "mysql"
+	}
+	fmt.Fprintf(w, "\ndry-run: %d tables, about %d rows, %s in %d chunks of %dMB, to %s with %d threads, %s mode.\n",
+		len(p.Tables), rows, planSize(bytes), chunks, p.ChunksizeInMB, p.Outdir, p.Threads, mode)
+	note := "The rows and sizes are the information_schema estimates of the whole tables, the where rules dump fewer"
+	if p.Compress {
+		note += ", the compression writes less"
+	}
+	_, err := fmt.Fprintln(w, note+".")
+	return err
+}
+
+// PlanLoad lists the dump directory as Loader does and sums the manifest per table, nothing is loaded.
+func PlanLoad(log *xlog.Log, args *Args) (*LoadPlan, error) {
+	files := loadFiles(log, args.Outdir)
+	plan := &LoadPlan{
+		Outdir:    args.Outdir,
+		Mode:      args.Mode,
+		Threads:   args.Threads,
+		Overwrite: args.OverwriteTables,
+		Verify:    !args.SkipVerify,
+	}
+	if m, err := ReadMetadata(args.Outdir); err == nil {
+		plan.Interrupted = m.Interrupted || len(m.Unfinished) > 0
+	}
+	m, err := ReadManifest(args.Outdir)
+	if err == nil {
+		plan.Manifest = true
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, file := range files.databases {
+		database, err := parseDatabaseFile(file)
+		if err != nil {
+			return nil, err
+		}
+		plan.Databases = append(plan.Databases, database)
+	}
+	sort.Strings(plan.Databases)
+
+	tables := make(map[string]*TablePlan)
+	for _, file := range files.tables {
+		database, table, _, err := parseTableFile(file, filepath.Ext(file))
+		if err != nil {
+			return nil, err
+		}
+		key := database + "." + table
+		t, ok := tables[key]
+		if !ok {
+			t = &TablePlan{Database: database, Table: table}
+			tables[key] = t
+			plan.Tables = append(plan.Tables, t)
+		}
+		t.Chunks++
+		if m != nil {
+			if entry := m.Lookup(file); entry != nil {
+				t.Rows += entry.Rows
+				t.Bytes += uint64(entry.Size)
+			}
+		}
+	}
+	sort.Slice(plan.Tables, func(i, j int) bool {
+		a, b := plan.Tables[i], plan.Tables[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Table < b.Table
+	})
+	return plan, nil
+}
+
+// Write prints the plan.
+func (p *LoadPlan) Write(w io.Writer) error {
+	var rows, bytes uint64
+	var chunks int
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tTABLE\tROWS\tSIZE\tCHUNKS")
+	for _, t := range p.Tables {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\n", t.Database, t.Table, t.Rows, planSize(t.Bytes), t.Chunks)
+		rows += t.Rows
+		bytes += t.Bytes
+		chunks += t.Chunks
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	mode := p.Mode
+	if mode == "" {
+		mode = "mysql"
+	}
+	fmt.Fprintf(w, "\ndry-run: %d databases, %d tables, %d rows, %s in %d chunks, from %s with %d threads, %s mode.\n",
+		len(p.Databases), len(p.Tables), rows, planSize(bytes), chunks, p.Outdir, p.Threads, mode)
+	if p.Overwrite {
+		fmt.Fprintln(w, "The tables are dropped and created again before the load.")
+	}
+	switch {
+	case !p.Manifest:
+		fmt.Fprintln(w, "No manifest: the files are not verified, the rows and sizes are unknown.")
+	case p.Verify:
+		fmt.Fprintln(w, "The files are verified against the manifest before the load.")
+	}
+	if p.Interrupted {
+		fmt.Fprintln(w, "The dump was interrupted or has unfinished tables, the load is refused unless -allow-unfinished is given.")
+	}
+	return nil
+}
+
+// planSize returns the bytes in MB, or KB under 1MB.
+func planSize(bytes uint64) string {
+	if bytes < 1024*1024 {
+		return fmt.Sprintf("%dKB", (bytes+1023)/1024)
+	}
+	return fmt.Sprintf("%dMB", bytes/1024/1024)
+}
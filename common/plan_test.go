@@ -0,0 +1,139 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestPlanDump(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	tablesResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Tables_in_test", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t2"))},
+		},
+	}
+	columnsResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Field", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("id"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("name"))},
+		},
+	}
+	estimatesResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "TABLE_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "ENGINE", Type: querypb.Type_VARCHAR},
+			{Name: "TABLE_ROWS", Type: querypb.Type_UINT64},
+			{Name: "DATA_LENGTH", Type: querypb.Type_UINT64},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("InnoDB")),
+				sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("100000")),
+				sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("300000000")),
+			},
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t2")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("InnoDB")),
+				sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("0")),
+				sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("0")),
+			},
+		},
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("show tables from .*", tablesResult)
+		fakedbs.AddQueryPattern("show columns from .*", columnsResult)
+		fakedbs.AddQueryPattern("select table_name, engine, table_rows, data_length from information_schema.tables .*", estimatesResult)
+	}
+
+	args := &Args{
+		Database:      "test",
+		Outdir:        "/tmp/dumpertest.plan",
+		User:          "mock",
+		Password:      "mock",
+		Address:       server.Addr(),
+		Threads:       4,
+		ChunksizeInMB: 128,
+		Wheres:        map[string]string{"t1": "id > 5"},
+		Selects:       map[string]map[string]string{"t1": {"name": "'x'"}},
+		Filters:       map[string]map[string]string{"t2": {"name": "ignore"}},
+	}
+	os.RemoveAll(args.Outdir)
+
+	plan, err := PlanDump(log, args)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(plan.Tables))
+	assert.Equal(t, &TablePlan{Database: "test", Table: "t1", Engine: "InnoDB", Rows: 100000, Bytes: 300000000, Chunks: 3, Rules: []string{"where[id > 5]", "select[name='x']"}}, plan.Tables[0])
+	assert.Equal(t, &TablePlan{Database: "test", Table: "t2", Engine: "InnoDB", Rules: []string{"filter[name]"}}, plan.Tables[1])
+
+	var out bytes.Buffer
+	assert.Nil(t, plan.Write(&out))
+	assert.True(t, strings.Contains(out.String(), "2 tables, about 100000 rows, 286MB in 3 chunks of 128MB"))
+
+	// Nothing written.
+	_, err = os.Stat(args.Outdir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPlanLoad(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	dir, err := ioutil.TempDir("", "plan")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	args := &Args{Outdir: dir, Threads: 8, OverwriteTables: true, Manifest: NewManifest()}
+	files := []struct {
+		file string
+		data string
+		rows uint64
+	}{
+		{databaseSchemaFile(dir, "test"), "CREATE DATABASE IF NOT EXISTS `test`;", 0},
+		{tableSchemaFile(dir, "test", "t1"), "CREATE TABLE `t1` (`a` int);\n", 0},
+		{tableDataFile(dir, "test", "t1", 1, tableSuffix), "INSERT INTO `t1`(`a`) VALUES\n(1),\n(2);\n", 2},
+		{tableDataFile(dir, "test", "t1", 2, tableSuffix), "INSERT INTO `t1`(`a`) VALUES\n(3);\n", 1},
+	}
+	for _, f := range files {
+		assert.Nil(t, writeDumpFile(args, f.file, f.data, "test", "t1", f.rows))
+	}
+	assert.Nil(t, args.Manifest.Write(dir))
+
+	plan, err := PlanLoad(log, args)
+	assert.Nil(t, err)
+	assert.True(t, plan.Manifest)
+	assert.Equal(t, []string{"test"}, plan.Databases)
+	assert.Equal(t, 1, len(plan.Tables))
+	assert.Equal(t, &TablePlan{Database: "test", Table: "t1", Rows: 3, Bytes: uint64(len(files[2].data) + len(files[3].data)), Chunks: 2}, plan.Tables[0])
+
+	var out bytes.Buffer
+	assert.Nil(t, plan.Write(&out))
+	assert.True(t, strings.Contains(out.String(), "1 databases, 1 tables, 3 rows, 1KB in 2 chunks"))
+	assert.True(t, strings.Contains(out.String(), "dropped and created again"))
+}
@@ -10,8 +10,13 @@
 package common
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xelabs/go-mysqlstack/driver"
 	"github.com/xelabs/go-mysqlstack/xlog"
@@ -19,11 +24,45 @@ import (
 	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
 )
 
+var (
+	// ErrPoolClosed is returned by Get once the pool is closed.
+	ErrPoolClosed = errors.New("pool.closed")
+
+	// ErrPoolExhausted is returned by Get once every connection is lost for good.
+	ErrPoolExhausted = errors.New("pool.all.connections.lost")
+)
+
+// poolOptions are the retries of the lost connections and the keepalive of the idle ones.
+type poolOptions struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	keepalive  time.Duration
+}
+
+// poolDefaults retry for about 30 seconds, the backoff doubles up to 10 seconds.
+var poolDefaults = poolOptions{
+	retries:    8,
+	backoff:    200 * time.Millisecond,
+	maxBackoff: 10 * time.Second,
+	keepalive:  30 * time.Second,
+}
+
 // Pool tuple.
+// A lost connection is reopened in the background with an exponential backoff, the pool runs
+// degraded with the others meanwhile. The connection is dropped after the retries, Get fails
+// once all are dropped.
 type Pool struct {
 	mu    sync.RWMutex
 	log   *xlog.Log
 	conns chan *Connection
+	done  chan struct{}
+	dead  chan struct{}
+	wg    sync.WaitGroup
+
+	// slots are the connections open or reopening.
+	slots int32
+	opts  poolOptions
 }
 
 // Connection tuple.
@@ -34,6 +73,9 @@ type Connection struct {
 	user     string
 	password string
 	vars     string
+	tls      *TLSOptions
+	taken    time.Time
+	idle     time.Time
 }
 
 // Execute used to executes the query.
@@ -51,85 +93,248 @@ func (conn *Connection) StreamFetch(query string) (driver.Rows, error) {
 	return conn.client.Query(query)
 }
 
-// NewPool creates the new pool.
-func NewPool(log *xlog.Log, cap int, address string, user string, password string, vars string) (*Pool, error) {
-	conns := make(chan *Connection, cap)
+// open dials the connection and sets the session variables.
+func (conn *Connection) open() error {
+	client, err := dialConn(conn.address, conn.user, conn.password, conn.tls)
+	if err != nil {
+		return err
+	}
+	conn.client = client
+	if conn.vars != "" {
+		varSp := strings.Split(conn.vars, ";")
+		for _, v := range varSp {
+			if err := conn.Execute(v); err != nil {
+				client.Close()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (conn *Connection) close() {
+	if conn.client != nil && !conn.client.Closed() {
+		conn.client.Close()
+	}
+}
+
+// NewPool creates the new pool, the address is host:port or unix:/path/to/socket.
+// The first connection is retried, it fails the pool. The others which fail are reopened
+// in the background, the pool starts degraded.
+func NewPool(log *xlog.Log, cap int, address string, user string, password string, vars string, tls *TLSOptions) (*Pool, error) {
+	p := &Pool{
+		log:   log,
+		conns: make(chan *Connection, cap),
+		done:  make(chan struct{}),
+		dead:  make(chan struct{}),
+		slots: int32(cap),
+		opts:  poolDefaults,
+	}
+
 	for i := 0; i < cap; i++ {
-		client, err := driver.NewConn(user, password, address, "", "utf8")
-		if err != nil {
-			return nil, err
+		conn := &Connection{ID: i, address: address, user: user, password: password, vars: vars, tls: tls}
+		if i == 0 {
+			if err := p.retry(conn); err != nil {
+				return nil, err
+			}
+			conn.idle = time.Now()
+			p.conns <- conn
+			continue
 		}
-		conn := &Connection{ID: i, client: client, address: address, user: user, password: password, vars: vars}
-		if vars != "" {
-			varSp := strings.Split(vars, ";")
-			for _, v := range varSp {
-				if err := conn.Execute(v); err != nil {
-					return nil, err
-				}
+		if err := conn.open(); err != nil {
+			log.Warning("pool.conn[%d].open.error[%v].retry.in.background", i, err)
+			p.revive(conn)
+			continue
+		}
+		conn.idle = time.Now()
+		p.conns <- conn
+	}
+
+	p.wg.Add(1)
+	go p.keepaliveLoop()
+	return p, nil
+}
+
+// retry opens the connection with the exponential backoff until the retries run out or the pool closes.
+func (p *Pool) retry(conn *Connection) error {
+	backoff := p.opts.backoff
+	var err error
+	for i := 0; ; i++ {
+		if err = conn.open(); err == nil {
+			return nil
+		}
+		if i+1 >= p.opts.retries {
+			return err
+		}
+		p.log.Warning("pool.conn[%d].open.error[%v].retry[%d/%d].in[%v]", conn.ID, err, i+1, p.opts.retries, backoff)
+		select {
+		case <-p.done:
+			return ErrPoolClosed
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > p.opts.maxBackoff {
+			backoff = p.opts.maxBackoff
+		}
+	}
+}
+
+// revive reopens the lost connection in the background, it's dropped if the retries run out.
+func (p *Pool) revive(conn *Connection) {
+	conn.close()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := p.retry(conn); err != nil {
+			if err != ErrPoolClosed {
+				p.log.Error("pool.conn[%d].lost.error[%v]", conn.ID, err)
+			}
+			if atomic.AddInt32(&p.slots, -1) == 0 {
+				close(p.dead)
 			}
+			return
 		}
-		conns <- conn
+		metricConnReconnects.Add(1)
+		p.log.Warning("pool.conn[%d].reopened", conn.ID)
+		conn.idle = time.Now()
+		p.put(conn)
+	}()
+}
+
+// Renew reopens the connection of the caller after an error, with the retries of the pool.
+func (p *Pool) Renew(conn *Connection) error {
+	conn.close()
+	if err := p.retry(conn); err != nil {
+		return err
 	}
+	metricConnReconnects.Add(1)
+	return nil
+}
 
-	return &Pool{
-		log:   log,
-		conns: conns,
-	}, nil
+// Get used to get one connection from the pool, it waits until one is free.
+func (p *Pool) Get() (*Connection, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetTimeout is Get giving up after the timeout.
+func (p *Pool) GetTimeout(timeout time.Duration) (*Connection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.GetContext(ctx)
 }
 
-// Get used to get one connection from the pool.
-func (p *Pool) Get() *Connection {
+// GetContext used to get one connection from the pool, until the context is done.
+// A connection failing the ping is reopened at once, or in the background while the next one is taken.
+func (p *Pool) GetContext(ctx context.Context) (*Connection, error) {
 	conns := p.getConns()
 	if conns == nil {
-		return nil
+		return nil, ErrPoolClosed
 	}
-	conn := <-conns
-	// 检查链接是否有效
-	if err := conn.client.Ping(); err != nil {
-		p.log.Warning("current conn[%d].client is invalid, renew...", conn.ID)
-		if !conn.client.Closed() {
-			conn.client.Close()
-		}
-		// 生成新的client
-		client, err := driver.NewConn(conn.user, conn.password, conn.address, "", "utf8")
-		if err != nil {
-			panic(err)
+	for {
+		var conn *Connection
+		var ok bool
+		select {
+		case conn, ok = <-conns:
+			if !ok {
+				return nil, ErrPoolClosed
+			}
+		case <-p.dead:
+			return nil, ErrPoolExhausted
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		conn.client = client // update
-		if conn.vars != "" {
-			varSp := strings.Split(conn.vars, ";")
-			for _, v := range varSp {
-				if err := conn.Execute(v); err != nil {
-					panic(err)
-				}
+
+		if err := conn.client.Ping(); err != nil {
+			p.log.Warning("pool.conn[%d].ping.error[%v].renew...", conn.ID, err)
+			conn.close()
+			if err := conn.open(); err != nil {
+				p.revive(conn)
+				continue
 			}
+			metricConnReconnects.Add(1)
 		}
+		conn.taken = time.Now()
+		return conn, nil
 	}
-
-	return conn
 }
 
 // Put used to put one connection to the pool.
 func (p *Pool) Put(conn *Connection) {
+	if !conn.taken.IsZero() {
+		metricConnBusy.Add(time.Since(conn.taken).Seconds(), strconv.Itoa(conn.ID))
+		conn.taken = time.Time{}
+	}
+	conn.idle = time.Now()
+	p.put(conn)
+}
+
+// put returns the connection to the pool, or closes it if the pool is closed.
+func (p *Pool) put(conn *Connection) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
 	if p.conns == nil {
+		conn.close()
 		return
 	}
 	p.conns <- conn
 }
 
+// keepaliveLoop pings the connections idle for the keepalive, before the server or a
+// firewall drops them.
+func (p *Pool) keepaliveLoop() {
+	defer p.wg.Done()
+	tick := time.NewTicker(p.opts.keepalive / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-tick.C:
+		}
+
+		conns := p.getConns()
+		if conns == nil {
+			return
+		}
+		for i := len(conns); i > 0; i-- {
+			var conn *Connection
+			select {
+			case conn = <-conns:
+			default:
+			}
+			if conn == nil {
+				break
+			}
+			if time.Since(conn.idle) >= p.opts.keepalive {
+				if err := conn.client.Ping(); err != nil {
+					p.log.Warning("pool.conn[%d].keepalive.error[%v]", conn.ID, err)
+					p.revive(conn)
+					continue
+				}
+				conn.idle = time.Now()
+			}
+			p.put(conn)
+		}
+	}
+}
+
 // Close used to close the pool and the connections.
 func (p *Pool) Close() {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
+	if p.conns == nil {
+		p.mu.Unlock()
+		return
+	}
+	close(p.done)
 	close(p.conns)
 	for conn := range p.conns {
-		conn.client.Close()
+		conn.close()
 	}
 	p.conns = nil
+	p.mu.Unlock()
+
+	// The background retries end with the done.
+	p.wg.Wait()
 }
 
 func (p *Pool) getConns() chan *Connection {
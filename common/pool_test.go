@@ -10,7 +10,11 @@
 package common
 
 import (
+	"context"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -33,7 +37,7 @@ func TestPool(t *testing.T) {
 		fakedbs.AddQueryPattern("select .*", &sqltypes.Result{})
 	}
 
-	pool, err := NewPool(log, 8, address, "mock", "mock", "")
+	pool, err := NewPool(log, 8, address, "mock", "mock", "", nil)
 	assert.Nil(t, err)
 
 	var wg sync.WaitGroup
@@ -48,8 +52,9 @@ func TestPool(t *testing.T) {
 				case <-ch1:
 					return
 				default:
-					conn := pool.Get()
-					err := conn.Execute("select 1")
+					conn, err := pool.Get()
+					assert.Nil(t, err)
+					err = conn.Execute("select 1")
 					assert.Nil(t, err)
 
 					_, err = conn.Fetch("select 1")
@@ -73,7 +78,8 @@ func TestPool(t *testing.T) {
 				case <-ch2:
 					return
 				default:
-					conn := pool.Get()
+					conn, err := pool.Get()
+					assert.Nil(t, err)
 					conn.Execute("select 2")
 					assert.Nil(t, err)
 
@@ -96,3 +102,216 @@ func TestPool(t *testing.T) {
 
 	wg.Wait()
 }
+
+// fastPool shortens the retries and the keepalive of the pools created until the restore.
+func fastPool(retries int) func() {
+	saved := poolDefaults
+	poolDefaults = poolOptions{
+		retries:    retries,
+		backoff:    10 * time.Millisecond,
+		maxBackoff: 20 * time.Millisecond,
+		keepalive:  100 * time.Millisecond,
+	}
+	return func() { poolDefaults = saved }
+}
+
+// testProxy is the flaky link to the server: its connections can be cut, at once or after
+// some bytes from the server, and the new ones refused beyond the limit.
+type testProxy struct {
+	mu       sync.Mutex
+	ln       net.Listener
+	limit    int
+	accepted int
+	conns    []net.Conn
+	budget   int64
+}
+
+func newTestProxy(t *testing.T, upstream string) *testProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	p := &testProxy{ln: ln, limit: -1}
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			if p.limit >= 0 && p.accepted >= p.limit {
+				p.mu.Unlock()
+				client.Close()
+				continue
+			}
+			server, err := net.Dial("tcp", upstream)
+			if err != nil {
+				p.mu.Unlock()
+				client.Close()
+				continue
+			}
+			p.accepted++
+			p.conns = append(p.conns, client, server)
+			p.mu.Unlock()
+			go func() {
+				io.Copy(server, client)
+				server.Close()
+			}()
+			go p.forward(client, server)
+		}
+	}()
+	return p
+}
+
+// forward copies the server bytes to the client, until the budget runs out.
+func (p *testProxy) forward(client net.Conn, server net.Conn) {
+	defer client.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := server.Read(buf)
+		if n > 0 {
+			if atomic.LoadInt64(&p.budget) > 0 && atomic.AddInt64(&p.budget, -int64(n)) <= 0 {
+				p.cut()
+				return
+			}
+			if _, err := client.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// cutAfter cuts all the connections once the server sent the bytes.
+func (p *testProxy) cutAfter(bytes int64) {
+	atomic.StoreInt64(&p.budget, bytes)
+}
+
+func (p *testProxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// setLimit limits the accepted connections from now on, -1 is unlimited.
+func (p *testProxy) setLimit(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+	p.accepted = 0
+}
+
+func (p *testProxy) getAccepted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+// cut closes the open connections.
+func (p *testProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *testProxy) Close() {
+	p.ln.Close()
+	p.cut()
+}
+
+// waitFor polls the condition for up to 2 seconds.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestPoolReconnect(t *testing.T) {
+	defer fastPool(3)()
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	fakedbs.AddQueryPattern("select .*", &sqltypes.Result{})
+
+	proxy := newTestProxy(t, server.Addr())
+	defer proxy.Close()
+	pool, err := NewPool(log, 3, proxy.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	// The lost connection is reopened by Get.
+	proxy.setLimit(-1)
+	proxy.cut()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	_, err = conn.Fetch("select 1")
+	assert.Nil(t, err)
+	pool.Put(conn)
+
+	// The idle ones by the keepalive, without any Get.
+	assert.True(t, waitFor(func() bool { return proxy.getAccepted() == 3 }))
+
+	// Get waits for a free one until the context is done.
+	var taken []*Connection
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get()
+		assert.Nil(t, err)
+		taken = append(taken, conn)
+	}
+	_, err = pool.GetTimeout(50 * time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	for _, conn := range taken {
+		pool.Put(conn)
+	}
+
+	// All lost for good: Get fails instead of hanging or panicking.
+	proxy.setLimit(0)
+	proxy.cut()
+	_, err = pool.GetTimeout(5 * time.Second)
+	assert.Equal(t, ErrPoolExhausted, err)
+
+	pool.Close()
+	_, err = pool.Get()
+	assert.Equal(t, ErrPoolClosed, err)
+}
+
+func TestPoolDegraded(t *testing.T) {
+	defer fastPool(50)()
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	fakedbs.AddQueryPattern("select .*", &sqltypes.Result{})
+
+	proxy := newTestProxy(t, server.Addr())
+	defer proxy.Close()
+
+	// Nothing to connect to.
+	proxy.setLimit(0)
+	_, err = NewPool(log, 2, proxy.Addr(), "mock", "mock", "", nil)
+	assert.NotNil(t, err)
+
+	// One connection of three: the pool runs with it.
+	proxy.setLimit(1)
+	pool, err := NewPool(log, 3, proxy.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	assert.Equal(t, 1, len(pool.getConns()))
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	_, err = conn.Fetch("select 1")
+	assert.Nil(t, err)
+	pool.Put(conn)
+
+	// The others join once the server is back.
+	proxy.setLimit(-1)
+	assert.True(t, waitFor(func() bool { return len(pool.getConns()) == 3 }))
+}
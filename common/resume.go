@@ -0,0 +1,247 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/xelabs/go-mysqlstack/sqldb"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// tableRetries is how many times a table scan is resumed after the transient errors.
+const tableRetries = 5
+
+// errThrottlePaused stops the scan at a chunk end while the throttle is paused, it resumes after.
+var errThrottlePaused = errors.New("throttle.paused")
+
+// transientErrors are the server errors of a lost or killed connection.
+var transientErrors = map[uint16]bool{
+	1053: true, // ER_SERVER_SHUTDOWN
+	1317: true, // ER_QUERY_INTERRUPTED
+	1927: true, // ER_CONNECTION_KILLED
+	2006: true, // CR_SERVER_GONE_ERROR
+	2013: true, // CR_SERVER_LOST
+}
+
+// transientError returns true if the error is of the network, not of the query, so
+// the scan may go on with a new connection.
+func transientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if sqlErr, ok := err.(*sqldb.SQLError); ok {
+		return transientErrors[sqlErr.Num]
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// resumeKey returns the positions of the primary key columns in the dumped fields, nil if the
+// table has no primary key or some of its columns are filtered out or replaced by [select].
+func resumeKey(log *xlog.Log, conn *Connection, args *Args, database string, table string, fields []string) []int {
+	columns, err := primaryKey(conn, database, table)
+	if err != nil {
+		log.Warning("dumping.table[%s.%s].primary.key.error[%v].no.resume", database, table, err)
+		return nil
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	var key []int
+	for _, column := range columns {
+		if _, ok := args.Selects[table][strings.Trim(column, "`")]; ok {
+			return nil
+		}
+		pos := -1
+		for i, f := range fields {
+			if f == column {
+				pos = i
+			}
+		}
+		if pos < 0 {
+			return nil
+		}
+		key = append(key, pos)
+	}
+	return key
+}
+
+// keyValues copies the key values of the row, the row buffer is reused by the cursor.
+func keyValues(row []sqltypes.Value, key []int) []sqltypes.Value {
+	values := make([]sqltypes.Value, len(key))
+	for i, pos := range key {
+		v := row[pos]
+		values[i] = sqltypes.MakeTrusted(v.Type(), append([]byte(nil), v.Raw()...))
+	}
+	return values
+}
+
+// keyLiteral returns the value as a SQL literal.
+func keyLiteral(v sqltypes.Value) string {
+	switch {
+	case v.IsNull():
+		return "NULL"
+	case v.IsSigned(), v.IsUnsigned(), v.IsFloat(), v.IsIntegral(), v.Type() == querypb.Type_DECIMAL:
+		return v.String()
+	}
+	return fmt.Sprintf("\"%s\"", EscapeBytes(v.Raw()))
+}
+
+// keysetWhere returns the WHERE clause of the rows after the last key, in the key order:
+// (a, b) > (x, y) as a > x OR (a = x AND b > y), which the optimizer turns into a range.
+func keysetWhere(where string, columns []string, last []sqltypes.Value) string {
+	if len(last) == 0 {
+		return where
+	}
+	var ors []string
+	for i := range columns {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, fmt.Sprintf("%s = %s", columns[j], keyLiteral(last[j])))
+		}
+		ands = append(ands, fmt.Sprintf("%s > %s", columns[i], keyLiteral(last[i])))
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	cond := strings.Join(ors, " OR ")
+	if where == "" {
+		return " WHERE " + cond
+	}
+	return fmt.Sprintf(" WHERE (%s) AND (%s)", strings.TrimPrefix(where, " WHERE "), cond)
+}
+
+// tableScan is the progress of the scans of a table, kept across the resumes: the chunks go on
+// with the next number after the key of the last written one.
+type tableScan struct {
+	key      []int
+	columns  []string
+	lastKey  []sqltypes.Value
+	fileNo   int
+	files    []string
+	allRows  uint64
+	allBytes uint64
+}
+
+// newTableScan returns the scan of the table, ordered by its primary key if it has one in the fields.
+func newTableScan(log *xlog.Log, conn *Connection, args *Args, database string, table string, fields []string) *tableScan {
+	s := &tableScan{fileNo: 1}
+	s.key = resumeKey(log, conn, args, database, table, fields)
+	for _, pos := range s.key {
+		s.columns = append(s.columns, fields[pos])
+	}
+	return s
+}
+
+// query returns the query of the rows after the last written key.
+func (s *tableScan) query(selects []string, database string, table string, where string) string {
+	order := ""
+	if s.key != nil {
+		order = " ORDER BY " + strings.Join(s.columns, ",")
+	}
+	return fmt.Sprintf("SELECT %s FROM `%s`.`%s` %s%s", strings.Join(selects, ", "), database, table, keysetWhere(where, s.columns, s.lastKey), order)
+}
+
+// rowKey returns the key of the row, nil without key.
+func (s *tableScan) rowKey(row []sqltypes.Value) []sqltypes.Value {
+	if s.key == nil {
+		return nil
+	}
+	return keyValues(row, s.key)
+}
+
+// written records the chunk file ending at the key.
+func (s *tableScan) written(file string, key []sqltypes.Value) {
+	s.files = append(s.files, file)
+	if key != nil {
+		s.lastKey = key
+	}
+	s.fileNo++
+}
+
+// paused returns true if the scan should stop at the chunk end for the throttle pause.
+func (s *tableScan) paused(args *Args) bool {
+	return s.key != nil && args.Throttle.Paused()
+}
+
+// run runs the scan until it ends. The scan returns the rows and bytes not written to a chunk on
+// error, they are taken off the counters. On a transient error the connection is renewed and the
+// scan resumes after the last key, or from scratch without key, the written chunks are removed.
+// On errThrottlePaused the cursor is closed during the pause. The context stops the retries.
+func (s *tableScan) run(ctx context.Context, log *xlog.Log, pool *Pool, conn *Connection, args *Args, database string, table string, scan func() (uint64, uint64, error)) error {
+	for retry := 1; ; retry++ {
+		args.Throttle.Pause()
+		lostRows, lostBytes, err := scan()
+		if err == nil {
+			return nil
+		}
+		s.allRows -= lostRows
+		s.allBytes -= lostBytes
+		atomic.AddUint64(&args.Allrows, ^(lostRows - 1))
+		atomic.AddUint64(&args.Allbytes, ^(lostBytes - 1))
+		if ctx.Err() != nil {
+			// The rest of the result is not read, the connection can't be reused.
+			conn.close()
+			log.Warning("dumping.table[%s.%s].interrupted.after.part[%d]", database, table, s.fileNo-1)
+			return ctx.Err()
+		}
+		if err == errThrottlePaused {
+			// The rest of the result is not read, the cursor would outlast the pause.
+			conn.close()
+			log.Info("dumping.table[%s.%s].throttle.paused.after.part[%d]...", database, table, s.fileNo-1)
+			args.Throttle.Pause()
+			if err := pool.Renew(conn); err != nil {
+				return err
+			}
+			log.Info("dumping.table[%s.%s].resume.part[%v].after%v", database, table, s.fileNo, s.lastKey)
+			retry--
+			continue
+		}
+		if retry > tableRetries || !transientError(err) {
+			// The rest of the result may be unread, the connection can't be reused.
+			conn.close()
+			return err
+		}
+
+		log.Warning("dumping.table[%s.%s].error[%v].retry[%d/%d]...", database, table, err, retry, tableRetries)
+		if err := pool.Renew(conn); err != nil {
+			return err
+		}
+		if s.key == nil {
+			// No key to resume from, the written chunks are dumped again.
+			for _, file := range s.files {
+				if err := removeStorageFile(file); err != nil {
+					return err
+				}
+				if args.Manifest != nil {
+					args.Manifest.Remove(file)
+				}
+			}
+			atomic.AddUint64(&args.Allrows, ^(s.allRows - 1))
+			atomic.AddUint64(&args.Allbytes, ^(s.allBytes - 1))
+			s.files, s.fileNo, s.allRows, s.allBytes = nil, 1, 0, 0
+		} else {
+			log.Info("dumping.table[%s.%s].resume.part[%v].after%v", database, table, s.fileNo, s.lastKey)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/sqldb"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+func TestKeysetWhere(t *testing.T) {
+	columns := []string{"`a`", "`b`"}
+	last := []sqltypes.Value{
+		sqltypes.MakeTrusted(querypb.Type_INT64, []byte("3")),
+		sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("x\"y")),
+	}
+
+	assert.Equal(t, " WHERE c = 1", keysetWhere(" WHERE c = 1", columns, nil))
+	assert.Equal(t, " WHERE (`a` > 3) OR (`a` = 3 AND `b` > \"x\\\"y\")", keysetWhere("", columns, last))
+	assert.Equal(t, " WHERE (c = 1 OR d = 2) AND ((`a` > 3))", keysetWhere(" WHERE c = 1 OR d = 2", columns[:1], last[:1]))
+}
+
+func TestTransientError(t *testing.T) {
+	assert.True(t, transientError(io.EOF))
+	assert.True(t, transientError(sqldb.NewSQLError(2013, "lost")))
+	assert.False(t, transientError(sqldb.NewSQLError(1146, "no such table")))
+	assert.False(t, transientError(errors.New("syntax")))
+	assert.False(t, transientError(nil))
+}
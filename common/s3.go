@@ -0,0 +1,439 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Scheme = "s3://"
+
+	// The parts of a multipart upload are at least 5MB, but the last one.
+	s3MinPartSizeMB     = 5
+	s3DefaultPartSizeMB = 16
+	s3DefaultRegion     = "us-east-1"
+)
+
+// S3Storage is an S3-compatible object store, addressed path-style
+// so MinIO and the other stand-ins work without DNS.
+type S3Storage struct {
+	endpoint     string
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	partSize     int
+	client       *http.Client
+}
+
+// NewS3Storage creates the storage of the bucket.
+func NewS3Storage(endpoint string, region string, bucket string, accessKey string, secretKey string) *S3Storage {
+	return &S3Storage{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partSize:  s3DefaultPartSizeMB * 1024 * 1024,
+		client:    &http.Client{Timeout: 600 * time.Second},
+	}
+}
+
+func s3Region() string {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+	}
+	return s3DefaultRegion
+}
+
+func s3Endpoint() string {
+	if v := os.Getenv("MYDUMPER_S3_ENDPOINT"); v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	return fmt.Sprintf("https://s3.%s.amazonaws.com", s3Region())
+}
+
+// NewS3StorageFromEnv creates the storage of the bucket configured by the environment:
+// MYDUMPER_S3_ENDPOINT (default AWS), AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN and MYDUMPER_S3_PART_SIZE_MB.
+func NewS3StorageFromEnv(bucket string) (*S3Storage, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("s3.bucket[%s].credentials.missing:AWS_ACCESS_KEY_ID.and.AWS_SECRET_ACCESS_KEY.must.be.set", bucket)
+	}
+	s := NewS3Storage(s3Endpoint(), s3Region(), bucket, accessKey, secretKey)
+	s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if v := os.Getenv("MYDUMPER_S3_PART_SIZE_MB"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < s3MinPartSizeMB {
+			return nil, fmt.Errorf("s3.part.size[%s].must.be.at.least[%dMB]", v, s3MinPartSizeMB)
+		}
+		s.partSize = mb * 1024 * 1024
+	}
+	return s, nil
+}
+
+// splitS3Location splits s3://bucket/key.
+func splitS3Location(location string) (string, string) {
+	rest := strings.TrimPrefix(location, s3Scheme)
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return rest[:i], strings.TrimLeft(rest[i+1:], "/")
+	}
+	return rest, ""
+}
+
+func (s *S3Storage) key(file string) (string, error) {
+	bucket, key := splitS3Location(file)
+	if bucket != s.bucket {
+		return "", fmt.Errorf("s3.location[%s].not.in.bucket[%s]", file, s.bucket)
+	}
+	return key, nil
+}
+
+// s3Escape is the URI encoding of SigV4, the path keeps its slashes.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs the request with AWS Signature Version 4, the host and all the headers are signed.
+// The payload hash and the x-amz-date header must be set.
+func signV4(req *http.Request, accessKey string, secretKey string, region string, now time.Time) {
+	date := now.UTC().Format("20060102")
+
+	names := []string{"host"}
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "authorization" {
+			continue
+		}
+		names = append(names, name)
+		headers[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", req.Header.Get("X-Amz-Date"), scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// do sends the signed request of the key, non-2xx responses are errors.
+func (s *S3Storage) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	rawURL := s.endpoint + "/" + s3Escape(s.bucket, false)
+	if key != "" {
+		rawURL += "/" + s3Escape(key, true)
+	}
+	if len(query) > 0 {
+		rawURL += "?" + s3Query(query)
+	}
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	now := time.Now()
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	req.Header.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	signV4(req, s.accessKey, s.secretKey, s.region, now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: s3Scheme + s.bucket + "/" + key, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("s3.%s[%s/%s].status[%d]:%s", strings.ToLower(method), s.bucket, key, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Create returns the writer uploading the object, with multipart once it outgrows one part.
+func (s *S3Storage) Create(file string) (io.WriteCloser, error) {
+	key, err := s.key(file)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s: s, key: key}, nil
+}
+
+// Open returns the body of the object, streamed.
+func (s *S3Storage) Open(file string) (io.ReadCloser, error) {
+	key, err := s.key(file)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Remove deletes the object, S3 doesn't fail on the missing ones.
+func (s *S3Storage) Remove(file string) error {
+	key, err := s.key(file)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the objects under the dir prefix.
+func (s *S3Storage) List(dir string) ([]string, error) {
+	prefix, err := s.key(dir)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var files []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			files = append(files, s3Scheme+s.bucket+"/"+c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+// s3Writer buffers one part at a time: small objects are put at once,
+// the others are streamed with a multipart upload.
+type s3Writer struct {
+	s        *S3Storage
+	key      string
+	buf      []byte
+	uploadID string
+	parts    []s3CompletePart
+	err      error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= w.s.partSize {
+		if w.err = w.uploadPart(w.buf[:w.s.partSize]); w.err != nil {
+			w.abort()
+			return 0, w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[w.s.partSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.s.do("POST", w.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	resp, err := w.s.do("PUT", w.key, url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3CompletePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) abort() {
+	if w.uploadID == "" {
+		return
+	}
+	if resp, err := w.s.do("DELETE", w.key, url.Values{"uploadId": {w.uploadID}}, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Close uploads the rest, the object is visible after.
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.uploadID == "" {
+		resp, err := w.s.do("PUT", w.key, nil, w.buf)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(s3CompleteUpload{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do("POST", w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The completion can fail with a 200 and an error body.
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return fmt.Errorf("s3.complete[%s/%s].error:%s", w.s.bucket, w.key, data)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// Sample is the sample of a root table: a percentage of its rows, or its first rows by the
+// primary key.
+type Sample struct {
+	Percent float64
+	Rows    int
+}
+
+// SampledTable is the subset of a table dumped by the sampling.
+type SampledTable struct {
+	// Where selects the rows, the [where] of the table included.
+	Where string
+	// Via is the sample of the root table, or the foreign keys reaching the table.
+	Via string
+}
+
+// ParseSample parses "10%" or "1000" rows.
+func ParseSample(v string) (*Sample, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasSuffix(v, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("sample[%s].percent.must.be.in.(0,100]", v)
+		}
+		return &Sample{Percent: p}, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("sample[%s].must.be.a.percent.or.a.row.count", v)
+	}
+	return &Sample{Rows: n}, nil
+}
+
+// ParseSamples parses the table=sample list of the command line, split by commas.
+func ParseSamples(v string) (map[string]*Sample, error) {
+	samples := make(map[string]*Sample)
+	for _, item := range strings.Split(v, ",") {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("sample[%s].must.be.table=sample", item)
+		}
+		s, err := ParseSample(split[1])
+		if err != nil {
+			return nil, err
+		}
+		samples[strings.TrimSpace(split[0])] = s
+	}
+	return samples, nil
+}
+
+func (s *Sample) String() string {
+	if s.Rows > 0 {
+		return fmt.Sprintf("%d.rows", s.Rows)
+	}
+	return strconv.FormatFloat(s.Percent, 'f', -1, 64) + "%"
+}
+
+// foreignKey is a foreign key between two tables of the same database.
+type foreignKey struct {
+	name    string
+	table   string
+	columns []string
+	parent  string
+	refs    []string
+}
+
+// foreignKeys returns the foreign keys of the database by information_schema, in the table order.
+func foreignKeys(conn *Connection, database string) ([]*foreignKey, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT CONSTRAINT_NAME, TABLE_NAME, COLUMN_NAME, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = '%s' AND REFERENCED_TABLE_SCHEMA = '%s' ORDER BY TABLE_NAME, CONSTRAINT_NAME, ORDINAL_POSITION", database, database))
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Fields) != 5 {
+		return nil, fmt.Errorf("information_schema.key_column_usage.unexpected.columns[%d]", len(qr.Fields))
+	}
+	var fks []*foreignKey
+	for _, row := range qr.Rows {
+		name, table := row[0].String(), row[1].String()
+		var fk *foreignKey
+		if n := len(fks); n > 0 && fks[n-1].name == name && fks[n-1].table == table {
+			fk = fks[n-1]
+		} else {
+			fk = &foreignKey{name: name, table: table, parent: row[3].String()}
+			fks = append(fks, fk)
+		}
+		fk.columns = append(fk.columns, fmt.Sprintf("`%s`", row[2].String()))
+		fk.refs = append(fk.refs, fmt.Sprintf("`%s`", row[4].String()))
+	}
+	return fks, nil
+}
+
+// primaryKey returns the quoted primary key columns of the table, nil if it has none.
+func primaryKey(conn *Connection, database string, table string) ([]string, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SHOW KEYS FROM `%s`.`%s` WHERE Key_name = 'PRIMARY'", database, table))
+	if err != nil {
+		return nil, err
+	}
+	column := -1
+	for i, f := range qr.Fields {
+		if strings.EqualFold(f.Name, "Column_name") {
+			column = i
+		}
+	}
+	if column < 0 {
+		return nil, nil
+	}
+	var key []string
+	for _, row := range qr.Rows {
+		key = append(key, fmt.Sprintf("`%s`", row[column].String()))
+	}
+	return key, nil
+}
+
+// andWhere joins the conditions, the empty ones are true.
+func andWhere(a string, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return fmt.Sprintf("(%s) AND (%s)", a, b)
+}
+
+// inWhere returns the condition of the columns in the refs of the table rows.
+func inWhere(columns []string, database string, table string, refs []string, where string) string {
+	cols := strings.Join(columns, ",")
+	if len(columns) > 1 {
+		cols = "(" + cols + ")"
+	}
+	sub := fmt.Sprintf("SELECT %s FROM `%s`.`%s`", strings.Join(refs, ","), database, table)
+	if where != "" {
+		sub += " WHERE " + where
+	}
+	return fmt.Sprintf("%s IN (%s)", cols, sub)
+}
+
+// rootWhere returns the condition of the sampled rows of the root table, the [where] included.
+// The percentages go by a hash of the primary key and the row counts by its order, so the
+// condition selects the same rows in the subqueries of the related tables.
+func rootWhere(conn *Connection, database string, table string, where string, key []string, s *Sample) (string, error) {
+	if len(key) == 0 {
+		return "", fmt.Errorf("sample.table[%s.%s].has.no.primary.key", database, table)
+	}
+	if s.Percent > 0 {
+		if s.Percent >= 100 {
+			return where, nil
+		}
+		cond := fmt.Sprintf("CRC32(CONCAT_WS(',',%s)) %% 10000 < %d", strings.Join(key, ","), int(s.Percent*100))
+		return andWhere(where, cond), nil
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM `%s`.`%s`", strings.Join(key, ","), database, table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT 1 OFFSET %d", strings.Join(key, ","), s.Rows-1)
+	qr, err := conn.Fetch(query)
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 {
+		// Fewer rows than the sample, all of them.
+		return where, nil
+	}
+	// Up to the last key: not after it.
+	after := strings.TrimPrefix(keysetWhere("", key, qr.Rows[0]), " WHERE ")
+	return andWhere(where, "NOT ("+after+")"), nil
+}
+
+// sampleTables returns the subsets of the tables related to the sampled roots: down the foreign
+// keys the rows referencing the sampled ones, then up the foreign keys the rows referenced by
+// all of them, the parents of the parents included. The other tables referencing them are
+// trimmed to the rows with dumped references, the unrelated tables are dumped whole.
+func sampleTables(database string, roots map[string]*SampledTable, fks []*foreignKey, tables map[string]bool, wheres map[string]string) map[string]*SampledTable {
+	sampled := make(map[string]*SampledTable)
+	queue := make([]string, 0, len(roots))
+	for _, root := range sortedTables(roots) {
+		sampled[root] = roots[root]
+		queue = append(queue, root)
+	}
+
+	// Down: the children of the sampled tables, nearest first.
+	down := make(map[string]bool)
+	for _, root := range queue {
+		down[root] = true
+	}
+	var children []string
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, fk := range fks {
+			if fk.parent != parent || fk.table == parent || !tables[fk.table] || down[fk.table] {
+				continue
+			}
+			down[fk.table] = true
+			children = append(children, fk.table)
+			queue = append(queue, fk.table)
+		}
+	}
+	// A child keeps the rows referencing the sampled rows by all its foreign keys to them, the
+	// nullable ones besides the first. It waits for its parents, or in a cycle goes nearest first.
+	for len(children) > 0 {
+		next := 0
+		for i, child := range children {
+			ready := true
+			for _, fk := range fks {
+				if fk.table == child && fk.parent != child && down[fk.parent] && sampled[fk.parent] == nil {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		child := children[next]
+		children = append(children[:next], children[next+1:]...)
+
+		var ands, via []string
+		for _, fk := range fks {
+			parent := sampled[fk.parent]
+			if fk.table != child || fk.parent == child || !down[fk.parent] || parent == nil {
+				continue
+			}
+			cond := inWhere(fk.columns, database, fk.parent, fk.refs, parent.Where)
+			if len(ands) > 0 && len(fk.columns) == 1 {
+				cond = fmt.Sprintf("%s IS NULL OR %s", fk.columns[0], cond)
+			}
+			ands = append(ands, cond)
+			via = append(via, fk.name)
+		}
+		where := ands[0]
+		if len(ands) > 1 {
+			where = "(" + strings.Join(ands, ") AND (") + ")"
+		}
+		sampled[child] = &SampledTable{Where: andWhere(wheres[child], where), Via: strings.Join(via, ",")}
+	}
+
+	// Up: the parents not sampled yet, by all the foreign keys of the sampled tables to them.
+	var ancestors []string
+	seen := make(map[string]bool)
+	queue = sortedTables(sampled)
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		for _, fk := range fks {
+			if fk.table != child || sampled[fk.parent] != nil || seen[fk.parent] || !tables[fk.parent] {
+				continue
+			}
+			seen[fk.parent] = true
+			ancestors = append(ancestors, fk.parent)
+			queue = append(queue, fk.parent)
+		}
+	}
+	visiting := make(map[string]bool)
+	var resolve func(parent string)
+	resolve = func(parent string) {
+		if sampled[parent] != nil || visiting[parent] {
+			return
+		}
+		visiting[parent] = true
+		var ors, via []string
+		for _, fk := range fks {
+			if fk.parent != parent || fk.table == parent {
+				continue
+			}
+			if seen[fk.table] {
+				resolve(fk.table)
+			}
+			child := sampled[fk.table]
+			if child == nil {
+				// Not dumped, or in a cycle of the parents being resolved.
+				continue
+			}
+			ors = append(ors, "("+inWhere(fk.refs, database, fk.table, fk.columns, child.Where)+")")
+			via = append(via, fk.name)
+		}
+		where := "FALSE"
+		if len(ors) > 0 {
+			where = strings.Join(ors, " OR ")
+		}
+		sampled[parent] = &SampledTable{Where: andWhere(wheres[parent], where), Via: strings.Join(via, ",")}
+		visiting[parent] = false
+	}
+	for _, parent := range ancestors {
+		resolve(parent)
+	}
+
+	// The other tables referencing the sampled ones keep the rows whose references are dumped.
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, fk := range fks {
+			if sampled[fk.table] != nil || sampled[fk.parent] == nil || !tables[fk.table] {
+				continue
+			}
+			var ands, via []string
+			for _, other := range fks {
+				parent := sampled[other.parent]
+				if other.table != fk.table || other.parent == fk.table || parent == nil {
+					continue
+				}
+				cond := inWhere(other.columns, database, other.parent, other.refs, parent.Where)
+				if len(other.columns) == 1 {
+					cond = fmt.Sprintf("%s IS NULL OR %s", other.columns[0], cond)
+				}
+				ands = append(ands, "("+cond+")")
+				via = append(via, other.name)
+			}
+			sampled[fk.table] = &SampledTable{Where: andWhere(wheres[fk.table], strings.Join(ands, " AND ")), Via: strings.Join(via, ",")}
+			trimmed = true
+		}
+	}
+	return sampled
+}
+
+func sortedTables(m map[string]*SampledTable) []string {
+	tables := make([]string, 0, len(m))
+	for table := range m {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// prepareSamples resolves the sampled subsets of the dumped databases into args.Sampled,
+// keyed by database.table.
+func prepareSamples(log *xlog.Log, conn *Connection, args *Args, databases []string) error {
+	if len(args.Samples) == 0 {
+		return nil
+	}
+	args.Sampled = make(map[string]*SampledTable)
+	for _, database := range databases {
+		tables := make(map[string]bool)
+		for _, table := range dumpTables(log, conn, args, database) {
+			tables[table] = true
+		}
+		roots := make(map[string]*SampledTable)
+		for table, s := range args.Samples {
+			if !tables[table] {
+				continue
+			}
+			key, err := primaryKey(conn, database, table)
+			if err != nil {
+				return err
+			}
+			where, err := rootWhere(conn, database, table, args.Wheres[table], key, s)
+			if err != nil {
+				return err
+			}
+			roots[table] = &SampledTable{Where: where, Via: s.String()}
+		}
+		if len(roots) == 0 {
+			continue
+		}
+
+		fks, err := foreignKeys(conn, database)
+		if err != nil {
+			return err
+		}
+		sampled := sampleTables(database, roots, fks, tables, args.Wheres)
+		for _, table := range sortedTables(sampled) {
+			log.Info("dumping.sample.table[%s.%s].via[%s]", database, table, sampled[table].Via)
+			args.Sampled[database+"."+table] = sampled[table]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestParseSample(t *testing.T) {
+	s, err := ParseSample("12.5%")
+	assert.Nil(t, err)
+	assert.Equal(t, &Sample{Percent: 12.5}, s)
+	assert.Equal(t, "12.5%", s.String())
+	s, err = ParseSample("1000")
+	assert.Nil(t, err)
+	assert.Equal(t, &Sample{Rows: 1000}, s)
+	assert.Equal(t, "1000.rows", s.String())
+
+	for _, v := range []string{"0%", "101%", "x%", "0", "-1", "ten"} {
+		_, err := ParseSample(v)
+		assert.NotNil(t, err, v)
+	}
+
+	samples, err := ParseSamples("orders=10%, users=500")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*Sample{"orders": {Percent: 10}, "users": {Rows: 500}}, samples)
+	_, err = ParseSamples("orders")
+	assert.NotNil(t, err)
+}
+
+func TestSampleTables(t *testing.T) {
+	// customers <- orders <- items -> products <- reviews, audit unrelated.
+	fks := []*foreignKey{
+		{name: "fk_items_order", table: "items", columns: []string{"`order_id`"}, parent: "orders", refs: []string{"`id`"}},
+		{name: "fk_items_product", table: "items", columns: []string{"`product_id`"}, parent: "products", refs: []string{"`id`"}},
+		{name: "fk_orders_customer", table: "orders", columns: []string{"`customer_id`"}, parent: "customers", refs: []string{"`id`"}},
+		{name: "fk_reviews_product", table: "reviews", columns: []string{"`product_id`"}, parent: "products", refs: []string{"`id`"}},
+	}
+	tables := map[string]bool{"customers": true, "orders": true, "items": true, "products": true, "reviews": true, "audit": true}
+	roots := map[string]*SampledTable{"orders": {Where: "`id` < 10", Via: "10.rows"}}
+	wheres := map[string]string{"products": "deleted = 0"}
+
+	sampled := sampleTables("shop", roots, fks, tables, wheres)
+	items := "`order_id` IN (SELECT `id` FROM `shop`.`orders` WHERE `id` < 10)"
+	products := "(deleted = 0) AND ((`id` IN (SELECT `product_id` FROM `shop`.`items` WHERE " + items + ")))"
+	assert.Equal(t, map[string]*SampledTable{
+		"orders": {Where: "`id` < 10", Via: "10.rows"},
+		"items":  {Where: items, Via: "fk_items_order"},
+		"customers": {
+			Where: "(`id` IN (SELECT `customer_id` FROM `shop`.`orders` WHERE `id` < 10))",
+			Via:   "fk_orders_customer",
+		},
+		"products": {Where: products, Via: "fk_items_product"},
+		"reviews": {
+			Where: "(`product_id` IS NULL OR `product_id` IN (SELECT `id` FROM `shop`.`products` WHERE " + products + "))",
+			Via:   "fk_reviews_product",
+		},
+	}, sampled)
+	assert.Nil(t, sampled["audit"])
+
+	// Not dumped, the items neither sample nor carry the products.
+	delete(tables, "items")
+	sampled = sampleTables("shop", roots, fks, tables, nil)
+	assert.Equal(t, []string{"customers", "orders"}, sortedTables(sampled))
+
+	// shipments -> orders <- items -> shipments: the items of the sampled shipments only.
+	fks = []*foreignKey{
+		{name: "fk_items_order", table: "items", columns: []string{"`order_id`"}, parent: "orders", refs: []string{"`id`"}},
+		{name: "fk_items_shipment", table: "items", columns: []string{"`shipment_id`"}, parent: "shipments", refs: []string{"`id`"}},
+		{name: "fk_shipments_order", table: "shipments", columns: []string{"`order_id`"}, parent: "orders", refs: []string{"`id`"}},
+	}
+	tables = map[string]bool{"orders": true, "items": true, "shipments": true}
+	sampled = sampleTables("shop", roots, fks, tables, nil)
+	shipments := "`order_id` IN (SELECT `id` FROM `shop`.`orders` WHERE `id` < 10)"
+	assert.Equal(t, map[string]*SampledTable{
+		"orders":    {Where: "`id` < 10", Via: "10.rows"},
+		"shipments": {Where: shipments, Via: "fk_shipments_order"},
+		"items": {
+			Where: "(" + items + ") AND (`shipment_id` IS NULL OR `shipment_id` IN (SELECT `id` FROM `shop`.`shipments` WHERE " + shipments + "))",
+			Via:   "fk_items_order,fk_items_shipment",
+		},
+	}, sampled)
+}
+
+func TestPrepareSamples(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	fksResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "CONSTRAINT_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "TABLE_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "COLUMN_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "REFERENCED_TABLE_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "REFERENCED_COLUMN_NAME", Type: querypb.Type_VARCHAR},
+		},
+	}
+	for _, fk := range [][]string{
+		{"fk_items", "items", "order_id", "orders", "id"},
+		{"fk_items", "items", "order_no", "orders", "no"},
+	} {
+		var row []sqltypes.Value
+		for _, v := range fk {
+			row = append(row, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+		}
+		fksResult.Rows = append(fksResult.Rows, row)
+	}
+	lastResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "id", Type: querypb.Type_INT64}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte("42"))}},
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("show keys from .*", columnResult("Column_name", "id"))
+		fakedbs.AddQueryPattern("select constraint_name, .*", fksResult)
+		fakedbs.AddQueryPattern("select `id` from `shop`.`orders` where status = 1 order by `id` limit 1 offset 99", lastResult)
+	}
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	defer pool.Put(conn)
+
+	args := &Args{
+		Table:   "orders,items",
+		Wheres:  map[string]string{"orders": "status = 1"},
+		Samples: map[string]*Sample{"orders": {Rows: 100}},
+	}
+	assert.Nil(t, prepareSamples(log, conn, args, []string{"shop"}))
+
+	orders := "(status = 1) AND (NOT ((`id` > 42)))"
+	assert.Equal(t, &SampledTable{Where: orders, Via: "100.rows"}, args.Sampled["shop.orders"])
+	items := "(`order_id`,`order_no`) IN (SELECT `id`,`no` FROM `shop`.`orders` WHERE " + orders + ")"
+	assert.Equal(t, &SampledTable{Where: items, Via: "fk_items"}, args.Sampled["shop.items"])
+
+	// The sampled where replaces the [where] of the table.
+	where, _ := tableWhere(conn, args, "shop", "orders")
+	assert.Equal(t, " WHERE "+orders, where)
+	where, _ = tableWhere(conn, args, "other", "orders")
+	assert.Equal(t, " WHERE status = 1", where)
+
+	// The percentages hash the key.
+	args.Samples = map[string]*Sample{"orders": {Percent: 2.5}}
+	assert.Nil(t, prepareSamples(log, conn, args, []string{"shop"}))
+	assert.Equal(t, "(status = 1) AND (CRC32(CONCAT_WS(',',`id`)) % 10000 < 250)", args.Sampled["shop.orders"].Where)
+}
@@ -0,0 +1,143 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// task is one unit of work: a table to dump or a chunk file to load.
+type task struct {
+	database string
+	table    string
+	file     string
+	part     int
+	size     uint64
+}
+
+// scheduler hands out the tasks largest first, so the biggest one doesn't start last and
+// dominate the wall clock; the chunks of the same size go by part, spreading the tables.
+// At most perTable tasks of one table and perDatabase of one database run at once, 0 is
+// unlimited; a task over the limits is passed over for the next largest one which fits.
+type scheduler struct {
+	mu          sync.Mutex
+	pending     []*task
+	tables      map[string]int
+	databases   map[string]int
+	perTable    int
+	perDatabase int
+
+	// changed is closed when a task is done, the waiting next may go on.
+	changed chan struct{}
+}
+
+func newScheduler(tasks []*task, perTable int, perDatabase int) *scheduler {
+	pending := append([]*task(nil), tasks...)
+	sort.SliceStable(pending, func(i, j int) bool {
+		a, b := pending[i], pending[j]
+		if a.size != b.size {
+			return a.size > b.size
+		}
+		return a.part < b.part
+	})
+	return &scheduler{
+		pending:     pending,
+		tables:      make(map[string]int),
+		databases:   make(map[string]int),
+		perTable:    perTable,
+		perDatabase: perDatabase,
+		changed:     make(chan struct{}),
+	}
+}
+
+// next returns the largest pending task within the limits, waiting for a running one to be
+// done if none fits. It returns nil once all are handed out or the context is done.
+func (s *scheduler) next(ctx context.Context) *task {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		for i, t := range s.pending {
+			key := t.database + "." + t.table
+			if s.perTable > 0 && s.tables[key] >= s.perTable {
+				continue
+			}
+			if s.perDatabase > 0 && s.databases[t.database] >= s.perDatabase {
+				continue
+			}
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.tables[key]++
+			s.databases[t.database]++
+			s.mu.Unlock()
+			return t
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// done releases the limits taken by the task.
+func (s *scheduler) done(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables[t.database+"."+t.table]--
+	s.databases[t.database]--
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// remaining returns the tasks not handed out.
+func (s *scheduler) remaining() []*task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*task(nil), s.pending...)
+}
+
+// chunkSize returns the size of the chunk file by the manifest, or by the local file.
+// It's 0 if unknown.
+func chunkSize(args *Args, file string) uint64 {
+	if args.Manifest != nil {
+		if entry := args.Manifest.Lookup(file); entry != nil {
+			return uint64(entry.Size)
+		}
+	}
+	if info, err := os.Stat(file); err == nil {
+		return uint64(info.Size())
+	}
+	return 0
+}
+
+// loadTasks returns the tasks of the chunk files to load.
+func loadTasks(args *Args, files []string) ([]*task, error) {
+	tasks := make([]*task, 0, len(files))
+	for _, file := range files {
+		database, table, part, err := parseTableFile(file, filepath.Ext(file))
+		if err != nil {
+			return nil, err
+		}
+		t := &task{database: database, table: table, file: file, size: chunkSize(args, file)}
+		t.part, _ = strconv.Atoi(part)
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	a1 := &task{database: "db1", table: "a", part: 1, size: 10}
+	a2 := &task{database: "db1", table: "a", part: 2, size: 10}
+	a3 := &task{database: "db1", table: "a", part: 3, size: 5}
+	b1 := &task{database: "db1", table: "b", part: 1, size: 10}
+	c1 := &task{database: "db2", table: "c", part: 1, size: 1}
+
+	// Largest first, the same sizes by part.
+	{
+		s := newScheduler([]*task{a3, a2, c1, a1, b1}, 0, 0)
+		var got []*task
+		for t := s.next(context.Background()); t != nil; t = s.next(context.Background()) {
+			got = append(got, t)
+		}
+		assert.Equal(t, []*task{a1, b1, a2, a3, c1}, got)
+	}
+
+	// One chunk per table: the next fitting one is taken, then wait for the table.
+	{
+		s := newScheduler([]*task{a1, a2, b1, c1}, 1, 0)
+		assert.Equal(t, a1, s.next(context.Background()))
+		assert.Equal(t, b1, s.next(context.Background()))
+		assert.Equal(t, c1, s.next(context.Background()))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			s.done(a1)
+		}()
+		assert.Equal(t, a2, s.next(context.Background()))
+		assert.Nil(t, s.next(context.Background()))
+	}
+
+	// Two per database, canceled while waiting.
+	{
+		s := newScheduler([]*task{a1, a2, b1, c1}, 0, 2)
+		assert.Equal(t, a1, s.next(context.Background()))
+		assert.Equal(t, b1, s.next(context.Background()))
+		assert.Equal(t, c1, s.next(context.Background()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Nil(t, s.next(ctx))
+		assert.Equal(t, []*task{a2}, s.remaining())
+	}
+}
+
+func TestLoadTasks(t *testing.T) {
+	args := &Args{Manifest: NewManifest()}
+	file := tableDataFile("/tmp/none", "db1", "t1", 12, tableSuffix)
+	args.Manifest.Add(file, "INSERT", "db1", "t1", 1)
+	tasks, err := loadTasks(args, []string{file, tableDataFile("/tmp/none", "db1", "t2", 1, csvSuffix)})
+	assert.Nil(t, err)
+	assert.Equal(t, &task{database: "db1", table: "t1", file: file, part: 12, size: 6}, tasks[0])
+	assert.Equal(t, "t2", tasks[1].table)
+	assert.Equal(t, uint64(0), tasks[1].size)
+
+	_, err = loadTasks(args, []string{"/tmp/none/bad.sql"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,111 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// packetMargin is kept under max_allowed_packet for the packet header and the command byte.
+const packetMargin = 1024
+
+// TableSizes overrides the chunk and statement sizes of one table, 0 keeps the [mysql] one.
+// ChunkRows is a pointer, a table may set 0 to be split by size while the others go by rows.
+type TableSizes struct {
+	ChunksizeInMB int
+	ChunkRows     *int
+	StmtSize      int
+}
+
+// chunking is how one table is split into chunks and statements.
+type chunking struct {
+	// chunkBytes bounds the chunks unless chunkRows is set.
+	chunkBytes int
+	chunkRows  int
+	stmtSize   int
+	// maxStmt is the largest INSERT statement the target takes, 0 is unlimited.
+	maxStmt int
+}
+
+// tableChunking returns the sizes of the table, the overrides of the config on the [mysql] ones.
+func tableChunking(args *Args, table string) chunking {
+	c := chunking{
+		chunkBytes: args.ChunksizeInMB * 1024 * 1024,
+		chunkRows:  args.ChunkRows,
+		stmtSize:   args.StmtSize,
+	}
+	if sizes, ok := args.TableSizes[table]; ok {
+		if sizes.ChunksizeInMB > 0 {
+			c.chunkBytes = sizes.ChunksizeInMB * 1024 * 1024
+		}
+		if sizes.ChunkRows != nil {
+			c.chunkRows = *sizes.ChunkRows
+		}
+		if sizes.StmtSize > 0 {
+			c.stmtSize = sizes.StmtSize
+		}
+	}
+	if args.MaxAllowedPacket > packetMargin {
+		c.maxStmt = args.MaxAllowedPacket - packetMargin
+	}
+	return c
+}
+
+// chunkFull returns true if the chunk of these rows and bytes is to be written.
+func (c chunking) chunkFull(rows uint64, bytes int) bool {
+	if c.chunkRows > 0 {
+		return rows >= uint64(c.chunkRows)
+	}
+	return bytes >= c.chunkBytes
+}
+
+// sourcePacket returns the max_allowed_packet of the source, 0 if unknown.
+// It's taken for the target's unless set, the restore usually goes to a server alike.
+func sourcePacket(log *xlog.Log, conn *Connection) int {
+	qr, err := conn.Fetch("SELECT @@max_allowed_packet")
+	if err == nil && (len(qr.Fields) != 1 || qr.Fields[0].Name != "@@max_allowed_packet" || len(qr.Rows) != 1) {
+		err = fmt.Errorf("unexpected.result")
+	}
+	if err != nil {
+		log.Warning("dumping.max_allowed_packet.error[%v].statements.not.capped", err)
+		return 0
+	}
+	packet, err := strconv.Atoi(qr.Rows[0][0].String())
+	if err != nil {
+		log.Warning("dumping.max_allowed_packet.error[%v].statements.not.capped", err)
+		return 0
+	}
+	return packet
+}
+
+// checkTargetPacket warns if the target takes smaller packets than the dump statements were
+// sized for, the larger ones would be rejected.
+func checkTargetPacket(log *xlog.Log, conn *Connection, args *Args) {
+	m, err := ReadMetadata(args.Outdir)
+	if err != nil || m.MaxAllowedPacket == 0 {
+		return
+	}
+	qr, err := conn.Fetch("SELECT @@max_allowed_packet")
+	if err != nil || len(qr.Rows) != 1 {
+		log.Warning("restoring.max_allowed_packet.error[%v].not.checked", err)
+		return
+	}
+	packet, err := strconv.Atoi(qr.Rows[0][0].String())
+	if err != nil {
+		log.Warning("restoring.max_allowed_packet.error[%v].not.checked", err)
+		return
+	}
+	if packet < m.MaxAllowedPacket {
+		log.Warning("restoring.max_allowed_packet[%d].below.the.dump[%d].the.large.statements.may.fail.dump.again.with.max_allowed_packet[%d]", packet, m.MaxAllowedPacket, packet)
+	}
+}
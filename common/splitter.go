@@ -0,0 +1,286 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const defaultDelimiter = ";"
+
+// SQLScanner splits a stream of SQL text into statements.
+// It understands quoted strings and identifiers, backslash escapes,
+// `--`, `#` and `/* */` comments, `/*! */` conditional comments and
+// the mysql client `DELIMITER` command, so it can replay files written
+// by go-mydumper, upstream mydumper and mysqldump.
+//
+// Plain comments are stripped, conditional comments and optimizer hints
+// are kept verbatim since the server executes them.
+type SQLScanner struct {
+	r         *bufio.Reader
+	delimiter string
+	buf       bytes.Buffer
+	stmt      string
+	err       error
+}
+
+// NewSQLScanner creates the new scanner reading from r.
+func NewSQLScanner(r io.Reader) *SQLScanner {
+	return &SQLScanner{
+		r:         bufio.NewReaderSize(r, 64*1024),
+		delimiter: defaultDelimiter,
+	}
+}
+
+// Statement returns the most recent statement found by Scan, without the delimiter.
+func (s *SQLScanner) Statement() string {
+	return s.stmt
+}
+
+// Delimiter returns the delimiter currently in effect.
+func (s *SQLScanner) Delimiter() string {
+	return s.delimiter
+}
+
+// Err returns the first non-EOF error encountered by the scanner.
+func (s *SQLScanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// Scan advances to the next non-empty statement.
+// It returns false when the input is exhausted or an error occurs.
+func (s *SQLScanner) Scan() bool {
+	s.stmt = ""
+	if s.err != nil {
+		return false
+	}
+
+	lineStart := true
+	for {
+		if lineStart && s.empty() {
+			ok, err := s.scanDelimiterCommand()
+			if err != nil {
+				return s.finish(err)
+			}
+			if ok {
+				continue
+			}
+		}
+
+		if s.matchDelimiter() {
+			s.r.Discard(len(s.delimiter))
+			if stmt := strings.TrimSpace(s.buf.String()); stmt != "" {
+				s.buf.Reset()
+				s.stmt = stmt
+				return true
+			}
+			s.buf.Reset()
+			lineStart = false
+			continue
+		}
+
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return s.finish(err)
+		}
+		lineStart = false
+
+		switch c {
+		case '\n':
+			s.buf.WriteByte(c)
+			lineStart = true
+		case '\'', '"', '`':
+			s.buf.WriteByte(c)
+			if err := s.scanQuoted(c); err != nil {
+				return s.finish(err)
+			}
+		case '#':
+			if err := s.skipLine(); err != nil {
+				return s.finish(err)
+			}
+			lineStart = true
+		case '-':
+			if next, _ := s.r.Peek(2); len(next) >= 1 && next[0] == '-' && (len(next) == 1 || isSpace(next[1])) {
+				if err := s.skipLine(); err != nil {
+					return s.finish(err)
+				}
+				lineStart = true
+				continue
+			}
+			s.buf.WriteByte(c)
+		case '/':
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == '*' {
+				s.r.Discard(1)
+				if err := s.scanComment(); err != nil {
+					return s.finish(err)
+				}
+				continue
+			}
+			s.buf.WriteByte(c)
+		default:
+			s.buf.WriteByte(c)
+		}
+	}
+}
+
+// finish flushes the trailing statement which has no delimiter.
+func (s *SQLScanner) finish(err error) bool {
+	if err != io.EOF {
+		s.err = err
+		return false
+	}
+	s.err = io.EOF
+	stmt := strings.TrimSpace(s.buf.String())
+	s.buf.Reset()
+	if stmt == "" {
+		return false
+	}
+	s.stmt = stmt
+	return true
+}
+
+func (s *SQLScanner) empty() bool {
+	return len(bytes.TrimSpace(s.buf.Bytes())) == 0
+}
+
+func (s *SQLScanner) matchDelimiter() bool {
+	peek, _ := s.r.Peek(len(s.delimiter))
+	return len(peek) == len(s.delimiter) && string(peek) == s.delimiter
+}
+
+// scanDelimiterCommand handles the client side `DELIMITER xx` command.
+func (s *SQLScanner) scanDelimiterCommand() (bool, error) {
+	const cmd = "delimiter"
+
+	// Skip the leading blanks on this line.
+	for {
+		peek, _ := s.r.Peek(1)
+		if len(peek) == 0 || (peek[0] != ' ' && peek[0] != '\t') {
+			break
+		}
+		s.r.Discard(1)
+	}
+	peek, _ := s.r.Peek(len(cmd) + 1)
+	if len(peek) != len(cmd)+1 || !strings.EqualFold(string(peek[:len(cmd)]), cmd) || !isSpace(peek[len(cmd)]) {
+		return false, nil
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	fields := strings.Fields(line[len(cmd):])
+	if len(fields) > 0 {
+		s.delimiter = fields[0]
+	}
+	s.buf.Reset()
+	if err == io.EOF {
+		return false, err
+	}
+	return true, nil
+}
+
+// scanQuoted copies a quoted string or identifier, the opening quote is already written.
+// The input ending before the closing quote is an error, the file is truncated.
+func (s *SQLScanner) scanQuoted(quote byte) error {
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return fmt.Errorf("sql.unterminated.quote[%c]", quote)
+		}
+		if err != nil {
+			return err
+		}
+		s.buf.WriteByte(c)
+		switch {
+		case c == '\\' && quote != '`':
+			c, err = s.r.ReadByte()
+			if err == io.EOF {
+				return fmt.Errorf("sql.unterminated.quote[%c]", quote)
+			}
+			if err != nil {
+				return err
+			}
+			s.buf.WriteByte(c)
+		case c == quote:
+			return nil
+		}
+	}
+}
+
+// scanComment handles the comment after `/*`.
+// Conditional comments `/*!` and hints `/*+` are kept, the others are dropped. A kept one
+// not closed before the end is an error, as the quotes.
+func (s *SQLScanner) scanComment() error {
+	keep := false
+	if next, _ := s.r.Peek(1); len(next) == 1 && (next[0] == '!' || next[0] == '+') {
+		keep = true
+		s.buf.WriteString("/*")
+	}
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF && keep {
+			return fmt.Errorf("sql.unterminated.comment")
+		}
+		if err != nil {
+			return err
+		}
+		if c == '*' {
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == '/' {
+				s.r.Discard(1)
+				if keep {
+					s.buf.WriteString("*/")
+				} else {
+					s.buf.WriteByte(' ')
+				}
+				return nil
+			}
+		}
+		if keep {
+			s.buf.WriteByte(c)
+			if c == '\'' || c == '"' || c == '`' {
+				if err := s.scanQuoted(c); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (s *SQLScanner) skipLine() error {
+	if _, err := s.r.ReadString('\n'); err != nil {
+		return err
+	}
+	s.buf.WriteByte('\n')
+	return nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// SplitStatements splits the SQL text into statements.
+func SplitStatements(sql string) ([]string, error) {
+	var stmts []string
+	scanner := NewSQLScanner(strings.NewReader(sql))
+	for scanner.Scan() {
+		stmts = append(stmts, scanner.Statement())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stmts, nil
+}
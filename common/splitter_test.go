@@ -0,0 +1,75 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql string
+		exp []string
+	}{
+		{
+			"INSERT INTO `t1`(`a`) VALUES\n(1),\n(2);\nINSERT INTO `t1`(`a`) VALUES\n(3);\n",
+			[]string{"INSERT INTO `t1`(`a`) VALUES\n(1),\n(2)", "INSERT INTO `t1`(`a`) VALUES\n(3)"},
+		},
+		{
+			`INSERT INTO t VALUES ("a;b",'c\';d',"e"";f");`,
+			[]string{`INSERT INTO t VALUES ("a;b",'c\';d',"e"";f")`},
+		},
+		{
+			"SELECT `semi;colon` FROM t; SELECT 2",
+			[]string{"SELECT `semi;colon` FROM t", "SELECT 2"},
+		},
+		{
+			"-- comment; here\n# another; one\n/* multi;\nline */SELECT 1;",
+			[]string{"SELECT 1"},
+		},
+		{
+			"SELECT 5--3;",
+			[]string{"SELECT 5--3"},
+		},
+		{
+			"/*!40101 SET NAMES utf8 */;\n/*!40103 SET TIME_ZONE='+00:00' */;",
+			[]string{"/*!40101 SET NAMES utf8 */", "/*!40103 SET TIME_ZONE='+00:00' */"},
+		},
+		{
+			"SELECT /*+ MAX_EXECUTION_TIME(1) */ 1;",
+			[]string{"SELECT /*+ MAX_EXECUTION_TIME(1) */ 1"},
+		},
+		{
+			"DELIMITER ;;\nCREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN\n  SET NEW.a = 1;\n  SET NEW.b = 2;\nEND ;;\nDELIMITER ;\nSELECT 1;",
+			[]string{"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN\n  SET NEW.a = 1;\n  SET NEW.b = 2;\nEND", "SELECT 1"},
+		},
+		{
+			"delimiter $$\nCREATE PROCEDURE p() BEGIN SELECT 1; END$$\ndelimiter ;\n",
+			[]string{"CREATE PROCEDURE p() BEGIN SELECT 1; END"},
+		},
+		{
+			"SELECT 1;\n\n;  ;\n/* only comment */;",
+			[]string{"SELECT 1"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := SplitStatements(tt.sql)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.exp, got)
+	}
+
+	// A truncated file is an error, not a statement.
+	for _, sql := range []string{"SELECT 'unterminated", "SELECT 1;\nINSERT INTO t VALUES (\"a\\", "SELECT `t", "/*!40101 SET NAMES utf8"} {
+		_, err := SplitStatements(sql)
+		assert.NotNil(t, err, sql)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// threadStatus is the work of one worker thread, for the status report.
+type threadStatus struct {
+	task    string
+	started time.Time
+	rows    uint64
+	bytes   uint64
+}
+
+// statusBoard is the work of the busy threads, by connection id.
+type statusBoard struct {
+	mu      sync.Mutex
+	threads map[int]*threadStatus
+}
+
+var status = &statusBoard{threads: make(map[int]*threadStatus)}
+
+// begin records the task taken by the thread.
+func (b *statusBoard) begin(id int, task string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threads[id] = &threadStatus{task: task, started: time.Now()}
+}
+
+// progress adds the rows and bytes done by the thread.
+func (b *statusBoard) progress(id int, rows int, bytes int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.threads[id]; ok {
+		s.rows += uint64(rows)
+		s.bytes += uint64(bytes)
+	}
+}
+
+// end marks the thread as idle.
+func (b *statusBoard) end(id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.threads, id)
+}
+
+// ReportStatus logs the running phase and the task of every busy thread.
+func ReportStatus(log *xlog.Log) {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+
+	ids := make([]int, 0, len(status.threads))
+	for id := range status.threads {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	log.Info("status.phase[%s].threads.busy[%d]", currentPhase(), len(ids))
+	for _, id := range ids {
+		s := status.threads[id]
+		log.Info("status.thread[%d].%s.rows[%d].bytes[%vMB].elapsed[%.2fsec]", id, s.task, s.rows, s.bytes/1024/1024, time.Since(s.started).Seconds())
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/common"
+)
+
+// Storage is where the dump files are written to and read from.
+// The files are named by their locations: plain paths for the local filesystem,
+// s3://bucket/key for the S3-compatible object stores.
+type Storage interface {
+	// Create returns the writer of the file, the file is complete once closed.
+	Create(file string) (io.WriteCloser, error)
+
+	// Open returns the reader of the file, the error satisfies os.IsNotExist if it's missing.
+	Open(file string) (io.ReadCloser, error)
+
+	// List returns all the files under the dir, recursively.
+	List(dir string) ([]string, error)
+
+	// Remove removes the file, a missing file isn't an error.
+	Remove(file string) error
+}
+
+// LocalStorage is the local filesystem.
+type LocalStorage struct{}
+
+// Create creates the file and its parent dirs, the file is renamed into place once closed.
+func (LocalStorage) Create(file string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	return createAtomic(file)
+}
+
+// tempSuffix ends the temporary files of the writes in progress, the loader skips them.
+const tempSuffix = ".tmp"
+
+// isTempFile returns true if the file is the temporary file of a write in progress,
+// or left by a crash.
+func isTempFile(file string) bool {
+	base := filepath.Base(file)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, tempSuffix)
+}
+
+// atomicFile is written to a temporary file of the same dir, then synced and renamed to its
+// name on Close: a crash leaves the old file or the new one, never a torn one.
+type atomicFile struct {
+	f    *os.File
+	name string
+	err  error
+}
+
+// createAtomic creates the temporary file of the file.
+func createAtomic(file string) (*atomicFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{f: f, name: file}, nil
+}
+
+// Write writes to the temporary file, after an error the file is discarded on Close.
+func (a *atomicFile) Write(p []byte) (int, error) {
+	n, err := a.f.Write(p)
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	return n, err
+}
+
+// Close syncs the temporary file and renames it into place, then syncs the dir to make the
+// rename durable.
+func (a *atomicFile) Close() error {
+	err := a.err
+	if err == nil {
+		err = a.f.Chmod(0644)
+	}
+	if err == nil {
+		err = a.f.Sync()
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(a.f.Name(), a.name)
+	}
+	if err != nil {
+		os.Remove(a.f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(a.name))
+}
+
+// syncDir syncs the dir entries.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Open opens the file.
+func (LocalStorage) Open(file string) (io.ReadCloser, error) {
+	return os.Open(file)
+}
+
+// List walks the dir.
+func (LocalStorage) List(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Remove removes the file.
+func (LocalStorage) Remove(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var storages sync.Map
+
+// StorageOf returns the storage of the location.
+// The stream location is the open tar stream of the --stream mode.
+// The S3 storages are configured by the environment, see NewS3StorageFromEnv.
+func StorageOf(location string) (Storage, error) {
+	if strings.HasPrefix(location, streamLocation) {
+		if s, ok := storages.Load(streamLocation); ok {
+			return s.(Storage), nil
+		}
+		return nil, errors.New("stream.is.not.open")
+	}
+	if !strings.HasPrefix(location, s3Scheme) {
+		return LocalStorage{}, nil
+	}
+	bucket, _ := splitS3Location(location)
+	key := s3Endpoint() + "/" + bucket
+	if s, ok := storages.Load(key); ok {
+		return s.(Storage), nil
+	}
+	s, err := NewS3StorageFromEnv(bucket)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := storages.LoadOrStore(key, s)
+	return actual.(Storage), nil
+}
+
+// joinLocation joins the dir and the file name, the location schemes are kept.
+func joinLocation(dir string, name string) string {
+	if dir == "" {
+		return name
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+// writeStorageFile writes the whole file to its storage.
+func writeStorageFile(file string, data string) error {
+	s, err := StorageOf(file)
+	if err != nil {
+		return err
+	}
+	w, err := s.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(common.StringToBytes(data)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// removeStorageFile removes the file from its storage.
+func removeStorageFile(file string) error {
+	s, err := StorageOf(file)
+	if err != nil {
+		return err
+	}
+	return s.Remove(file)
+}
+
+// openStorageFile opens the file of its storage.
+func openStorageFile(file string) (io.ReadCloser, error) {
+	s, err := StorageOf(file)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(file)
+}
+
+// readStorageFile reads the whole file from its storage.
+func readStorageFile(file string) ([]byte, error) {
+	r, err := openStorageFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// listStorageFiles lists the files under the dir of its storage.
+func listStorageFiles(dir string) ([]string, error) {
+	s, err := StorageOf(dir)
+	if err != nil {
+		return nil, err
+	}
+	return s.List(dir)
+}
+
+// countingReader counts the bytes read, the size of the remote files isn't known beforehand.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func newGzipWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+// openDumpFile opens the dump file, encrypted and gzipped files are decoded on the fly by their magic bytes.
+func openDumpFile(args *Args, file string) (io.Reader, io.Closer, error) {
+	f, err := openStorageFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(encryptMagic))
+	if string(magic) == encryptMagic {
+		if args.Cipher == nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("file[%s].is.encrypted.but.no.key.given", file)
+		}
+		dec, err := args.Cipher.Decrypt(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("file[%s].decrypt.error:%v", file, err)
+		}
+		br = bufio.NewReader(dec)
+	}
+	magic, _ = br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return gz, f, nil
+	}
+	return br, f, nil
+}
+
+// readDumpFile reads the whole dump file, decoded.
+func readDumpFile(args *Args, file string) ([]byte, error) {
+	r, closer, err := openDumpFile(args, file)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,331 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+// streamLocation is the dump location of the --stream mode, the files are the entries of one tar stream.
+const streamLocation = "stream:"
+
+// StreamStorage is the tar stream of the dump, the files are named by their base names.
+// On the dumper side every file becomes one entry once closed, on the loader side the
+// entries are kept in memory from their arrival until they are restored.
+type StreamStorage struct {
+	mu    sync.Mutex
+	tw    *tar.Writer
+	files map[string][]byte
+}
+
+// NewStreamStorage creates the stream storage writing the tar stream to w, w may be nil for reading.
+func NewStreamStorage(w io.Writer) *StreamStorage {
+	s := &StreamStorage{files: make(map[string][]byte)}
+	if w != nil {
+		s.tw = tar.NewWriter(w)
+	}
+	return s
+}
+
+type streamFile struct {
+	s    *StreamStorage
+	name string
+	buf  bytes.Buffer
+}
+
+func (f *streamFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+// Close writes the entry, the entries are never interleaved.
+func (f *streamFile) Close() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     f.name,
+		Mode:     0644,
+		Size:     int64(f.buf.Len()),
+		ModTime:  time.Now(),
+	}
+	if err := f.s.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := f.s.tw.Write(f.buf.Bytes())
+	return err
+}
+
+// Create returns the writer of the entry.
+func (s *StreamStorage) Create(file string) (io.WriteCloser, error) {
+	if s.tw == nil {
+		return nil, errors.New("stream.is.read.only")
+	}
+	return &streamFile{s: s, name: filepath.Base(file)}, nil
+}
+
+// Open returns the received entry.
+func (s *StreamStorage) Open(file string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[filepath.Base(file)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// List returns the received entries.
+func (s *StreamStorage) List(dir string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []string
+	for name := range s.files {
+		files = append(files, joinLocation(dir, name))
+	}
+	return files, nil
+}
+
+// Remove forgets the received entry, the written ones can't be taken back.
+func (s *StreamStorage) Remove(file string) error {
+	if s.tw != nil {
+		return fmt.Errorf("stream.entry[%s].already.written", filepath.Base(file))
+	}
+	s.release(filepath.Base(file))
+	return nil
+}
+
+// Close ends the tar stream.
+func (s *StreamStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tw == nil {
+		return nil
+	}
+	return s.tw.Close()
+}
+
+func (s *StreamStorage) put(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = data
+}
+
+func (s *StreamStorage) release(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+}
+
+// openStream registers the storage of the stream location, one stream at a time.
+func openStream(s *StreamStorage) {
+	storages.Store(streamLocation, s)
+}
+
+func closeStream() {
+	storages.Delete(streamLocation)
+}
+
+// DumpStream dumps as Dumper, but to the tar stream of w instead of the outdir.
+// The stream of an interrupted dump has no end, the loader sees it truncated.
+func DumpStream(ctx context.Context, log *xlog.Log, args *Args, w io.Writer) error {
+	if len(args.Incrementals) > 0 {
+		log.Panicf("dumping.stream.does.not.support.incremental")
+	}
+	s := NewStreamStorage(w)
+	openStream(s)
+	defer closeStream()
+
+	args.Outdir = streamLocation
+	if err := Dumper(ctx, log, args); err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// streamSum is the size and checksum of the received entry.
+type streamSum struct {
+	size int64
+	sum  string
+}
+
+// LoadStream loads the tar stream of DumpStream from r. The entries are dispatched as they arrive:
+// the schemas are restored in order, the chunks by the worker threads. The manifest comes last,
+// the entries are verified against it once all are loaded.
+// Once the context is done no new entry is read, the chunks in flight are loaded whole.
+func LoadStream(ctx context.Context, log *xlog.Log, args *Args, r io.Reader) error {
+	spare := 1
+	if adaptiveThrottle(args) {
+		spare = 2
+	}
+	pool, err := NewPool(log, args.Threads+spare, args.Address, args.User, args.Password, args.SessionVars, args.TLS)
+	AssertNil(err)
+	defer pool.Close()
+
+	args.Throttle = NewThrottle(log, args)
+	args.Throttle.Start(pool)
+	defer args.Throttle.Stop()
+
+	if args.Cipher == nil {
+		args.Cipher, err = LoadCipher(args.EncryptionKeyFile)
+		AssertNil(err)
+	}
+
+	s := NewStreamStorage(nil)
+	openStream(s)
+	defer closeStream()
+	args.Outdir = streamLocation
+
+	// The schemas are restored on their own connection, in the stream order.
+	schemaConn, err := pool.Get()
+	AssertNil(err)
+	defer pool.Put(schemaConn)
+
+	var wg sync.WaitGroup
+	var bytes uint64
+	var keyChecked bool
+	var loaded int64
+	sums := make(map[string]streamSum)
+	var manifest *Manifest
+	t := time.Now()
+	idx := 0
+
+	SetPhase("restoring.stream")
+	tr := tar.NewReader(r)
+	for ctx.Err() == nil {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		AssertNil(err)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Base(hdr.Name)
+		data, err := ioutil.ReadAll(tr)
+		AssertNil(err)
+		sum := sha256.Sum256(data)
+		sums[name] = streamSum{size: int64(len(data)), sum: hex.EncodeToString(sum[:])}
+		s.put(name, data)
+		file := joinLocation(streamLocation, name)
+
+		switch {
+		case name == metadataFile:
+			if !keyChecked {
+				checkDumpKey(log, args)
+				keyChecked = true
+			}
+			// Written again at the end of the dump, interrupted or not.
+			checkDumpFinished(log, args)
+			s.release(name)
+		case name == manifestFile:
+			// Kept apart from args: the chunks in flight read args.Manifest, and it comes last anyway.
+			manifest, err = ReadManifest(streamLocation)
+			AssertNil(err)
+			s.release(name)
+		case strings.HasSuffix(name, dbSuffix):
+			restoreDatabaseSchema(log, args, []string{file}, schemaConn)
+			s.release(name)
+		case strings.HasSuffix(name, schemaSuffix):
+			restoreTableSchema(log, args, []string{file}, schemaConn)
+			s.release(name)
+		case strings.HasSuffix(name, tableSuffix) || strings.HasSuffix(name, csvSuffix):
+			// Blocks until a worker is free, at most threads entries are kept in memory.
+			conn := getConn(ctx, pool)
+			if conn == nil {
+				s.release(name)
+				continue
+			}
+			wg.Add(1)
+
+			var dorisAddr string
+			if len(args.DorisHttpLoadAddress) > 0 {
+				dorisAddr = args.DorisHttpLoadAddress[idx%len(args.DorisHttpLoadAddress)]
+				idx++
+			}
+
+			go func(conn *Connection, addr string, name string, file string) {
+				status.begin(conn.ID, fmt.Sprintf("restoring.file[%s]", name))
+				defer func() {
+					status.end(conn.ID)
+					s.release(name)
+					wg.Done()
+					pool.Put(conn)
+				}()
+				r := restoreChunk(log, args, file, addr, conn)
+				atomic.AddUint64(&bytes, uint64(r))
+				atomic.AddInt64(&loaded, 1)
+			}(conn, dorisAddr, name, file)
+		case strings.HasSuffix(name, parquetSuffix):
+			// Not loadable, verified by its sum only.
+			s.release(name)
+		default:
+			log.Warning("loader.stream.skip.entry[%s]", name)
+			s.release(name)
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(t).Seconds()
+	if ctx.Err() != nil {
+		SetPhase("restoring.interrupted")
+		log.Warning("restoring.interrupted.cost[%.2fsec].chunks.loaded[%d].allbytes[%.2fMB]", elapsed, loaded, float64(bytes/1024/1024))
+		return ctx.Err()
+	}
+
+	if !args.SkipVerify {
+		if manifest == nil {
+			log.Panicf("loader.stream.manifest.not.found.the.stream.may.be.truncated")
+		}
+		AssertNil(verifyStreamSums(log, manifest, sums))
+		log.Info("loader.verify.files[%d].done...", len(manifest.Files))
+	}
+	SetPhase("restoring.done")
+	log.Info("restoring.all.done.cost[%.2fsec].allbytes[%.2fMB].rate[%.2fMB/s]", elapsed, float64(bytes/1024/1024), (float64(bytes/1024/1024) / elapsed))
+	return nil
+}
+
+// verifyStreamSums checks the received entries against the manifest.
+func verifyStreamSums(log *xlog.Log, m *Manifest, sums map[string]streamSum) error {
+	var first error
+	for _, entry := range m.Files {
+		var err error
+		got, ok := sums[entry.File]
+		switch {
+		case !ok:
+			err = fmt.Errorf("file[%s].missing", entry.File)
+		case got.size != entry.Size:
+			err = fmt.Errorf("file[%s].size.mismatch.want[%d].got[%d]", entry.File, entry.Size, got.size)
+		case got.sum != entry.SHA256:
+			err = fmt.Errorf("file[%s].sha256.mismatch.want[%s].got[%s]", entry.File, entry.SHA256, got.sum)
+		default:
+			continue
+		}
+		log.Error("verify.%v", err)
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
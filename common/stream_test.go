@@ -0,0 +1,129 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestStreamDumpLoad(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "id", Type: querypb.Type_INT32},
+			{Name: "name", Type: querypb.Type_VARCHAR},
+		},
+	}
+	for i := 0; i < 30000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("11")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxx")),
+		})
+	}
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Table", Type: querypb.Type_VARCHAR},
+			{Name: "Create Table", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`id` int(11) NOT NULL,`name` varchar(32)) ENGINE=InnoDB")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("drop table .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+	}
+
+	args := &Args{
+		Database:      "test",
+		Table:         "t1",
+		User:          "mock",
+		Password:      "mock",
+		Address:       address,
+		ChunksizeInMB: 1,
+		Threads:       4,
+		StmtSize:      100000,
+		IntervalMs:    500,
+		Compress:      true,
+	}
+
+	var stream bytes.Buffer
+	assert.Nil(t, DumpStream(context.Background(), log, args, &stream))
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(stream.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		names = append(names, hdr.Name)
+	}
+	// The schemas come before the chunks, the manifest and the final metadata last.
+	assert.Equal(t, metadataFile, names[0])
+	assert.Equal(t, "test-schema-create.sql", names[1])
+	assert.Equal(t, "test.t1-schema.sql", names[2])
+	assert.Equal(t, "test.t1.00001.sql", names[3])
+	assert.Equal(t, manifestFile, names[len(names)-2])
+	assert.Equal(t, metadataFile, names[len(names)-1])
+	chunks := len(names) - 5
+	assert.True(t, chunks > 1)
+
+	fakedbs.ResetAll()
+	fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("drop table .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+
+	loadArgs := &Args{
+		User:            "mock",
+		Password:        "mock",
+		Address:         address,
+		Threads:         2,
+		IntervalMs:      500,
+		OverwriteTables: true,
+	}
+	assert.Nil(t, LoadStream(context.Background(), log, loadArgs, bytes.NewReader(stream.Bytes())))
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("drop table if exists `test`.`t1`"))
+
+	// A corrupted entry fails the verify.
+	data := stream.Bytes()
+	idx := bytes.LastIndex(data, []byte("\"sha256\": \""))
+	corrupted := append([]byte(nil), data...)
+	corrupted[idx+len("\"sha256\": \"")] ^= 1
+	assert.Panics(t, func() {
+		LoadStream(context.Background(), log, loadArgs, bytes.NewReader(corrupted))
+	})
+}
@@ -0,0 +1,264 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+const (
+	// throttleBatchRows is the number of rows a worker accounts at once.
+	throttleBatchRows = 256
+
+	defaultThrottleIntervalMs = 1000
+)
+
+// RateLimiter is a token bucket shared by all the workers.
+// The bucket holds one second worth of tokens.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates the limiter of rate tokens per second, nil if rate is not positive.
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// WaitN blocks until n tokens are available.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// Throttle protects the server from the workers: it limits the bytes and rows
+// per second and pauses the workers while the server is overloaded.
+type Throttle struct {
+	log   *xlog.Log
+	bytes *RateLimiter
+	rows  *RateLimiter
+
+	maxThreadsRunning int
+	maxReplicaLag     int
+	interval          time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewThrottle creates the throttle from the args, nil if nothing is throttled.
+func NewThrottle(log *xlog.Log, args *Args) *Throttle {
+	if args.RateLimitMB <= 0 && args.RateLimitRows <= 0 && !adaptiveThrottle(args) {
+		return nil
+	}
+	interval := args.ThrottleIntervalMs
+	if interval <= 0 {
+		interval = defaultThrottleIntervalMs
+	}
+	t := &Throttle{
+		log:               log,
+		bytes:             NewRateLimiter(float64(args.RateLimitMB) * 1024 * 1024),
+		rows:              NewRateLimiter(float64(args.RateLimitRows)),
+		maxThreadsRunning: args.MaxThreadsRunning,
+		maxReplicaLag:     args.MaxReplicaLag,
+		interval:          time.Millisecond * time.Duration(interval),
+		done:              make(chan struct{}),
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// adaptiveThrottle returns true if the server load is polled.
+func adaptiveThrottle(args *Args) bool {
+	return args.MaxThreadsRunning > 0 || args.MaxReplicaLag > 0
+}
+
+// Wait blocks while the throttle is paused, then accounts the bytes and rows.
+func (t *Throttle) Wait(bytes int, rows int) {
+	t.Pause()
+	t.Limit(bytes, rows)
+}
+
+// Pause blocks while the throttle is paused. The pause lasts as long as the overload,
+// so no cursor must be open: the server would drop it past its net_write_timeout.
+func (t *Throttle) Pause() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	for t.paused {
+		t.cond.Wait()
+	}
+	t.mu.Unlock()
+}
+
+// Limit accounts the bytes and rows, it blocks for their share of the rates only.
+func (t *Throttle) Limit(bytes int, rows int) {
+	if t == nil {
+		return
+	}
+	t.bytes.WaitN(bytes)
+	t.rows.WaitN(rows)
+}
+
+// Paused returns true if the workers are paused.
+func (t *Throttle) Paused() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+func (t *Throttle) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paused == paused {
+		return
+	}
+	t.paused = paused
+	if !paused {
+		t.cond.Broadcast()
+	}
+}
+
+// Start polls the server load with a spare connection of the pool.
+func (t *Throttle) Start(pool *Pool) {
+	if t == nil || (t.maxThreadsRunning <= 0 && t.maxReplicaLag <= 0) {
+		return
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		t.log.Error("throttle.get.conn.error[%v].disabled", err)
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer func() {
+			pool.Put(conn)
+			t.wg.Done()
+		}()
+
+		tick := time.NewTicker(t.interval)
+		defer tick.Stop()
+		for {
+			t.check(conn)
+			select {
+			case <-t.done:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+}
+
+// Stop stops polling and releases the paused workers.
+func (t *Throttle) Stop() {
+	if t == nil {
+		return
+	}
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+	t.wg.Wait()
+	t.setPaused(false)
+}
+
+func (t *Throttle) check(conn *Connection) {
+	overloaded := false
+	if t.maxThreadsRunning > 0 {
+		running, err := threadsRunning(conn)
+		if err != nil {
+			t.log.Warning("throttle.threads.running.error:%v", err)
+		} else if running > t.maxThreadsRunning {
+			t.log.Warning("throttle.threads.running[%d].exceeds[%d].pause...", running, t.maxThreadsRunning)
+			overloaded = true
+		}
+	}
+	if t.maxReplicaLag > 0 && !overloaded {
+		lag, ok, err := replicaLag(conn)
+		if err != nil {
+			t.log.Warning("throttle.replica.lag.error:%v", err)
+		} else if ok && lag > t.maxReplicaLag {
+			t.log.Warning("throttle.replica.lag[%ds].exceeds[%ds].pause...", lag, t.maxReplicaLag)
+			overloaded = true
+		}
+	}
+	if t.Paused() && !overloaded {
+		t.log.Info("throttle.resume...")
+	}
+	t.setPaused(overloaded)
+}
+
+func threadsRunning(conn *Connection) (int, error) {
+	qr, err := conn.Fetch("SHOW GLOBAL STATUS LIKE 'Threads_running'")
+	if err != nil {
+		return 0, err
+	}
+	if len(qr.Rows) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(qr.Rows[0][1].String())
+}
+
+// replicaLag returns the Seconds_Behind_Master, ok is false if the server isn't a replica.
+func replicaLag(conn *Connection) (int, bool, error) {
+	qr, err := conn.Fetch("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, false, err
+	}
+	if len(qr.Rows) == 0 {
+		return 0, false, nil
+	}
+	for i, f := range qr.Fields {
+		if strings.EqualFold(f.Name, "Seconds_Behind_Master") {
+			v := qr.Rows[0][i]
+			if v.IsNull() {
+				return 0, false, nil
+			}
+			lag, err := strconv.Atoi(v.String())
+			return lag, err == nil, err
+		}
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xelabs/go-mysqlstack/driver"
+	querypb "github.com/xelabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/xelabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/xelabs/go-mysqlstack/xlog"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, NewRateLimiter(0))
+	var nilLimiter *RateLimiter
+	nilLimiter.WaitN(100)
+
+	// The first second is the burst, the second one must be waited.
+	l := NewRateLimiter(10000)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		l.WaitN(1000)
+	}
+	assert.True(t, time.Since(start) >= 800*time.Millisecond)
+}
+
+func threadsRunningResult(n string) *sqltypes.Result {
+	return &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Variable_name", Type: querypb.Type_VARCHAR},
+			{Name: "Value", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("Threads_running")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(n)),
+			},
+		},
+	}
+}
+
+func TestThrottlePause(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	args := &Args{
+		User:               "mock",
+		Password:           "mock",
+		Address:            address,
+		MaxThreadsRunning:  10,
+		ThrottleIntervalMs: 10,
+	}
+	assert.Nil(t, NewThrottle(log, &Args{}))
+
+	fakedbs.AddQueryPattern("show global status like .*", threadsRunningResult("50"))
+
+	pool, err := NewPool(log, 1, address, "mock", "mock", "", nil)
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	throttle := NewThrottle(log, args)
+	throttle.Start(pool)
+	for i := 0; i < 100 && !throttle.Paused(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, throttle.Paused())
+
+	done := make(chan struct{})
+	go func() {
+		throttle.Wait(1, 1)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("wait.must.block.while.paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The load goes down.
+	fakedbs.ResetAll()
+	fakedbs.AddQueryPattern("show global status like .*", threadsRunningResult("2"))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait.must.resume")
+	}
+	assert.False(t, throttle.Paused())
+	throttle.Stop()
+}